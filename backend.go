@@ -0,0 +1,76 @@
+package test
+
+import (
+	"errors"
+	"os"
+)
+
+// Backend decides how services are launched
+type Backend string
+
+// supported backends
+const (
+	// BackendNative runs services with executables installed on the host
+	BackendNative Backend = "native"
+	// BackendDocker runs services in containers
+	BackendDocker Backend = "docker"
+	// BackendAuto runs services natively if their executables are installed,
+	// otherwise in containers
+	BackendAuto Backend = "auto"
+)
+
+const (
+	// EnvBackend is the environment variable to select the default backend of
+	// launchers, e.g. CSIGO_TEST_BACKEND=auto
+	EnvBackend = "CSIGO_TEST_BACKEND"
+)
+
+var (
+	// ErrBackendUnavailable is returned when the backend of a service isn't
+	// available on the host, e.g. executables aren't installed or docker isn't
+	// running
+	ErrBackendUnavailable = errors.New("backend unavailable")
+)
+
+// LauncherOption defines option function to setup launcher
+type LauncherOption func(*serviceLauncherImpl)
+
+// LauncherBackend sets the default backend of services started by the launcher,
+// which overrides env CSIGO_TEST_BACKEND
+func LauncherBackend(b Backend) LauncherOption {
+	return func(s *serviceLauncherImpl) {
+		s.backend = b
+	}
+}
+
+// ServiceBackend sets the backend of a single service, which overrides the default
+// backend of the launcher
+func ServiceBackend(b Backend) ServiceOption {
+	return withBase("backend", func(sb *serviceBase) {
+		sb.backend = b
+	})
+}
+
+// nativeChecker is implemented by services which need executables on the host to
+// start natively
+type nativeChecker interface {
+	checkNative() error
+}
+
+// checkNative returns nil if the service can start natively. Services which don't
+// implement nativeChecker, e.g. running in process, can always start natively.
+func checkNative(srv Service) error {
+	if c, ok := srv.(nativeChecker); ok {
+		return c.checkNative()
+	}
+	return nil
+}
+
+// backendFromEnv returns the backend named by env CSIGO_TEST_BACKEND, or def if it's
+// not set
+func backendFromEnv(def Backend) Backend {
+	if b := os.Getenv(EnvBackend); b != "" {
+		return Backend(b)
+	}
+	return def
+}
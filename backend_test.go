@@ -0,0 +1,68 @@
+package test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// nativeLessService is a service which can't start natively
+type nativeLessService struct {
+	gnatsdService
+}
+
+func (s *nativeLessService) checkNative() error {
+	return errors.New("not installed")
+}
+
+func TestResolveBackend(t *testing.T) {
+	sl := newServiceLauncher(BackendAuto)
+
+	cl, err := sl.resolveBackend(&gnatsdService{})
+	assert.NoError(t, err)
+	assert.Nil(t, cl, "auto should prefer native")
+
+	_, dockerErr := sl.docker()
+	cl, err = sl.resolveBackend(&nativeLessService{})
+	if dockerErr != nil {
+		assert.True(t, errors.Is(err, ErrBackendUnavailable), "should inform backend unavailable")
+	} else {
+		assert.NoError(t, err)
+		assert.NotNil(t, cl, "auto should fall back to docker")
+	}
+
+	srv := &gnatsdService{}
+	assert.NoError(t, ServiceBackend(BackendDocker)(srv))
+	cl, err = sl.resolveBackend(srv)
+	if dockerErr != nil {
+		assert.True(t, errors.Is(err, ErrBackendUnavailable), "should inform backend unavailable")
+	} else {
+		assert.NoError(t, err)
+		assert.NotNil(t, cl, "service backend should override launcher backend")
+	}
+
+	assert.NoError(t, ServiceBackend(BackendNative)(srv))
+	cl, err = sl.resolveBackend(srv)
+	assert.NoError(t, err)
+	assert.Nil(t, cl)
+
+	_, err = newServiceLauncher(BackendNative).resolveBackend(&nativeLessService{})
+	assert.True(t, errors.Is(err, ErrBackendUnavailable), "should inform backend unavailable")
+
+	assert.NoError(t, ServiceBackend("unknown")(srv))
+	_, err = sl.resolveBackend(srv)
+	assert.Error(t, err)
+}
+
+func TestBackendFromEnv(t *testing.T) {
+	defer os.Setenv(EnvBackend, os.Getenv(EnvBackend))
+
+	os.Unsetenv(EnvBackend)
+	assert.Equal(t, BackendNative, NewServiceLauncher().(*serviceLauncherImpl).backend)
+
+	os.Setenv(EnvBackend, string(BackendAuto))
+	assert.Equal(t, BackendAuto, NewServiceLauncher().(*serviceLauncherImpl).backend)
+	assert.Equal(t, BackendDocker, NewServiceLauncher(LauncherBackend(BackendDocker)).(*serviceLauncherImpl).backend)
+}
@@ -0,0 +1,454 @@
+package test
+
+// This file shares long-lived services among test binaries.
+// 1) A broker process owns service instances and listens on a unix socket.
+// 2) A test binary leases a service by its type and options, which are the options
+//    of environment specs. Leases of the same type and options share an instance but
+//    get isolated namespaces, e.g. redis db index or zookeeper chroot.
+// 3) A lease lasts as long as its connection to the broker, so leases of crashed
+//    test binaries are released as well. Instances without leases are stopped after
+//    an idle timeout.
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+const (
+	// EnvBroker is the environment variable of the broker socket. Shared services
+	// are leased from the broker if it's set, e.g. CSIGO_TEST_BROKER=/tmp/broker.sock
+	EnvBroker = "CSIGO_TEST_BROKER"
+
+	// maxRedisDB is the number of databases of a redis instance
+	maxRedisDB = 16
+	// brokerNamespaceTimeout bounds clearing a released namespace
+	brokerNamespaceTimeout = 30 * time.Second
+)
+
+var (
+	// DefaultBrokerSocket is the socket the broker listens on by default
+	DefaultBrokerSocket = filepath.Join(os.TempDir(), "csigo-test-broker.sock")
+)
+
+// leaseRequest is sent by clients to lease a service
+type leaseRequest struct {
+	Type    ServiceType       `json:"type"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// leaseResponse is sent by the broker once the service is ready
+type leaseResponse struct {
+	IPPort    string `json:"ipport"`
+	Namespace string `json:"namespace"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Lease is a service leased from the broker
+type Lease struct {
+	// IPPort is the listening ip:port of the service
+	IPPort string
+	// Namespace isolates the lease from other leases of the same service. It's the
+	// db index of redis, chroot of zookeeper, key prefix of etcd and consul, and name
+	// prefix of others, e.g. index prefix of elasticsearch.
+	Namespace string
+	conn      net.Conn
+}
+
+// Release returns the lease to the broker
+func (l *Lease) Release() error {
+	return l.conn.Close()
+}
+
+// LeaseService leases a service of the given type and options from the broker
+// listening on socket. Options are named as in environment specs.
+func LeaseService(ctx context.Context, socket string, t ServiceType, options map[string]string) (*Lease, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("fail to connect broker %s, err:%v", socket, err)
+	}
+	// unblock the decoder once ctx is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	if err := json.NewEncoder(conn).Encode(&leaseRequest{Type: t, Options: options}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp := leaseResponse{}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("fail to lease %v, err:%v", t, err)
+	}
+	if resp.Error != "" {
+		conn.Close()
+		return nil, errors.New(resp.Error)
+	}
+	return &Lease{IPPort: resp.IPPort, Namespace: resp.Namespace, conn: conn}, nil
+}
+
+// StartSharedForTest leases a service from the broker named by env CSIGO_TEST_BROKER
+// and returns its ip:port and namespace. The lease is released via t.Cleanup. If the
+// env isn't set, a private service is started by StartForTest instead, and its
+// namespace is the one of the first lease.
+func StartSharedForTest(t testing.TB, typ ServiceType, options map[string]string) (ipport, namespace string) {
+	t.Helper()
+
+	socket := os.Getenv(EnvBroker)
+	if socket == "" {
+		srv := &ServiceSpec{Type: typ, Options: options}
+		opts, err := srv.options(nil)
+		if err != nil {
+			t.Fatalf("invalid options of %v, err:%v", typ, err)
+		}
+		if typ == ZooKeeper {
+			opts = append(opts, ZkChroot(namespaceOf(typ, 0)))
+		}
+		return StartForTest(t, typ, opts...), namespaceOf(typ, 0)
+	}
+	lease, err := LeaseService(context.Background(), socket, typ, options)
+	if err != nil {
+		t.Fatalf("fail to lease %v, err:%v", typ, err)
+	}
+	t.Cleanup(func() {
+		lease.Release()
+	})
+	return lease.IPPort, lease.Namespace
+}
+
+// namespaceOf returns the i-th namespace of the service type
+func namespaceOf(t ServiceType, i int) string {
+	switch t {
+	case Redis:
+		return strconv.Itoa(i)
+	case ZooKeeper:
+		return fmt.Sprintf("/csigo-%d", i)
+	case Etcd:
+		return fmt.Sprintf("/csigo-%d/", i)
+	case Consul:
+		return fmt.Sprintf("csigo-%d/", i)
+	}
+	return fmt.Sprintf("csigo-%d-", i)
+}
+
+// createNamespace creates the i-th namespace in the service at ipport if it has to
+// exist before use, i.e. the zookeeper chroot
+func createNamespace(ctx context.Context, srv interface{}, t ServiceType, ipport string, i int) error {
+	switch s := srv.(type) {
+	case *zkService:
+		conn, err := s.connect([]string{ipport})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return zkCreateAll(ctx, conn, namespaceOf(t, i), nil, nil)
+	}
+	return nil
+}
+
+// clearNamespace deletes data in the i-th namespace of the service at ipport, so the
+// next lease of the namespace starts clean
+func clearNamespace(ctx context.Context, srv interface{}, t ServiceType, ipport string, i int) error {
+	ns := namespaceOf(t, i)
+	switch s := srv.(type) {
+	case *redisService:
+		conn, err := redisDial(ctx, ipport, s.auth)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if _, err := conn.Do("SELECT", i); err != nil {
+			return err
+		}
+		_, err = conn.Do("FLUSHDB")
+		return err
+	case *zkService:
+		conn, err := s.connect([]string{ipport})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return zkDeleteAll(ctx, conn, ns)
+	case *etcdService:
+		return etcdV3(ctx, ipport, "/v3/kv/deleterange",
+			map[string]interface{}{"key": []byte(ns), "range_end": etcdPrefixEnd(ns)}, nil)
+	case *consulService:
+		config := consul.DefaultConfig()
+		config.Address = ipport
+		client, err := consul.NewClient(config)
+		if err != nil {
+			return err
+		}
+		_, err = client.KV().DeleteTree(ns, (&consul.WriteOptions{}).WithContext(ctx))
+		return err
+	case *esService:
+		// wildcards match no index without error
+		req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s/%s*", ipport, ns), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("unexpected status %d of deleting %s*", resp.StatusCode, ns)
+		}
+	}
+	return nil
+}
+
+// etcdPrefixEnd returns the range end of keys with the prefix
+func etcdPrefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// all keys from the prefix on
+	return []byte{0}
+}
+
+// Broker owns shared services and leases them to test binaries
+type Broker struct {
+	socket string
+	idle   time.Duration
+	sl     *serviceLauncherImpl
+
+	sync.Mutex
+	// shared are keyed by fingerprint of type and options
+	shared map[string]*sharedService
+}
+
+// sharedService is a service instance shared by leases
+type sharedService struct {
+	// ready is closed once the service is started or failed
+	ready  chan struct{}
+	ipport string
+	stop   func() error
+	err    error
+	// leased are namespace indexes in use
+	leased map[int]bool
+	// dirty are namespace indexes failed to clear, which are never leased again
+	dirty map[int]bool
+	idle  *time.Timer
+}
+
+// NewBroker returns a broker listening on socket, which stops services once they
+// aren't leased for idle
+func NewBroker(socket string, idle time.Duration, options ...LauncherOption) *Broker {
+	return &Broker{
+		socket: socket,
+		idle:   idle,
+		sl:     newServiceLauncher(backendFromEnv(BackendNative), options...),
+		shared: map[string]*sharedService{},
+	}
+}
+
+// Serve accepts leases until ctx is done, then stops all services
+func (b *Broker) Serve(ctx context.Context) error {
+	os.Remove(b.socket)
+	l, err := net.Listen("unix", b.socket)
+	if err != nil {
+		return fmt.Errorf("fail to listen %s, err:%v", b.socket, err)
+	}
+	defer os.Remove(b.socket)
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	var wg sync.WaitGroup
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.handle(ctx, conn)
+		}()
+	}
+	wg.Wait()
+
+	b.Lock()
+	for _, srv := range b.shared {
+		if srv.idle != nil {
+			srv.idle.Stop()
+		}
+	}
+	b.shared = map[string]*sharedService{}
+	b.Unlock()
+	return b.sl.StopAll()
+}
+
+// handle serves a lease until its connection is closed
+func (b *Broker) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	// the connection is closed once ctx is done to release the lease
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	req := leaseRequest{}
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+	key, srv, ns, err := b.acquire(ctx, &req)
+	resp := leaseResponse{}
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.IPPort = srv.ipport
+		resp.Namespace = namespaceOf(req.Type, ns)
+		defer b.clearAndRelease(ctx, req.Type, key, srv, ns)
+	}
+	if err := json.NewEncoder(conn).Encode(&resp); err != nil || resp.Error != "" {
+		return
+	}
+	// wait for the client to close
+	ioutil.ReadAll(conn)
+}
+
+// acquire leases the shared service of the request, starting it if necessary
+func (b *Broker) acquire(ctx context.Context, req *leaseRequest) (string, *sharedService, int, error) {
+	key := fingerprint(req.Type, req.Options)
+	b.Lock()
+	srv, ok := b.shared[key]
+	if !ok {
+		srv = &sharedService{ready: make(chan struct{}), leased: map[int]bool{}, dirty: map[int]bool{}}
+		b.shared[key] = srv
+		go b.start(ctx, key, srv, req)
+	}
+	if srv.idle != nil {
+		srv.idle.Stop()
+		srv.idle = nil
+	}
+	// reserve the namespace before the service is ready, so that it's kept even if
+	// other leases are released meanwhile
+	ns := 0
+	for srv.leased[ns] || srv.dirty[ns] {
+		ns++
+	}
+	if req.Type == Redis && ns >= maxRedisDB {
+		b.Unlock()
+		return "", nil, 0, fmt.Errorf("all %d redis dbs are leased", maxRedisDB)
+	}
+	srv.leased[ns] = true
+	b.Unlock()
+
+	select {
+	case <-srv.ready:
+	case <-ctx.Done():
+		b.release(key, srv, ns)
+		return "", nil, 0, ctx.Err()
+	}
+	if srv.err != nil {
+		b.release(key, srv, ns)
+		return "", nil, 0, srv.err
+	}
+	if err := createNamespace(ctx, b.sl.Get(srv.ipport), req.Type, srv.ipport, ns); err != nil {
+		b.release(key, srv, ns)
+		return "", nil, 0, fmt.Errorf("fail to create namespace %s, err:%v", namespaceOf(req.Type, ns), err)
+	}
+	return key, srv, ns, nil
+}
+
+// start starts the shared service and removes it if fails
+func (b *Broker) start(ctx context.Context, key string, srv *sharedService, req *leaseRequest) {
+	defer close(srv.ready)
+	opts, err := (&ServiceSpec{Type: req.Type, Options: req.Options}).options(nil)
+	if err == nil {
+		srv.ipport, srv.stop, err = b.sl.StartContext(ctx, req.Type, opts...)
+	}
+	if err != nil {
+		srv.err = err
+		b.Lock()
+		delete(b.shared, key)
+		b.Unlock()
+	}
+}
+
+// clearAndRelease clears data in the namespace before releasing it. The namespace
+// is never leased again if it fails to clear.
+func (b *Broker) clearAndRelease(ctx context.Context, t ServiceType, key string, srv *sharedService, ns int) {
+	// ctx may be done as the broker stops, and the service is stopped anyway
+	cctx, cancel := context.WithTimeout(context.Background(), brokerNamespaceTimeout)
+	defer cancel()
+	if err := clearNamespace(cctx, b.sl.Get(srv.ipport), t, srv.ipport, ns); err != nil {
+		logf(ctx, LevelWarn, "fail to clear namespace %s, err:%v", namespaceOf(t, ns), err)
+		b.Lock()
+		srv.dirty[ns] = true
+		b.Unlock()
+	}
+	b.release(key, srv, ns)
+}
+
+// release returns the namespace and stops the service after idle timeout if it's
+// no longer leased
+func (b *Broker) release(key string, srv *sharedService, ns int) {
+	b.Lock()
+	defer b.Unlock()
+
+	delete(srv.leased, ns)
+	if len(srv.leased) != 0 || srv.err != nil {
+		return
+	}
+	srv.idle = time.AfterFunc(b.idle, func() {
+		b.Lock()
+		if len(srv.leased) != 0 || b.shared[key] != srv {
+			b.Unlock()
+			return
+		}
+		delete(b.shared, key)
+		b.Unlock()
+		srv.stop()
+	})
+}
+
+// fingerprint identifies services of the type and options
+func fingerprint(t ServiceType, options map[string]string) string {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n", t)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%s\n", name, options[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
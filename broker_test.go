@@ -0,0 +1,76 @@
+package test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprint(t *testing.T) {
+	assert.Equal(t,
+		fingerprint(Redis, map[string]string{"port": "6379", "auth": "x"}),
+		fingerprint(Redis, map[string]string{"auth": "x", "port": "6379"}))
+	assert.NotEqual(t,
+		fingerprint(Redis, map[string]string{"port": "6379"}),
+		fingerprint(Redis, map[string]string{"port": "6380"}))
+	assert.NotEqual(t, fingerprint(Redis, nil), fingerprint(Etcd, nil))
+}
+
+func TestEtcdPrefixEnd(t *testing.T) {
+	assert.Equal(t, []byte("/csigo-10"), etcdPrefixEnd("/csigo-1/"))
+	assert.Equal(t, []byte{'b'}, etcdPrefixEnd("a\xff"))
+	assert.Equal(t, []byte{0}, etcdPrefixEnd("\xff"))
+}
+
+func TestBroker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "broker-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "broker.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- NewBroker(socket, 200*time.Millisecond).Serve(ctx)
+	}()
+	defer func() {
+		cancel()
+		assert.NoError(t, <-served)
+	}()
+	assert.NoError(t, WaitReady(ctx, socket, 5*time.Second, DefaultBackoff, ProbeFunc(
+		func(ctx context.Context, socket string) error {
+			_, err := os.Stat(socket)
+			return err
+		})))
+
+	l1, err := LeaseService(ctx, socket, Gnatsd, nil)
+	if err != nil {
+		t.Skipf("unable to lease gnatsd, err:%v", err)
+	}
+	l2, err := LeaseService(ctx, socket, Gnatsd, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, l1.IPPort, l2.IPPort, "leases should share the service")
+	assert.NotEqual(t, l1.Namespace, l2.Namespace, "leases should be isolated")
+
+	_, err = LeaseService(ctx, socket, unavailable, map[string]string{"backend": "native"})
+	assert.Error(t, err)
+
+	// the service is kept while leased
+	assert.NoError(t, l1.Release())
+	time.Sleep(500 * time.Millisecond)
+	conn, err := net.DialTimeout("tcp", l2.IPPort, time.Second)
+	assert.NoError(t, err)
+	conn.Close()
+
+	// and stopped after idle timeout
+	assert.NoError(t, l2.Release())
+	time.Sleep(500 * time.Millisecond)
+	_, err = net.DialTimeout("tcp", l2.IPPort, time.Second)
+	assert.Error(t, err)
+}
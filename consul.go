@@ -7,6 +7,7 @@ package test
 // 2) It guarantees that both the service port is listening and the leader is elected.
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -20,13 +21,17 @@ import (
 )
 
 const (
-	consulChkTimesListen = 20                    // consulChkTimesListen is the number of times to retry for port listening.
-	consulChkDelayListen = 50 * time.Millisecond // consulChkDelayListen is the waiting time for next retry for port listening.
+	consulStopTimeout = time.Second // consulStopTimeout is how long the agent has to exit after SIGTERM before it's killed.
 
-	// Constants to check leader election mechanism, which usually takes 1-2 seconds.
-	// Thus, we use 5 seconds as the time limit for the checking.
-	consulChkTimesLeader = 10                     // consulChkTimesLeader is the number of times to retry for leader election.
-	consulChkDelayLeader = 500 * time.Millisecond // consulChkDelayLeader is the waiting time for next retry for leader election.
+	// Leader election mechanism usually takes 1-2 seconds after the port is listening.
+	// Thus, we use 6 seconds as the time limit for the checking.
+	consulReadyTimeout = 6 * time.Second
+
+	consulDockerPort        = 8500         // consulDockerPort is the http port inside the container.
+	consulDockerServerPort  = 8300         // consulDockerServerPort is the server rpc port inside the container.
+	consulDockerSerfLanPort = 8301         // consulDockerSerfLanPort is the LAN gossip port inside the container.
+	consulDockerSerfWanPort = 8302         // consulDockerSerfWanPort is the WAN gossip port inside the container.
+	consulLogFileName       = "consul.log" // consulLogFileName captures output of the consul agent.
 )
 
 func init() {
@@ -42,7 +47,7 @@ func init() {
 type consulConfig struct {
 	BootstrapExpect int                `json:"bootstrap_expect"`
 	Server          bool               `json:"server"`
-	DataDir         string             `json:"data_dir"`
+	DataDir         string             `json:"data_dir,omitempty"`
 	Ports           *consulPortsConfig `json:"ports"`
 }
 
@@ -51,34 +56,54 @@ type consulConfig struct {
 // Ref: https://github.com/hashicorp/consul/blob/master/command/agent/config.go#L23
 //      https://www.consul.io/docs/agent/options.html#ports
 type consulPortsConfig struct {
-	DNS     int `json:"dns"`      // DNS Query interface
-	HTTP    int `json:"http"`     // HTTP API
-	HTTPS   int `json:"https"`    // HTTPS API
-	RPC     int `json:"rpc" `     // CLI RPC
-	SerfLan int `json:"serf_lan"` // LAN gossip (Client + Server)
-	SerfWan int `json:"serf_wan"` // WAN gossip (Server only)
-	Server  int `json:"server"`   // Server internal RPC
+	DNS     int `json:"dns,omitempty"`      // DNS Query interface
+	HTTP    int `json:"http,omitempty"`     // HTTP API
+	HTTPS   int `json:"https,omitempty"`    // HTTPS API
+	RPC     int `json:"rpc,omitempty"`      // CLI RPC
+	SerfLan int `json:"serf_lan,omitempty"` // LAN gossip (Client + Server)
+	SerfWan int `json:"serf_wan,omitempty"` // WAN gossip (Server only)
+	Server  int `json:"server,omitempty"`   // Server internal RPC
 }
 
 // consulService is the consul service.
 type consulService struct {
+	serviceBase
+
 	// cmd is the command to run consul.
 	cmd *exec.Cmd
 
 	// port is the http port for consul service.
 	port int
+
+	// ports are all ports of consul service.
+	ports *consulPortsConfig
+
+	// workDir stores config, data and log of consul service.
+	workDir string
 }
 
 // Start runs the consul service and returns its ip port.
 func (s *consulService) Start() (ipport string, err error) {
-	if err := CheckExecutable("consul"); err != nil {
+	return s.StartContext(context.Background())
+}
+
+// StartContext runs the consul service and returns its ip port. The agent is killed
+// if ctx is done before it's ready.
+func (s *consulService) StartContext(ctx context.Context) (ipport string, err error) {
+	if err := s.checkNative(); err != nil {
 		return "", fmt.Errorf("Consul is not installed: %v", err)
 	}
 	workDir, err := ioutil.TempDir("", "consul")
+	s.workDir = workDir
 	if err != nil {
 		return "", fmt.Errorf("Fail to generate work dir: %v", err)
 	}
-	ports, err := BookPorts(5)
+	defer func() {
+		if err != nil {
+			s.StopContext(context.Background())
+		}
+	}()
+	ports, err := s.bookPorts(5)
 	if err != nil {
 		return "", fmt.Errorf("Fail to book ports for consul: %v", err)
 	}
@@ -107,77 +132,250 @@ func (s *consulService) Start() (ipport string, err error) {
 	s.cmd = exec.Command(
 		"consul", "agent", "-bind", "127.0.0.1", "-config-file", configFile,
 	)
+	logFile, err := os.Create(filepath.Join(workDir, consulLogFileName))
+	if err != nil {
+		return "", fmt.Errorf("Fail to create log file: %v", err)
+	}
+	defer logFile.Close()
+	s.cmd.Stdout = logFile
+	s.cmd.Stderr = logFile
 	if err := s.cmd.Start(); err != nil {
 		return "", fmt.Errorf("Fail to start consul: %v", err)
 	}
+	if err := markOwner(Consul, workDir, []int{s.cmd.Process.Pid}); err != nil {
+		return "", fmt.Errorf("Fail to mark owner: %v", err)
+	}
 	s.port = config.Ports.HTTP
+	s.ports = config.Ports
 
-	// Make sure that the server is running.
-	if err := checkPortListening(s.port, consulChkTimesListen, consulChkDelayListen); err != nil {
-		return "", fmt.Errorf("Port is not listening: %v", err)
-	}
-	if err := checkLeaderElected(s.port, consulChkTimesLeader, consulChkDelayLeader); err != nil {
-		return "", fmt.Errorf("Leader election mechanism fails: %v", err)
+	// Make sure that the server is running and the leader is elected.
+	ipport = fmt.Sprintf("localhost:%d", s.port)
+	if err := s.waitReady(ctx, ipport, consulReadyTimeout, TCPProbe(), consulLeaderProbe()); err != nil {
+		return "", fmt.Errorf("Consul is not ready: %v", err)
 	}
-	return fmt.Sprintf("localhost:%d", s.port), nil
+	return ipport, nil
 }
 
-// checkPortListening checks whether the port is listening or not.
-// - port : The port to check.
-// - times: Total number of checks.
-// - delay: Time delay between checks.
-func checkPortListening(port, times int, delay time.Duration) error {
-	for i := 0; i < times; i++ {
-		time.Sleep(delay)
-		if CheckListening(port) {
-			return nil
+// consulLeaderProbe checks whether the leader is elected for the consul service or not.
+func consulLeaderProbe() ReadinessProbe {
+	return ProbeFunc(func(ctx context.Context, ipport string) error {
+		config := consul.DefaultConfig()
+		config.Address = ipport
+		client, err := consul.NewClient(config)
+		if err != nil {
+			return fmt.Errorf("Fail to build connection with consul agent: %v", err)
+		}
+		leader, err := client.Status().Leader()
+		if err != nil {
+			return fmt.Errorf("Fail to get the leader: %v", err)
 		}
+		if leader == "" {
+			return fmt.Errorf("The leader is not elected yet")
+		}
+		return nil
+	})
+}
+
+// Stop stops the consul service.
+func (s *consulService) Stop() error {
+	return s.StopContext(context.Background())
+}
+
+// StopContext terminates the consul agent, kills it if it doesn't exit in time, and
+// removes the work dir.
+func (s *consulService) StopContext(ctx context.Context) error {
+	defer s.releasePorts()
+	var err error
+	if err = stopProcess(ctx, s.cmd, consulStopTimeout); err != nil {
+		err = fmt.Errorf("Fail to stop consul service: %v", err)
+	}
+	return CombineError(err, os.RemoveAll(s.workDir))
+}
+
+// endpoints returns the http, rpc, gossip and server endpoints of consul service.
+func (s *consulService) endpoints() []Endpoint {
+	eps := []Endpoint{{Name: "http", Protocol: ProtocolHTTP, Port: s.ports.HTTP}}
+	if s.ports.RPC > 0 {
+		eps = append(eps, Endpoint{Name: "rpc", Protocol: ProtocolTCP, Port: s.ports.RPC})
 	}
-	return fmt.Errorf("Port(%v) is not listening within time: %v",
-		port, time.Duration(int64(times))*delay)
+	return append(eps,
+		Endpoint{Name: "serf_lan", Protocol: ProtocolTCP, Port: s.ports.SerfLan},
+		Endpoint{Name: "serf_wan", Protocol: ProtocolTCP, Port: s.ports.SerfWan},
+		Endpoint{Name: "server", Protocol: ProtocolTCP, Port: s.ports.Server},
+	)
+}
+
+// logFiles returns files capturing output of the consul agent.
+func (s *consulService) logFiles() []string {
+	return []string{filepath.Join(s.workDir, consulLogFileName)}
+}
+
+// checkNative checks executables required to start the service natively
+func (s *consulService) checkNative() error {
+	return CheckExecutable("consul")
+}
+
+// StartDocker start the service via docker
+func (s *consulService) StartDocker(cl *docker.Client) (string, error) {
+	return s.StartDockerContext(context.Background(), cl)
 }
 
-// checkLeaderElected checks whether the leader is elected for the consul service or not.
-// - port : The port to check.
-// - times: Total number of checks.
-// - delay: Time delay between checks.
-func checkLeaderElected(port, times int, delay time.Duration) error {
+// StartDockerContext start the service via docker. The config is injected with
+// CONSUL_LOCAL_CONFIG, which the image writes into its config dir, and the data dir
+// is left to the image. Ports keep their defaults, which are exposed.
+func (s *consulService) StartDockerContext(ctx context.Context, cl *docker.Client) (ipport string, err error) {
+	config := &consulConfig{
+		BootstrapExpect: 1,
+		Server:          true,
+		Ports: &consulPortsConfig{
+			DNS:     -1,
+			HTTP:    consulDockerPort,
+			HTTPS:   -1,
+			SerfLan: consulDockerSerfLanPort,
+			SerfWan: consulDockerSerfWanPort,
+			Server:  consulDockerServerPort,
+		},
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("Fail to json marshal consul config: %v", err)
+	}
+	s.container, ipport, err = StartContainerContext(
+		ctx, cl,
+		SetImage("consul:1.6"),
+		SetExposedPorts([]string{
+			fmt.Sprintf("%d/tcp", consulDockerPort),
+			fmt.Sprintf("%d/tcp", consulDockerServerPort),
+			fmt.Sprintf("%d/tcp", consulDockerSerfLanPort),
+			fmt.Sprintf("%d/tcp", consulDockerSerfWanPort),
+		}),
+		SetEnv([]string{"CONSUL_LOCAL_CONFIG=" + string(b)}),
+		SetCommand([]string{"agent", "-client", "0.0.0.0"}),
+	)
+	if err != nil {
+		return "", fmt.Errorf("Fail to start consul container: %v", err)
+	}
+	s.port = consulDockerPort
+	s.ports = config.Ports
+
+	// Make sure that the leader is elected as the native one does.
+	if err := s.waitReady(ctx, ipport, consulReadyTimeout, TCPProbe(), consulLeaderProbe()); err != nil {
+		RemoveContainer(cl, s.container)
+		return "", fmt.Errorf("Consul is not ready: %v", err)
+	}
+	return ipport, nil
+}
+
+// StopDocker stops the service via docker
+func (s *consulService) StopDocker(cl *docker.Client) error {
+	return s.StopDockerContext(context.Background(), cl)
+}
+
+// StopDockerContext stops the service via docker
+func (s *consulService) StopDockerContext(ctx context.Context, cl *docker.Client) error {
+	return RemoveContainerContext(ctx, cl, s.container)
+}
+
+// Reset deletes all keys, and deregisters services and checks other than consul
+func (s *consulService) Reset(ctx context.Context, ipport string) error {
 	config := consul.DefaultConfig()
-	config.Address = fmt.Sprintf("127.0.0.1:%d", port)
+	config.Address = ipport
 	client, err := consul.NewClient(config)
 	if err != nil {
-		return fmt.Errorf("Fail to build connection with consul agent: %v", err)
+		return err
+	}
+	opts := (&consul.WriteOptions{}).WithContext(ctx)
+	if _, err := client.KV().DeleteTree("", opts); err != nil {
+		return fmt.Errorf("fail to delete keys, err:%v", err)
 	}
-	for i := 0; i < times; i++ {
-		time.Sleep(delay)
-		if leader, _ := client.Status().Leader(); leader != "" {
-			return nil
+	// services registered via agent are synced back to catalog unless deregistered
+	// via agent
+	agent := client.Agent()
+	services, err := agent.Services()
+	if err != nil {
+		return fmt.Errorf("fail to list agent services, err:%v", err)
+	}
+	for id := range services {
+		if id == "consul" {
+			continue
+		}
+		if err := agent.ServiceDeregister(id); err != nil {
+			return fmt.Errorf("fail to deregister %s, err:%v", id, err)
 		}
 	}
-	return fmt.Errorf("Fail to find the leader within time: %v", time.Duration(int64(times))*delay)
-}
-
-// Stop stops the consul service.
-func (s *consulService) Stop() error {
-	if err := s.cmd.Process.Signal(os.Interrupt); err != nil {
-		return fmt.Errorf("Fail to stop consul service with INT: %v", err)
+	checks, err := agent.Checks()
+	if err != nil {
+		return fmt.Errorf("fail to list agent checks, err:%v", err)
 	}
-	for i := 0; i < consulChkTimesListen; i++ {
-		time.Sleep(consulChkDelayListen)
-		if !CheckListening(s.port) {
-			return nil
+	for id, check := range checks {
+		if check.ServiceID != "" || id == "serfHealth" {
+			continue
+		}
+		if err := agent.CheckDeregister(id); err != nil {
+			return fmt.Errorf("fail to deregister check %s, err:%v", id, err)
 		}
 	}
-	return fmt.Errorf("Fail to stop consul service within time limit: %v",
-		consulChkTimesListen*consulChkDelayListen)
+	// and the ones registered via catalog directly
+	catalog := client.Catalog()
+	names, _, err := catalog.Services((&consul.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("fail to list services, err:%v", err)
+	}
+	for name := range names {
+		if name == "consul" {
+			continue
+		}
+		instances, _, err := catalog.Service(name, "", (&consul.QueryOptions{}).WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("fail to list %s, err:%v", name, err)
+		}
+		for _, inst := range instances {
+			if _, err := catalog.Deregister(&consul.CatalogDeregistration{
+				Node:      inst.Node,
+				ServiceID: inst.ServiceID,
+			}, opts); err != nil {
+				return fmt.Errorf("fail to deregister %s, err:%v", inst.ServiceID, err)
+			}
+		}
+	}
+	return nil
 }
 
-// StartDocker start the service via docker
-func (s *consulService) StartDocker(cl *docker.Client) (string, error) {
-	return "", fmt.Errorf("implmenet this")
+// Snapshot saves all keys, services and checks aren't included
+func (s *consulService) Snapshot(ctx context.Context, ipport, name string) error {
+	config := consul.DefaultConfig()
+	config.Address = ipport
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return err
+	}
+	pairs, _, err := client.KV().List("", (&consul.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("fail to list keys, err:%v", err)
+	}
+	return writeSnapshot(Consul, name, pairs)
 }
 
-// StopDocker stops the service via docker
-func (s *consulService) StopDocker(cl *docker.Client) error {
-	return fmt.Errorf("implmenet this")
+// Restore resets consul and puts keys of the snapshot
+func (s *consulService) Restore(ctx context.Context, ipport, name string) error {
+	pairs := consul.KVPairs{}
+	if err := readSnapshot(Consul, name, &pairs); err != nil {
+		return err
+	}
+	if err := s.Reset(ctx, ipport); err != nil {
+		return err
+	}
+	config := consul.DefaultConfig()
+	config.Address = ipport
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return err
+	}
+	opts := (&consul.WriteOptions{}).WithContext(ctx)
+	for _, p := range pairs {
+		if _, err := client.KV().Put(&consul.KVPair{Key: p.Key, Flags: p.Flags, Value: p.Value}, opts); err != nil {
+			return fmt.Errorf("fail to put %s, err:%v", p.Key, err)
+		}
+	}
+	return nil
 }
@@ -22,10 +22,14 @@ func run() {
 	hbasePort, _, _ := sl.Start(test.HBase)
 	fmt.Println(hbasePort)
 
-	s := sl.Get(hbasePort)
-	err := s.(test.HbaseService).RunScript(`list`)
+	hbase, err := test.GetHBase(sl, hbasePort)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = hbase.Shell.RunScript(`list`)
 	fmt.Println(err)
-	err = s.(test.HbaseService).RunScriptFromFile("schema.hbase")
+	err = hbase.Shell.RunScriptFromFile("schema.hbase")
 	fmt.Println(err)
 }
 
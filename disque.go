@@ -3,16 +3,23 @@ package test
 // This file handles the disque service.
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
 )
 
 const (
-	disqueChkTimes = 40                    // disqueChkTimes is the number of times to retry.
-	disqueChkDelay = 50 * time.Millisecond // disqueChkDelay is the waiting time for next retry.
+	disqueReadyTimeout  = 2 * time.Second // disqueReadyTimeout is the time to wait for the server to answer PING.
+	disqueDockerPort    = 7711            // disqueDockerPort is the port inside the container.
+	disquePidFileName   = "disque.pid"    // disquePidFileName is the pid file in work dir.
+	disqueLogFileName   = "disque.log"    // disqueLogFileName is the log file in work dir.
+	disqueBusPortOffset = 10000           // disqueBusPortOffset is how much the cluster communication port is higher.
 )
 
 func init() {
@@ -23,71 +30,84 @@ func init() {
 
 // disqueService is the disque service.
 type disqueService struct {
+	serviceBase
+
 	// port is the port for disque server.
 	port int
+
+	// workDir stores data, pid and log of disque server.
+	workDir string
 }
 
 // Start runs the disque service and returns its port.
 func (s *disqueService) Start() (ipport string, err error) {
-	if err := CheckExecutable("disque-server", "disque"); err != nil {
+	return s.StartContext(context.Background())
+}
+
+// StartContext runs the disque service and returns its port. It shuts the server
+// down if ctx is done before the server is listening.
+func (s *disqueService) StartContext(ctx context.Context) (ipport string, err error) {
+	if err := s.checkNative(); err != nil {
 		return "", fmt.Errorf("Disque is not installed: %v\n", err)
 	}
 
-	s.port, err = genDisquePort(minPort, maxPort)
+	// Both the port and the cluster communication port are leased until the service stops.
+	defer func() {
+		if err != nil {
+			s.releasePorts()
+		}
+	}()
+	s.port, err = s.bookBusPort(disqueBusPortOffset)
 	if err != nil {
 		return "", fmt.Errorf("Fail to get port for disque: %v\n", err)
 	}
 
+	s.workDir, err = ioutil.TempDir("", "disque-test")
+	if err != nil {
+		return "", fmt.Errorf("Fail to generate work dir: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(s.workDir)
+		}
+	}()
+	if err := markOwner(Disque, s.workDir, nil, disquePidFileName); err != nil {
+		return "", fmt.Errorf("Fail to mark owner: %v", err)
+	}
+
 	// Starts disque server.
-	cmd := exec.Command(
+	cmd := exec.CommandContext(
+		ctx,
 		"disque-server",
 		"--port", fmt.Sprintf("%d", s.port),
 		"--daemonize", "yes",
+		"--dir", s.workDir,
+		"--pidfile", filepath.Join(s.workDir, disquePidFileName),
+		"--logfile", filepath.Join(s.workDir, disqueLogFileName),
 	)
 	if err := cmd.Run(); err != nil {
 		return "", fmt.Errorf("Fail to start disque server: %v\n", err)
 	}
 
-	// Make sure that the server is running.
-	for i := 0; i < disqueChkTimes; i++ {
-		time.Sleep(disqueChkDelay)
-		if CheckListening(s.port) {
-			return fmt.Sprintf("localhost:%d", s.port), nil
-		}
-	}
-	return "", fmt.Errorf("Fail to start disque server for port: %v", s.port)
-}
-
-// genDisquePort returns the port for disque server.
-func genDisquePort(min, max int) (int, error) {
-	// Cluster communication port is 10,000 port numbers higher than your Disque node port.
-	// By noting that BookPorts() returns available ports from max,
-	// we first get the cluster communication port since it is the larger one.
-	if max-min < 10000 {
-		return 0, fmt.Errorf("Min(%v) and Max(%v) should be separated by at least 10,000.", min, max)
-	}
-	portCLMin := min + 10000
-	ports, err := BookPorts(1)
-	if err != nil {
-		return 0, fmt.Errorf("Fail to book port: %v", err)
-	}
-	if len(ports) == 0 {
-		return 0, fmt.Errorf("Cannot get available ports.")
-	}
-	portCL := ports[0]
-	if portCL < portCLMin {
-		return 0, fmt.Errorf("Port booking(%v) cannot be lower than min(%v)", portCL, portCLMin)
-	}
-	portSvc := portCL - 10000
-	if !portAvailable(int32(portSvc)) {
-		return 0, fmt.Errorf("Port(%v) is not available for service.", portSvc)
+	// Make sure that the server is running, disque speaks the redis protocol.
+	ipport = fmt.Sprintf("localhost:%d", s.port)
+	if err := s.waitReady(ctx, ipport, disqueReadyTimeout, RedisPingProbe("")); err != nil {
+		s.Stop()
+		return "", fmt.Errorf("Fail to start disque server for port: %v, err: %v", s.port, err)
 	}
-	return portSvc, nil
+	return ipport, nil
 }
 
 // Stop stops the disque service.
 func (s *disqueService) Stop() error {
-	cmd := exec.Command(
+	return s.StopContext(context.Background())
+}
+
+// StopContext stops the disque service.
+func (s *disqueService) StopContext(ctx context.Context) error {
+	defer s.releasePorts()
+	cmd := exec.CommandContext(
+		ctx,
 		"disque",
 		"-p", fmt.Sprintf("%d", s.port),
 		"SHUTDOWN",
@@ -98,12 +118,56 @@ func (s *disqueService) Stop() error {
 	return nil
 }
 
+// logFiles returns the log file of disque server.
+func (s *disqueService) logFiles() []string {
+	return []string{filepath.Join(s.workDir, disqueLogFileName)}
+}
+
+// checkNative checks executables required to start the service natively
+func (s *disqueService) checkNative() error {
+	return CheckExecutable("disque-server", "disque")
+}
+
 // StartDocker start the service via docker
 func (s *disqueService) StartDocker(cl *docker.Client) (string, error) {
-	return "", fmt.Errorf("implmenet this")
+	return s.StartDockerContext(context.Background(), cl)
+}
+
+// StartDockerContext start the service via docker
+func (s *disqueService) StartDockerContext(ctx context.Context, cl *docker.Client) (ipport string, err error) {
+	s.container, ipport, err = StartContainerContext(
+		ctx, cl,
+		SetImage("efrecon/disque:1.0-rc1"),
+		SetExposedPorts([]string{fmt.Sprintf("%d/tcp", disqueDockerPort)}),
+		SetCommand([]string{"disque-server", "--port", fmt.Sprintf("%d", disqueDockerPort)}),
+	)
+	if err != nil {
+		return "", fmt.Errorf("Fail to start disque container: %v", err)
+	}
+	if err := s.waitReady(ctx, ipport, disqueReadyTimeout, RedisPingProbe("")); err != nil {
+		RemoveContainer(cl, s.container)
+		return "", fmt.Errorf("Fail to start disque container: %v", err)
+	}
+	return ipport, nil
 }
 
 // StopDocker stops the service via docker
 func (s *disqueService) StopDocker(cl *docker.Client) error {
-	return fmt.Errorf("implmenet this")
+	return s.StopDockerContext(context.Background(), cl)
+}
+
+// StopDockerContext stops the service via docker
+func (s *disqueService) StopDockerContext(ctx context.Context, cl *docker.Client) error {
+	return RemoveContainerContext(ctx, cl, s.container)
+}
+
+// Reset drops all jobs and queues
+func (s *disqueService) Reset(ctx context.Context, ipport string) error {
+	conn, err := redisDial(ctx, ipport, "")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("DEBUG", "FLUSHALL")
+	return err
 }
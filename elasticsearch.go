@@ -1,8 +1,11 @@
 package test
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -14,9 +17,15 @@ import (
 )
 
 const (
-	elasticSearchChkTimes       = 10
-	elasticSearchChkDelay       = 1 * time.Second
+	elasticSearchReadyTimeout   = 60 * time.Second
 	elasticSearchAvailableDelay = 50
+	// esSnapshotRepo is the repository of snapshots
+	esSnapshotRepo = "csigo"
+	// esDockerRepoDir is where SnapshotDir is mounted in containers
+	esDockerRepoDir = "/snapshots"
+	// ports inside the container
+	esDockerHTTPPort      = 9200
+	esDockerTransportPort = 9300
 )
 
 func init() {
@@ -26,27 +35,34 @@ func init() {
 }
 
 type esService struct {
-	port      int
-	workDir   string
-	container *docker.Container
+	serviceBase
+	port int
+	// transportPort is the port of node to node communication
+	transportPort int
+	workDir       string
 }
 
 func (s *esService) Start() (string, error) {
+	return s.StartContext(context.Background())
+}
+
+func (s *esService) StartContext(ctx context.Context) (string, error) {
 	// perform default check
-	if err := CheckExecutable("elasticsearch"); err != nil {
+	if err := s.checkNative(); err != nil {
 		return "", err
 	}
 
-	// booking 1 ports
-	ports, err := BookPorts(1)
+	// booking 2 ports
+	ports, err := s.bookPorts(2)
 	if err != nil {
 		return "", fmt.Errorf("fail to book ports, err:%v", err)
 	}
-	s.port = ports[0]
+	s.port, s.transportPort = ports[0], ports[1]
 
 	// prepare tmp dir
 	s.workDir, err = ioutil.TempDir("", "elasticsearch-test")
 	if err != nil {
+		s.releasePorts()
 		return "", fmt.Errorf("fail to prepare tmp dir, err:%v", err)
 	}
 
@@ -54,10 +70,21 @@ func (s *esService) Start() (string, error) {
 	dataDir := filepath.Join(s.workDir, "data")
 	logsDir := filepath.Join(s.workDir, "logs")
 
+	repoDir, err := snapshotDir(ElasticSearch)
+	if err != nil {
+		s.releasePorts()
+		return "", err
+	}
+
 	host, _ := os.Hostname()
-	if err := Exec(
-		s.workDir, nil, nil, "elasticsearch",
+	if err := markOwner(ElasticSearch, s.workDir, nil, filepath.Base(pidFile)); err != nil {
+		s.releasePorts()
+		return "", fmt.Errorf("fail to mark owner, err:%v", err)
+	}
+	if err := ExecContext(
+		ctx, s.workDir, nil, nil, "elasticsearch",
 		fmt.Sprintf("-Des.http.port=%d", s.port),
+		fmt.Sprintf("-Des.transport.tcp.port=%d", s.transportPort),
 		fmt.Sprintf("-Des.cluster.name=elasticsearch-csi-test-%s-%d", host, os.Getpid()),
 		"-Des.script.default_lang=groovy",
 		"-Des.script.disable_dynamic=false",
@@ -66,26 +93,32 @@ func (s *esService) Start() (string, error) {
 		"-Des.index.number_of_replicas=0",
 		"-d", "-p", pidFile,
 		"-Des.path.data="+dataDir,
-		"-Des.path.logs="+logsDir); err != nil {
+		"-Des.path.logs="+logsDir,
+		"-Des.path.repo="+repoDir); err != nil {
+		s.releasePorts()
 		return "", fmt.Errorf("fail to start start elastic server, err:%v", err)
 	}
 
-	// check if remote port is listening
-	for i := 0; i < elasticSearchChkTimes; i++ {
-		time.Sleep(elasticSearchChkDelay)
-		if CheckListening(s.port) {
-			// check if server is ready
-			if !s.isServerAvailable() {
-				s.Stop()
-				return "", fmt.Errorf("Elastic Search start time out")
-			}
-			return fmt.Sprintf("localhost:%d", s.port), nil
-		}
+	// check if server is ready
+	ipport := fmt.Sprintf("localhost:%d", s.port)
+	if err := s.waitReady(ctx, ipport, elasticSearchReadyTimeout, esHealthProbe()); err != nil {
+		s.Stop()
+		return "", fmt.Errorf("fail to start elastic search, err:%v", err)
 	}
-	return "", fmt.Errorf("fail to start elastic search")
+	return ipport, nil
 }
 
 func (s *esService) Stop() error {
+	return s.StopContext(context.Background())
+}
+
+// StopContext kills the process recorded in the pid file, which doesn't block so
+// ctx is only checked upfront.
+func (s *esService) StopContext(ctx context.Context) error {
+	defer s.releasePorts()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	pidFile := filepath.Join(s.workDir, "elasticsearch.pid")
 	bytes, err := ioutil.ReadFile(pidFile)
 	if err != nil {
@@ -105,36 +138,164 @@ func (s *esService) Stop() error {
 	return nil
 }
 
+// endpoints returns the http and transport endpoints of elastic search
+func (s *esService) endpoints() []Endpoint {
+	return []Endpoint{
+		{Name: "http", Protocol: ProtocolHTTP, Port: s.port},
+		{Name: "transport", Protocol: ProtocolTCP, Port: s.transportPort},
+	}
+}
+
+// logFiles returns log files of elastic search and the output of its launcher
+func (s *esService) logFiles() []string {
+	files := globFiles(filepath.Join(s.workDir, "logs"), "*.log")
+	return append(files, filepath.Join(s.workDir, execLogFileName))
+}
+
+// checkNative checks executables required to start the service natively
+func (s *esService) checkNative() error {
+	return CheckExecutable("elasticsearch")
+}
+
 // StartDocker start the service via docker
 func (s *esService) StartDocker(cl *docker.Client) (ipport string, err error) {
-	s.container, ipport, err = StartContainer(
-		cl,
+	return s.StartDockerContext(context.Background(), cl)
+}
+
+// StartDockerContext start the service via docker
+func (s *esService) StartDockerContext(ctx context.Context, cl *docker.Client) (ipport string, err error) {
+	repoDir, err := snapshotDir(ElasticSearch)
+	if err != nil {
+		return "", err
+	}
+	s.container, ipport, err = StartContainerContext(
+		ctx, cl,
 		SetImage("elasticsearch:2.4"),
-		SetExposedPorts([]string{"9200/tcp", "9300/tcp"}),
+		SetExposedPorts([]string{
+			fmt.Sprintf("%d/tcp", esDockerHTTPPort),
+			fmt.Sprintf("%d/tcp", esDockerTransportPort),
+		}),
+		SetBinds([]string{repoDir + ":" + esDockerRepoDir}),
+		SetCommand([]string{"elasticsearch", "-Des.path.repo=" + esDockerRepoDir}),
 	)
-	return ipport, err
+	if err != nil {
+		return "", err
+	}
+	s.port, s.transportPort = esDockerHTTPPort, esDockerTransportPort
+	if err := s.waitReady(ctx, ipport, elasticSearchReadyTimeout, esHealthProbe()); err != nil {
+		RemoveContainer(cl, s.container)
+		return "", fmt.Errorf("fail to start elastic search, err:%v", err)
+	}
+	return ipport, nil
 }
 
 // StopDocker stops the service via docker
 func (s *esService) StopDocker(cl *docker.Client) error {
-	return RemoveContainer(cl, s.container)
+	return s.StopDockerContext(context.Background(), cl)
+}
+
+// StopDockerContext stops the service via docker
+func (s *esService) StopDockerContext(ctx context.Context, cl *docker.Client) error {
+	return RemoveContainerContext(ctx, cl, s.container)
+}
+
+// Reset deletes all indices
+func (s *esService) Reset(ctx context.Context, ipport string) error {
+	if err := esRequest(ctx, ipport, "DELETE", "/_all", nil, http.StatusOK); err != nil {
+		return fmt.Errorf("fail to delete indices, err:%v", err)
+	}
+	return nil
+}
+
+// Snapshot takes a snapshot of all indices into the repository under SnapshotDir
+func (s *esService) Snapshot(ctx context.Context, ipport, name string) error {
+	if err := s.registerRepo(ctx, ipport, name); err != nil {
+		return err
+	}
+	// replace the former snapshot of the same name
+	if err := esRequest(ctx, ipport, "DELETE", "/_snapshot/"+esSnapshotRepo+"/"+name, nil,
+		http.StatusOK, http.StatusNotFound); err != nil {
+		return fmt.Errorf("fail to delete snapshot %s, err:%v", name, err)
+	}
+	if err := esRequest(ctx, ipport, "PUT", "/_snapshot/"+esSnapshotRepo+"/"+name+"?wait_for_completion=true", nil,
+		http.StatusOK); err != nil {
+		return fmt.Errorf("fail to take snapshot %s, err:%v", name, err)
+	}
+	return nil
+}
+
+// Restore deletes all indices and restores the ones of the snapshot
+func (s *esService) Restore(ctx context.Context, ipport, name string) error {
+	if err := s.registerRepo(ctx, ipport, name); err != nil {
+		return err
+	}
+	if err := s.Reset(ctx, ipport); err != nil {
+		return err
+	}
+	if err := esRequest(ctx, ipport, "POST", "/_snapshot/"+esSnapshotRepo+"/"+name+"/_restore?wait_for_completion=true", nil,
+		http.StatusOK); err != nil {
+		return fmt.Errorf("fail to restore snapshot %s, err:%v", name, err)
+	}
+	return nil
 }
 
-// Wait until Easltic Search cluster status is good enough for operations
-func (s *esService) isServerAvailable() bool {
-	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/_cluster/health?wait_for_status=yellow&timeout=%ds", s.port, elasticSearchAvailableDelay))
+// registerRepo registers the snapshot repository, which lives in path.repo of the
+// node
+func (s *esService) registerRepo(ctx context.Context, ipport, name string) error {
+	if err := checkSnapshotName(name); err != nil {
+		return err
+	}
+	location, err := snapshotDir(ElasticSearch)
 	if err != nil {
-		return false
+		return err
 	}
-	defer resp.Body.Close()
-	bytes, err := ioutil.ReadAll(resp.Body)
+	if s.container != nil {
+		location = esDockerRepoDir
+	}
+	body := map[string]interface{}{
+		"type":     "fs",
+		"settings": map[string]interface{}{"location": location},
+	}
+	if err := esRequest(ctx, ipport, "PUT", "/_snapshot/"+esSnapshotRepo, body, http.StatusOK); err != nil {
+		return fmt.Errorf("fail to register snapshot repository, err:%v", err)
+	}
+	return nil
+}
+
+// esRequest sends a request with the json body and checks its status
+func esRequest(ctx context.Context, ipport, method, path string, body interface{}, status ...int) error {
+	var in io.Reader
+	if body != nil {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		in = bytes.NewReader(bs)
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", ipport, path), in)
 	if err != nil {
-		return false
+		return err
 	}
-	var v map[string]interface{}
-	err = json.Unmarshal(bytes, &v)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
-		return false
+		return err
 	}
-	return !v["timed_out"].(bool)
+	defer resp.Body.Close()
+	bs, _ := ioutil.ReadAll(resp.Body)
+	for _, st := range status {
+		if resp.StatusCode == st {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected status:%d, body:%s", resp.StatusCode, bs)
+}
+
+// esHealthProbe waits until Easltic Search cluster status is good enough for operations
+func esHealthProbe() ReadinessProbe {
+	return HTTPJSONProbe(
+		fmt.Sprintf("/_cluster/health?wait_for_status=yellow&timeout=%ds", elasticSearchAvailableDelay),
+		func(v map[string]interface{}) bool {
+			timedOut, ok := v["timed_out"].(bool)
+			return ok && !timedOut
+		})
 }
@@ -0,0 +1,126 @@
+package test
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// protocols of endpoints
+const (
+	ProtocolTCP       = "tcp"
+	ProtocolHTTP      = "http"
+	ProtocolRedis     = "redis"
+	ProtocolRedisTLS  = "rediss"
+	ProtocolNats      = "nats"
+	ProtocolZooKeeper = "zookeeper"
+	ProtocolThrift    = "thrift"
+	ProtocolGRPC      = "grpc"
+)
+
+// Endpoint is a named port exposed by a service
+type Endpoint struct {
+	// Name identifies the endpoint within the service, e.g. "client" or "transport"
+	Name     string
+	Protocol string
+	Host     string
+	Port     int
+}
+
+// Addr returns ip:port of the endpoint
+func (e Endpoint) Addr() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
+
+// URL returns the url of the endpoint, whose scheme is its protocol
+func (e Endpoint) URL() string {
+	return fmt.Sprintf("%s://%s", e.Protocol, e.Addr())
+}
+
+// ServiceDescriptor describes all endpoints of a started service
+type ServiceDescriptor struct {
+	Type ServiceType
+	// Addr is the ip:port returned by Start, which is the address of the first endpoint
+	Addr      string
+	Endpoints []Endpoint
+}
+
+// Endpoint returns the endpoint by name
+func (d *ServiceDescriptor) Endpoint(name string) (Endpoint, bool) {
+	for _, e := range d.Endpoints {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return Endpoint{}, false
+}
+
+// clientProtocols are protocols of services exposing a client endpoint only, which
+// is tcp if not listed
+var clientProtocols = map[ServiceType]string{
+	Disque:    ProtocolRedis,
+	ZooKeeper: ProtocolZooKeeper,
+	Gnatsd:    ProtocolNats,
+}
+
+// endpointer is implemented by services exposing more than a client endpoint
+type endpointer interface {
+	// endpoints returns endpoints of the started service. Ports are the ones the
+	// service listens on, and Host is left empty unless the endpoint is on another host.
+	endpoints() []Endpoint
+}
+
+// describe returns the descriptor of srv started at ipport
+func describe(t ServiceType, srv Service, ipport string) (*ServiceDescriptor, error) {
+	host, port, err := net.SplitHostPort(ipport)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s, err:%v", ipport, err)
+	}
+	ep, ok := srv.(endpointer)
+	if !ok {
+		p, _ := strconv.Atoi(port)
+		protocol, ok := clientProtocols[t]
+		if !ok {
+			protocol = ProtocolTCP
+		}
+		return &ServiceDescriptor{
+			Type:      t,
+			Addr:      ipport,
+			Endpoints: []Endpoint{{Name: "client", Protocol: protocol, Host: host, Port: p}},
+		}, nil
+	}
+	var container *docker.Container
+	if bs, ok := srv.(baseService); ok {
+		container = bs.base().container
+	}
+	eps := ep.endpoints()
+	for i := range eps {
+		if eps[i].Host != "" {
+			continue
+		}
+		eps[i].Host = host
+		if container != nil && runtime.GOOS == "darwin" {
+			// ports inside the container are published to random ports of localhost
+			if eps[i].Port, err = publishedPort(container, eps[i].Port); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &ServiceDescriptor{Type: t, Addr: ipport, Endpoints: eps}, nil
+}
+
+// publishedPort returns the host port which the tcp port of the container is
+// published to
+func publishedPort(c *docker.Container, port int) (int, error) {
+	if c.NetworkSettings != nil {
+		for _, b := range c.NetworkSettings.Ports[docker.Port(fmt.Sprintf("%d/tcp", port))] {
+			if p, err := strconv.Atoi(b.HostPort); err == nil {
+				return p, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("port %d of container %s isn't published", port, c.ID)
+}
@@ -0,0 +1,57 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpoint(t *testing.T) {
+	e := Endpoint{Name: "http", Protocol: ProtocolHTTP, Host: "localhost", Port: 9200}
+	assert.Equal(t, "localhost:9200", e.Addr())
+	assert.Equal(t, "http://localhost:9200", e.URL())
+}
+
+func TestDescribe(t *testing.T) {
+	es := &esService{port: 10001, transportPort: 10000}
+	desc, err := describe(ElasticSearch, es, "localhost:10001")
+	assert.NoError(t, err)
+	assert.Equal(t, "localhost:10001", desc.Addr)
+	transport, ok := desc.Endpoint("transport")
+	assert.True(t, ok)
+	assert.Equal(t, "tcp://localhost:10000", transport.URL())
+	_, ok = desc.Endpoint("peer")
+	assert.False(t, ok)
+
+	// zookeeper endpoint of hbase stays on the host of the external zookeeper
+	hs := &hbaseService{zkAddr: "zk:2181", ports: []int{1, 2, 3, 2181, 5, 6, 7}}
+	desc, err = describe(HBase, hs, "localhost:1")
+	assert.NoError(t, err)
+	assert.Len(t, desc.Endpoints, 7)
+	zk, _ := desc.Endpoint("zookeeper")
+	assert.Equal(t, "zk:2181", zk.Addr())
+	info, _ := desc.Endpoint("master_info")
+	assert.Equal(t, "http://localhost:3", info.URL())
+}
+
+func TestStartDescriptor(t *testing.T) {
+	sl := NewServiceLauncher()
+	defer sl.StopAll()
+
+	desc, stop, err := sl.StartDescriptor(context.Background(), Gnatsd)
+	assert.NoError(t, err)
+	assert.Equal(t, Gnatsd, desc.Type)
+	client, ok := desc.Endpoint("client")
+	assert.True(t, ok)
+	assert.Equal(t, desc.Addr, client.Addr())
+	assert.Equal(t, "nats://"+desc.Addr, client.URL())
+
+	got, err := sl.Describe(desc.Addr)
+	assert.NoError(t, err)
+	assert.Equal(t, desc, got)
+
+	assert.NoError(t, stop())
+	_, err = sl.Describe("127.0.0.1:1")
+	assert.Error(t, err)
+}
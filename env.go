@@ -0,0 +1,312 @@
+package test
+
+// This file handles declarative environments.
+// 1) An environment spec lists named services with their type, options and
+//    dependencies, e.g.
+//
+//      services:
+//        zk:
+//          type: zookeeper
+//        hbase:
+//          type: hbase
+//          depends_on: [zk]
+//          options:
+//            zookeeper: "{{.zk}}"
+//
+// 2) Services are started in dependency order, services of the same level in
+//    parallel. Option values are templates rendered with ip:port of dependencies.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	specOptions = struct {
+		sync.RWMutex
+		opts map[ServiceType]map[string]SpecOptionFactory
+	}{opts: map[ServiceType]map[string]SpecOptionFactory{}}
+)
+
+func init() {
+	// options shared by all services are registered with empty service type
+	RegisterSpecOption("", "backend", func(v string) (ServiceOption, error) {
+		return ServiceBackend(Backend(v)), nil
+	})
+	RegisterSpecOption("", "readiness_timeout", func(v string) (ServiceOption, error) {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		return ReadinessTimeout(d), nil
+	})
+}
+
+// SpecOptionFactory builds a ServiceOption from its value in environment specs
+type SpecOptionFactory func(value string) (ServiceOption, error)
+
+// RegisterSpecOption registers an option of the given service type usable in
+// environment specs. Options registered with empty type apply to all services.
+func RegisterSpecOption(t ServiceType, name string, f SpecOptionFactory) {
+	specOptions.Lock()
+	defer specOptions.Unlock()
+
+	if _, ok := specOptions.opts[t]; !ok {
+		specOptions.opts[t] = map[string]SpecOptionFactory{}
+	}
+	if _, ok := specOptions.opts[t][name]; ok {
+		panic(fmt.Errorf("aready register option %s of service type %s", name, t))
+	}
+	specOptions.opts[t][name] = f
+}
+
+// specOption builds the named option of the service type
+func specOption(t ServiceType, name, value string) (ServiceOption, error) {
+	specOptions.RLock()
+	f, ok := specOptions.opts[t][name]
+	if !ok {
+		f, ok = specOptions.opts[""][name]
+	}
+	specOptions.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported option %s of service type %v", name, t)
+	}
+	return f(value)
+}
+
+// intSpecOption adapts an option taking int to SpecOptionFactory
+func intSpecOption(f func(int) ServiceOption) SpecOptionFactory {
+	return func(v string) (ServiceOption, error) {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		return f(i), nil
+	}
+}
+
+// stringSpecOption adapts an option taking string to SpecOptionFactory
+func stringSpecOption(f func(string) ServiceOption) SpecOptionFactory {
+	return func(v string) (ServiceOption, error) {
+		return f(v), nil
+	}
+}
+
+// EnvSpec describes an environment of services
+type EnvSpec struct {
+	// Backend is the default backend of services
+	Backend Backend `yaml:"backend" json:"backend"`
+	// Services are keyed by name
+	Services map[string]*ServiceSpec `yaml:"services" json:"services"`
+}
+
+// ServiceSpec describes a service in the environment
+type ServiceSpec struct {
+	Type ServiceType `yaml:"type" json:"type"`
+	// DependsOn are names of services to start before this one
+	DependsOn []string `yaml:"depends_on" json:"depends_on"`
+	// Options are keyed by names registered with RegisterSpecOption. Values are
+	// templates rendered with ip:port of dependencies keyed by name.
+	Options map[string]string `yaml:"options" json:"options"`
+}
+
+// LoadEnvSpec loads the environment spec from a yaml or json file
+func LoadEnvSpec(file string) (*EnvSpec, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseEnvSpec(bs)
+}
+
+// ParseEnvSpec parses the environment spec in yaml or json
+func ParseEnvSpec(data []byte) (*EnvSpec, error) {
+	spec := &EnvSpec{}
+	// json is a subset of yaml
+	if err := yaml.UnmarshalStrict(data, spec); err != nil {
+		return nil, fmt.Errorf("fail to parse env spec, err:%v", err)
+	}
+	if _, err := spec.levels(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// levels groups service names by dependency level, services of a level only
+// depend on services of former levels
+func (e *EnvSpec) levels() ([][]string, error) {
+	for name, srv := range e.Services {
+		if srv == nil || srv.Type == "" {
+			return nil, fmt.Errorf("service %s has no type", name)
+		}
+		for _, dep := range srv.DependsOn {
+			if _, ok := e.Services[dep]; !ok {
+				return nil, fmt.Errorf("service %s depends on unknown service %s", name, dep)
+			}
+		}
+	}
+	levels := [][]string{}
+	done := map[string]bool{}
+	for len(done) < len(e.Services) {
+		level := []string{}
+		for name, srv := range e.Services {
+			if done[name] {
+				continue
+			}
+			ready := true
+			for _, dep := range srv.DependsOn {
+				ready = ready && done[dep]
+			}
+			if ready {
+				level = append(level, name)
+			}
+		}
+		if len(level) == 0 {
+			return nil, fmt.Errorf("circular dependency among services")
+		}
+		sort.Strings(level)
+		for _, name := range level {
+			done[name] = true
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// options renders option values with endpoints of dependencies and builds them
+func (s *ServiceSpec) options(endpoints map[string]string) ([]ServiceOption, error) {
+	deps := map[string]string{}
+	for _, dep := range s.DependsOn {
+		deps[dep] = endpoints[dep]
+	}
+	names := make([]string, 0, len(s.Options))
+	for name := range s.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := []ServiceOption{}
+	for _, name := range names {
+		tpl, err := template.New(name).Option("missingkey=error").Parse(s.Options[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid option %s, err:%v", name, err)
+		}
+		buf := bytes.NewBuffer(nil)
+		if err := tpl.Execute(buf, deps); err != nil {
+			return nil, fmt.Errorf("fail to render option %s, err:%v", name, err)
+		}
+		opt, err := specOption(s.Type, name, buf.String())
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, opt)
+	}
+	return result, nil
+}
+
+// Environment is a set of started services
+type Environment struct {
+	launcher  *serviceLauncherImpl
+	endpoints map[string]string
+}
+
+// StartEnv starts services of the spec in dependency order. Services already started
+// are stopped if any of them fails.
+func StartEnv(ctx context.Context, spec *EnvSpec, options ...LauncherOption) (*Environment, error) {
+	levels, err := spec.levels()
+	if err != nil {
+		return nil, err
+	}
+	backend := spec.Backend
+	if backend == "" {
+		backend = backendFromEnv(BackendNative)
+	}
+	env := &Environment{
+		launcher:  newServiceLauncher(backend, options...),
+		endpoints: map[string]string{},
+	}
+	for _, level := range levels {
+		if err := env.startLevel(ctx, spec, level); err != nil {
+			env.Stop()
+			return nil, err
+		}
+	}
+	return env, nil
+}
+
+// startLevel starts services of the level in parallel
+func (e *Environment) startLevel(ctx context.Context, spec *EnvSpec, level []string) error {
+	reqs := make([]ServiceRequest, 0, len(level))
+	for _, name := range level {
+		srv := spec.Services[name]
+		opts, err := srv.options(e.endpoints)
+		if err != nil {
+			return fmt.Errorf("service %s: %v", name, err)
+		}
+		reqs = append(reqs, ServiceRequest{Type: srv.Type, Options: opts})
+	}
+	ipports, err := e.launcher.StartAll(ctx, reqs...)
+	if err != nil {
+		return fmt.Errorf("services %v: %v", level, err)
+	}
+	for i, name := range level {
+		e.endpoints[name] = ipports[i]
+	}
+	return nil
+}
+
+// Endpoint returns ip:port of the named service, empty if no such service
+func (e *Environment) Endpoint(name string) string {
+	return e.endpoints[name]
+}
+
+// Endpoints returns ip:port of all services keyed by name
+func (e *Environment) Endpoints() map[string]string {
+	result := make(map[string]string, len(e.endpoints))
+	for name, ipport := range e.endpoints {
+		result[name] = ipport
+	}
+	return result
+}
+
+// Service returns the named service like ServiceLauncher.Get, nil if no such service
+func (e *Environment) Service(name string) interface{} {
+	ipport, ok := e.endpoints[name]
+	if !ok {
+		return nil
+	}
+	return e.launcher.Get(ipport)
+}
+
+// Launcher returns the launcher owning services of the environment
+func (e *Environment) Launcher() ServiceLauncher {
+	return e.launcher
+}
+
+// Stop stops all services of the environment
+func (e *Environment) Stop() error {
+	return e.launcher.StopAll()
+}
+
+// String lists services and their endpoints
+func (e *Environment) String() string {
+	names := make([]string, 0, len(e.endpoints))
+	for name := range e.endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s=%s", name, e.endpoints[name]))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,127 @@
+package test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	// peers records values of the gnatsd "peer" spec option
+	peers sync.Map
+)
+
+func init() {
+	RegisterSpecOption(Gnatsd, "peer", func(v string) (ServiceOption, error) {
+		return func(s Service) error {
+			peers.Store(s, v)
+			return nil
+		}, nil
+	})
+}
+
+func TestParseEnvSpec(t *testing.T) {
+	spec, err := ParseEnvSpec([]byte(`
+backend: native
+services:
+  zk:
+    type: zookeeper
+  hbase:
+    type: hbase
+    depends_on: [zk]
+    options:
+      zookeeper: "{{.zk}}"
+  redis:
+    type: redis
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, BackendNative, spec.Backend)
+	assert.Equal(t, HBase, spec.Services["hbase"].Type)
+	levels, err := spec.levels()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"redis", "zk"}, {"hbase"}}, levels)
+
+	// json works as well
+	spec, err = ParseEnvSpec([]byte(`{"services": {"nats": {"type": "gnatsd"}}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, Gnatsd, spec.Services["nats"].Type)
+
+	_, err = ParseEnvSpec([]byte(`
+services:
+  a: {type: gnatsd, depends_on: [b]}
+  b: {type: gnatsd, depends_on: [a]}
+`))
+	assert.Error(t, err, "circular dependency")
+
+	_, err = ParseEnvSpec([]byte(`
+services:
+  a: {type: gnatsd, depends_on: [c]}
+`))
+	assert.Error(t, err, "unknown dependency")
+
+	_, err = ParseEnvSpec([]byte(`
+services:
+  a: {type: gnatsd, port: 1}
+`))
+	assert.Error(t, err, "unknown field")
+}
+
+func TestServiceSpecOptions(t *testing.T) {
+	srv := &ServiceSpec{
+		Type:      Redis,
+		DependsOn: []string{"zk"},
+		Options:   map[string]string{"auth": "secret", "readiness_timeout": "5s"},
+	}
+	opts, err := srv.options(map[string]string{"zk": "127.0.0.1:2181"})
+	assert.NoError(t, err)
+	assert.Len(t, opts, 2)
+
+	srv.Options = map[string]string{"auth": "{{.etcd}}"}
+	_, err = srv.options(map[string]string{"zk": "127.0.0.1:2181"})
+	assert.Error(t, err, "only dependencies can be referred")
+
+	srv.Options = map[string]string{"unknown": "1"}
+	_, err = srv.options(nil)
+	assert.Error(t, err, "unsupported option")
+}
+
+func TestStartEnv(t *testing.T) {
+	spec, err := ParseEnvSpec([]byte(`
+services:
+  a:
+    type: gnatsd
+  b:
+    type: gnatsd
+    depends_on: [a]
+    options:
+      peer: "nats://{{.a}}"
+`))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	env, err := StartEnv(ctx, spec)
+	if err != nil {
+		t.Skipf("unable to start env, err:%v", err)
+	}
+	defer env.Stop()
+
+	assert.Len(t, env.Endpoints(), 2)
+	for _, name := range []string{"a", "b"} {
+		conn, err := net.DialTimeout("tcp", env.Endpoint(name), time.Second)
+		assert.NoError(t, err)
+		conn.Close()
+	}
+	peer, ok := peers.Load(env.Service("b"))
+	assert.True(t, ok)
+	assert.Equal(t, "nats://"+env.Endpoint("a"), peer)
+	assert.Nil(t, env.Service("c"))
+
+	assert.NoError(t, env.Stop())
+	_, err = net.DialTimeout("tcp", env.Endpoint("a"), time.Second)
+	assert.Error(t, err)
+}
@@ -1,41 +1,60 @@
 package test
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
 )
 
 const (
-	etcdChkTimes = 10
-	etcdChkDelay = time.Second
+	etcdReadyTimeout = 10 * time.Second
+	etcdLogFileName  = "etcd.log"
+	// etcdStopTimeout is how long etcd has to exit after SIGTERM before it's killed
+	etcdStopTimeout = 10 * time.Second
+	// ports inside the container
+	etcdDockerClientPort = 2379
+	etcdDockerPeerPort   = 2380
+	// etcdDockerDataDir is where the data dir set by EtcdDataDir is mounted
+	etcdDockerDataDir = "/etcd-data"
+	// etcdDockerImage serves the v3 JSON gateway at /v3, which Reset and snapshots use
+	etcdDockerImage = "quay.io/coreos/etcd:v3.4.27"
 )
 
 func init() {
 	RegisterService(Etcd, func() Service {
 		return &etcdService{}
 	})
+	RegisterSpecOption(Etcd, "data_dir", stringSpecOption(EtcdDataDir))
 }
 
 type etcdService struct {
-	ports     []int
-	workDir   string
-	cmd       *exec.Cmd
-	container *docker.Container
+	serviceBase
+	ports   []int
+	workDir string
+	// dataDir is set by EtcdDataDir, and kept when etcd stops
+	dataDir string
+	cmd     *exec.Cmd
 }
 
 func (s *etcdService) Start() (string, error) {
+	return s.StartContext(context.Background())
+}
+
+func (s *etcdService) StartContext(ctx context.Context) (string, error) {
 	// perform default check
-	if err := CheckExecutable("etcd"); err != nil {
+	if err := s.checkNative(); err != nil {
 		return "", err
 	}
 
 	// booking 2 ports
 	var err error
-	s.ports, err = BookPorts(2)
+	s.ports, err = s.bookPorts(2)
 	if err != nil {
 		return "", fmt.Errorf("fail to book ports, err:%v", err)
 	}
@@ -43,6 +62,7 @@ func (s *etcdService) Start() (string, error) {
 	// prepare tmp dir
 	s.workDir, err = ioutil.TempDir("", "etcd-test")
 	if err != nil {
+		s.releasePorts()
 		return "", fmt.Errorf("fail to prepare tmp dir, err:%v", err)
 	}
 
@@ -50,48 +70,227 @@ func (s *etcdService) Start() (string, error) {
 		"etcd",
 		fmt.Sprintf("--listen-client-urls=http://0.0.0.0:%d", s.ports[0]),
 		fmt.Sprintf("--advertise-client-urls=http://0.0.0.0:%d", s.ports[0]),
-		fmt.Sprintf("-data-dir=%s", s.workDir),
+		fmt.Sprintf("--listen-peer-urls=http://localhost:%d", s.ports[1]),
+		fmt.Sprintf("--initial-advertise-peer-urls=http://localhost:%d", s.ports[1]),
+		fmt.Sprintf("--initial-cluster=m%d=http://localhost:%d", s.ports[0], s.ports[1]),
+		fmt.Sprintf("-data-dir=%s", s.dataDirOrDefault()),
 		fmt.Sprintf("-name=m%d", s.ports[0]),
 	)
+	logFile, err := os.Create(filepath.Join(s.workDir, etcdLogFileName))
+	if err != nil {
+		s.StopContext(context.Background())
+		return "", fmt.Errorf("fail to create log file, err:%v", err)
+	}
+	defer logFile.Close()
+	s.cmd.Stdout = logFile
+	s.cmd.Stderr = logFile
 	if err := s.cmd.Start(); err != nil {
+		s.StopContext(context.Background())
 		return "", err
 	}
+	if err := markOwner(Etcd, s.workDir, []int{s.cmd.Process.Pid}); err != nil {
+		s.StopContext(context.Background())
+		return "", fmt.Errorf("fail to mark owner, err:%v", err)
+	}
 
-	for i := 0; i < etcdChkTimes; i++ {
-		time.Sleep(etcdChkDelay)
-		if CheckListening(s.ports[0]) {
-			return fmt.Sprintf("localhost:%d", s.ports[0]), nil
-		}
+	ipport := fmt.Sprintf("localhost:%d", s.ports[0])
+	if err := s.waitReady(ctx, ipport, etcdReadyTimeout, etcdHealthProbe()); err != nil {
+		s.StopContext(context.Background())
+		return "", fmt.Errorf("fail to start etcd, err:%v", err)
 	}
-	// only need region server thrift port
-	return "", fmt.Errorf("fail to start etcd")
+	return ipport, nil
 }
 
 func (s *etcdService) Stop() error {
-	// close process
-	if err := s.cmd.Process.Kill(); err != nil {
-		return err
+	return s.StopContext(context.Background())
+}
+
+// StopContext terminates etcd gracefully, kills it if it doesn't exit in time, and
+// removes the work dir. The data dir set by EtcdDataDir is kept.
+func (s *etcdService) StopContext(ctx context.Context) error {
+	defer s.releasePorts()
+	var err error
+	if err = stopProcess(ctx, s.cmd, etcdStopTimeout); err != nil {
+		err = fmt.Errorf("fail to stop etcd, err:%v", err)
 	}
-	time.Sleep(time.Second)
-	return nil
+	return CombineError(err, os.RemoveAll(s.workDir))
+}
+
+// dataDirOrDefault returns the data dir set by EtcdDataDir, or the work dir
+func (s *etcdService) dataDirOrDefault() string {
+	if s.dataDir != "" {
+		return s.dataDir
+	}
+	return s.workDir
+}
+
+// endpoints returns the client and peer endpoints of etcd
+func (s *etcdService) endpoints() []Endpoint {
+	ports := s.ports
+	if s.container != nil {
+		ports = []int{etcdDockerClientPort, etcdDockerPeerPort}
+	}
+	return []Endpoint{
+		{Name: "client", Protocol: ProtocolHTTP, Port: ports[0]},
+		{Name: "peer", Protocol: ProtocolHTTP, Port: ports[1]},
+	}
+}
+
+// logFiles returns files capturing output of etcd
+func (s *etcdService) logFiles() []string {
+	return []string{filepath.Join(s.workDir, etcdLogFileName)}
+}
+
+// checkNative checks executables required to start the service natively
+func (s *etcdService) checkNative() error {
+	return CheckExecutable("etcd")
 }
 
 // StartDocker start the service via docker
 func (s *etcdService) StartDocker(cl *docker.Client) (ipport string, err error) {
-	s.container, ipport, err = StartContainer(
-		cl,
-		SetImage("quay.io/coreos/etcd"),
+	return s.StartDockerContext(context.Background(), cl)
+}
+
+// StartDockerContext start the service via docker
+func (s *etcdService) StartDockerContext(ctx context.Context, cl *docker.Client) (ipport string, err error) {
+	command := []string{
+		"/usr/local/bin/etcd",
+		"-advertise-client-urls=http://0.0.0.0:2379",
+		"-listen-client-urls=http://0.0.0.0:2379",
+	}
+	binds := []string{}
+	if s.dataDir != "" {
+		command = append(command, fmt.Sprintf("-data-dir=%s", etcdDockerDataDir))
+		binds = append(binds, s.dataDir+":"+etcdDockerDataDir)
+	}
+	s.container, ipport, err = StartContainerContext(
+		ctx, cl,
+		SetImage(etcdDockerImage),
 		SetExposedPorts([]string{"2379/tcp", "2380/tcp"}),
-		SetCommand([]string{
-			"/usr/local/bin/etcd",
-			"-advertise-client-urls=http://0.0.0.0:2379",
-			"-listen-client-urls=http://0.0.0.0:2379",
-		}),
+		SetCommand(command),
+		SetBinds(binds),
 	)
-	return ipport, err
+	if err != nil {
+		return "", err
+	}
+	if err := s.waitReady(ctx, ipport, etcdReadyTimeout, etcdHealthProbe()); err != nil {
+		RemoveContainer(cl, s.container)
+		return "", fmt.Errorf("fail to start etcd, err:%v", err)
+	}
+	return ipport, nil
 }
 
 // StopDocker stops the service via docker
 func (s *etcdService) StopDocker(cl *docker.Client) error {
-	return RemoveContainer(cl, s.container)
+	return s.StopDockerContext(context.Background(), cl)
+}
+
+// StopDockerContext stops the service via docker
+func (s *etcdService) StopDockerContext(ctx context.Context, cl *docker.Client) error {
+	return RemoveContainerContext(ctx, cl, s.container)
+}
+
+// Reset deletes all keys via the v3 API, which requires etcd 3.4 or later
+func (s *etcdService) Reset(ctx context.Context, ipport string) error {
+	// keys are base64 encoded, and "\x00" to "\x00" covers all keys
+	if err := etcdV3(ctx, ipport, "/v3/kv/deleterange",
+		map[string]interface{}{"key": []byte{0}, "range_end": []byte{0}}, nil); err != nil {
+		return fmt.Errorf("fail to delete keys, err:%v", err)
+	}
+	return nil
+}
+
+const (
+	// etcdSnapshotPageSize is the number of keys ranged per request
+	etcdSnapshotPageSize = 1000
+	// etcdRestoreBatchSize is the number of keys put per txn, which is under the
+	// default --max-txn-ops of etcd
+	etcdRestoreBatchSize = 128
+)
+
+// etcdKey is a key in etcd snapshots
+type etcdKey struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Snapshot saves all keys via the v3 API without their leases
+func (s *etcdService) Snapshot(ctx context.Context, ipport, name string) error {
+	keys := []etcdKey{}
+	from := []byte{0}
+	for {
+		var resp struct {
+			Kvs  []etcdKey `json:"kvs"`
+			More bool      `json:"more"`
+		}
+		if err := etcdV3(ctx, ipport, "/v3/kv/range", map[string]interface{}{
+			"key":       from,
+			"range_end": []byte{0},
+			"limit":     etcdSnapshotPageSize,
+		}, &resp); err != nil {
+			return fmt.Errorf("fail to list keys, err:%v", err)
+		}
+		keys = append(keys, resp.Kvs...)
+		if !resp.More || len(resp.Kvs) == 0 {
+			break
+		}
+		// the next page starts right after the last key
+		last := resp.Kvs[len(resp.Kvs)-1].Key
+		from = append(append([]byte{}, last...), 0)
+	}
+	return writeSnapshot(Etcd, name, keys)
+}
+
+// Restore deletes all keys and puts the ones of the snapshot via the v3 API
+func (s *etcdService) Restore(ctx context.Context, ipport, name string) error {
+	keys := []etcdKey{}
+	if err := readSnapshot(Etcd, name, &keys); err != nil {
+		return err
+	}
+	if err := s.Reset(ctx, ipport); err != nil {
+		return err
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > etcdRestoreBatchSize {
+			n = etcdRestoreBatchSize
+		}
+		ops := make([]interface{}, 0, n)
+		for _, k := range keys[:n] {
+			ops = append(ops, map[string]interface{}{
+				"request_put": map[string]interface{}{"key": k.Key, "value": k.Value},
+			})
+		}
+		if err := etcdV3(ctx, ipport, "/v3/kv/txn", map[string]interface{}{"success": ops}, nil); err != nil {
+			return fmt.Errorf("fail to put keys, err:%v", err)
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// etcdHealthProbe checks the health endpoint of etcd
+func etcdHealthProbe() ReadinessProbe {
+	return HTTPJSONProbe("/health", func(v map[string]interface{}) bool {
+		// etcd reports health as string "true" in v3 and as bool in some v2 releases
+		return fmt.Sprint(v["health"]) == "true"
+	})
+}
+
+// EtcdDataDir lets etcd keep data in dir instead of its work dir. The dir is kept
+// when etcd stops, so another etcd started with the same dir restarts against the
+// existing data. It should be empty at first.
+func EtcdDataDir(dir string) ServiceOption {
+	return func(s Service) error {
+		es, ok := s.(*etcdService)
+		if !ok {
+			return fmt.Errorf("can't set etcd data dir with service %v", s)
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return fmt.Errorf("invalid etcd data dir %s, err:%v", dir, err)
+		}
+		es.dataDir = abs
+		return nil
+	}
 }
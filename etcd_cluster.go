@@ -0,0 +1,523 @@
+package test
+
+// This file handles etcd clusters. Every member books client and peer ports, and
+// the first members bootstrap with --initial-cluster listing all of them. Clients
+// reach the v3 API via gRPC at client ports, and the launcher manages members via
+// the JSON gateway of the v3 API, which requires etcd 3.4 or later.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	etcdClusterReadyTimeout = 30 * time.Second
+)
+
+func init() {
+	RegisterService(EtcdCluster, func() Service {
+		return &etcdClusterService{size: 3}
+	})
+	RegisterSpecOption(EtcdCluster, "size", intSpecOption(EtcdClusterSize))
+}
+
+// etcdMember is a member of etcd cluster
+type etcdMember struct {
+	name    string
+	workDir string
+	client  int
+	peer    int
+	// id is assigned by the cluster, empty until it's known
+	id      string
+	cmd     *exec.Cmd
+	removed bool
+}
+
+func (m *etcdMember) addr() string {
+	return fmt.Sprintf("localhost:%d", m.client)
+}
+
+func (m *etcdMember) peerURL() string {
+	return fmt.Sprintf("http://localhost:%d", m.peer)
+}
+
+type etcdClusterService struct {
+	serviceBase
+	size int
+	// members are in order of joining, removed ones included
+	members []*etcdMember
+	// lock protects members and their states
+	lock sync.Mutex
+}
+
+// Start starts all members and returns ip:port of the first one
+func (s *etcdClusterService) Start() (string, error) {
+	return s.StartContext(context.Background())
+}
+
+// StartContext starts all members and waits until they agree on a healthy leader
+func (s *etcdClusterService) StartContext(ctx context.Context) (string, error) {
+	if err := s.checkNative(); err != nil {
+		return "", err
+	}
+	if s.size < 1 {
+		return "", fmt.Errorf("invalid cluster size %d", s.size)
+	}
+
+	initial := []string{}
+	for i := 0; i < s.size; i++ {
+		m, err := s.newMember()
+		if err != nil {
+			s.Stop()
+			return "", err
+		}
+		s.members = append(s.members, m)
+		initial = append(initial, m.name+"="+m.peerURL())
+	}
+	for _, m := range s.members {
+		if err := s.startMember(m, strings.Join(initial, ","), "new"); err != nil {
+			s.Stop()
+			return "", err
+		}
+	}
+
+	ipport := s.members[0].addr()
+	if err := s.waitReady(ctx, ipport, etcdClusterReadyTimeout, ProbeFunc(s.checkLeader)); err != nil {
+		s.Stop()
+		return "", fmt.Errorf("etcd cluster isn't ready after %v, err:%v", etcdClusterReadyTimeout, err)
+	}
+	return ipport, nil
+}
+
+// newMember books ports and prepares the work dir of a member
+func (s *etcdClusterService) newMember() (*etcdMember, error) {
+	ports, err := s.bookPorts(2)
+	if err != nil {
+		return nil, fmt.Errorf("fail to book ports, err:%v", err)
+	}
+	m := &etcdMember{name: fmt.Sprintf("m%d", ports[0]), client: ports[0], peer: ports[1]}
+	m.workDir, err = ioutil.TempDir("", "etcd-test")
+	if err != nil {
+		return nil, fmt.Errorf("fail to prepare tmp dir, err:%v", err)
+	}
+	return m, nil
+}
+
+// startMember starts etcd of the member, which joins the initial cluster in state
+// "new" or "existing"
+func (s *etcdClusterService) startMember(m *etcdMember, initial, state string) error {
+	cmd := exec.Command(
+		"etcd",
+		fmt.Sprintf("--name=%s", m.name),
+		fmt.Sprintf("--data-dir=%s", m.workDir),
+		fmt.Sprintf("--listen-client-urls=http://0.0.0.0:%d", m.client),
+		fmt.Sprintf("--advertise-client-urls=http://localhost:%d", m.client),
+		fmt.Sprintf("--listen-peer-urls=%s", m.peerURL()),
+		fmt.Sprintf("--initial-advertise-peer-urls=%s", m.peerURL()),
+		fmt.Sprintf("--initial-cluster=%s", initial),
+		fmt.Sprintf("--initial-cluster-state=%s", state),
+		// the first member names the cluster, so members of other clusters can't join
+		fmt.Sprintf("--initial-cluster-token=%s", s.members[0].name),
+	)
+	logFile, err := os.Create(filepath.Join(m.workDir, etcdLogFileName))
+	if err != nil {
+		return fmt.Errorf("fail to create log file, err:%v", err)
+	}
+	defer logFile.Close()
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("fail to start member %s, err:%v", m.name, err)
+	}
+	if err := markOwner(EtcdCluster, m.workDir, []int{cmd.Process.Pid}); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("fail to mark owner, err:%v", err)
+	}
+	s.lock.Lock()
+	m.cmd = cmd
+	s.lock.Unlock()
+	return nil
+}
+
+// stopMember terminates etcd of the member gracefully
+func (s *etcdClusterService) stopMember(ctx context.Context, m *etcdMember) error {
+	s.lock.Lock()
+	cmd := m.cmd
+	m.cmd = nil
+	s.lock.Unlock()
+	if cmd == nil {
+		return nil
+	}
+	if err := stopProcess(ctx, cmd, etcdStopTimeout); err != nil {
+		return fmt.Errorf("fail to stop member %s, err:%v", m.name, err)
+	}
+	return nil
+}
+
+// running returns indexes of running members
+func (s *etcdClusterService) running() []int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	result := []int{}
+	for i, m := range s.members {
+		if m.cmd != nil && !m.removed {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+// member returns the running member at index i
+func (s *etcdClusterService) member(i int) (*etcdMember, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if i < 0 || i >= len(s.members) {
+		return nil, fmt.Errorf("no member %d in cluster of %d", i, len(s.members))
+	}
+	m := s.members[i]
+	if m.removed || m.cmd == nil {
+		return nil, fmt.Errorf("member %d isn't running", i)
+	}
+	return m, nil
+}
+
+// checkLeader checks if running members agree on a healthy leader
+func (s *etcdClusterService) checkLeader(ctx context.Context, ipport string) error {
+	_, err := s.leader(ctx)
+	return err
+}
+
+// leader returns index of the leader, which all running members must agree on
+func (s *etcdClusterService) leader(ctx context.Context) (int, error) {
+	leaderID := ""
+	ids := map[string]int{}
+	for _, i := range s.running() {
+		m := s.members[i]
+		var status etcdV3Status
+		if err := etcdV3(ctx, m.addr(), "/v3/maintenance/status", struct{}{}, &status); err != nil {
+			return -1, fmt.Errorf("member %d isn't serving, err:%v", i, err)
+		}
+		s.lock.Lock()
+		m.id = status.Header.MemberID
+		s.lock.Unlock()
+		ids[m.id] = i
+		if status.Leader == "" || status.Leader == "0" {
+			return -1, fmt.Errorf("member %d has no leader", i)
+		}
+		if leaderID != "" && leaderID != status.Leader {
+			return -1, fmt.Errorf("members disagree on leaders %s and %s", leaderID, status.Leader)
+		}
+		leaderID = status.Leader
+	}
+	leader, ok := ids[leaderID]
+	if !ok {
+		return -1, fmt.Errorf("leader %s isn't a running member", leaderID)
+	}
+	if err := etcdHealthProbe().Probe(ctx, s.members[leader].addr()); err != nil {
+		return -1, fmt.Errorf("leader %d isn't healthy, err:%v", leader, err)
+	}
+	return leader, nil
+}
+
+// serving returns the client address of a running member other than the excluded
+// one
+func (s *etcdClusterService) serving(exclude int) (string, error) {
+	for _, i := range s.running() {
+		if i != exclude {
+			return s.members[i].addr(), nil
+		}
+	}
+	return "", fmt.Errorf("no other member is running")
+}
+
+// addMember adds a member via a running one, starts it and returns its index
+func (s *etcdClusterService) addMember(ctx context.Context) (int, error) {
+	addr, err := s.serving(-1)
+	if err != nil {
+		return -1, err
+	}
+	m, err := s.newMember()
+	if err != nil {
+		return -1, err
+	}
+	var resp etcdV3MemberAddResponse
+	if err := etcdV3(ctx, addr, "/v3/cluster/member/add",
+		map[string]interface{}{"peerURLs": []string{m.peerURL()}}, &resp); err != nil {
+		return -1, fmt.Errorf("fail to add member %s, err:%v", m.name, err)
+	}
+	m.id = resp.Member.ID
+	initial := etcdInitialCluster(resp.Members, m.id, m.name)
+	if err := s.startMember(m, initial, "existing"); err != nil {
+		// a member which never starts costs the quorum
+		etcdV3(ctx, addr, "/v3/cluster/member/remove", map[string]interface{}{"ID": m.id}, nil)
+		os.RemoveAll(m.workDir)
+		return -1, err
+	}
+	s.lock.Lock()
+	s.members = append(s.members, m)
+	i := len(s.members) - 1
+	s.lock.Unlock()
+	if err := WaitReady(ctx, m.addr(), etcdClusterReadyTimeout, DefaultBackoff, ProbeFunc(s.checkLeader)); err != nil {
+		return -1, fmt.Errorf("member %d doesn't join after %v, err:%v", i, etcdClusterReadyTimeout, err)
+	}
+	return i, nil
+}
+
+// removeMember removes the member via another running one and stops it
+func (s *etcdClusterService) removeMember(ctx context.Context, i int) error {
+	m, err := s.member(i)
+	if err != nil {
+		return err
+	}
+	addr, err := s.serving(i)
+	if err != nil {
+		return err
+	}
+	if m.id == "" {
+		if _, err := s.leader(ctx); err != nil {
+			return err
+		}
+	}
+	if err := etcdV3(ctx, addr, "/v3/cluster/member/remove",
+		map[string]interface{}{"ID": m.id}, nil); err != nil {
+		return fmt.Errorf("fail to remove member %d, err:%v", i, err)
+	}
+	s.lock.Lock()
+	m.removed = true
+	s.lock.Unlock()
+	if err := s.stopMember(ctx, m); err != nil {
+		return err
+	}
+	return WaitReady(ctx, addr, etcdClusterReadyTimeout, DefaultBackoff, ProbeFunc(s.checkLeader))
+}
+
+// Stop stops running members
+func (s *etcdClusterService) Stop() error {
+	return s.StopContext(context.Background())
+}
+
+// StopContext stops running members and removes their work dirs
+func (s *etcdClusterService) StopContext(ctx context.Context) error {
+	defer s.releasePorts()
+	errs := []error{}
+	for _, m := range s.members {
+		errs = append(errs, s.stopMember(ctx, m), os.RemoveAll(m.workDir))
+	}
+	return CombineError(errs...)
+}
+
+// logFiles returns files capturing output of all members
+func (s *etcdClusterService) logFiles() []string {
+	files := []string{}
+	for _, m := range s.members {
+		files = append(files, filepath.Join(m.workDir, etcdLogFileName))
+	}
+	return files
+}
+
+// checkNative checks executables required to start the service natively
+func (s *etcdClusterService) checkNative() error {
+	return CheckExecutable("etcd")
+}
+
+// StartDocker isn't supported as members have to know addresses of each other
+// before they start
+func (s *etcdClusterService) StartDocker(cl *docker.Client) (string, error) {
+	return s.StartDockerContext(context.Background(), cl)
+}
+
+// StartDockerContext isn't supported as members have to know addresses of each other
+// before they start
+func (s *etcdClusterService) StartDockerContext(ctx context.Context, cl *docker.Client) (string, error) {
+	return "", fmt.Errorf("etcd cluster isn't supported via docker")
+}
+
+// StopDocker stops the service via docker
+func (s *etcdClusterService) StopDocker(cl *docker.Client) error {
+	return s.StopDockerContext(context.Background(), cl)
+}
+
+// StopDockerContext stops the service via docker
+func (s *etcdClusterService) StopDockerContext(ctx context.Context, cl *docker.Client) error {
+	return nil
+}
+
+// endpoints returns client, gRPC and peer endpoints of members not removed. gRPC
+// shares the client port.
+func (s *etcdClusterService) endpoints() []Endpoint {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	eps := []Endpoint{}
+	for i, m := range s.members {
+		if m.removed {
+			continue
+		}
+		eps = append(eps,
+			Endpoint{Name: fmt.Sprintf("client_%d", i), Protocol: ProtocolHTTP, Port: m.client},
+			Endpoint{Name: fmt.Sprintf("grpc_%d", i), Protocol: ProtocolGRPC, Port: m.client},
+			Endpoint{Name: fmt.Sprintf("peer_%d", i), Protocol: ProtocolHTTP, Port: m.peer},
+		)
+	}
+	return eps
+}
+
+// Reset deletes all keys via the v3 API
+func (s *etcdClusterService) Reset(ctx context.Context, ipport string) error {
+	addr, err := s.serving(-1)
+	if err != nil {
+		return err
+	}
+	// keys are base64 encoded, and "\x00" to "\x00" covers all keys
+	if err := etcdV3(ctx, addr, "/v3/kv/deleterange",
+		map[string]interface{}{"key": []byte{0}, "range_end": []byte{0}}, nil); err != nil {
+		return fmt.Errorf("fail to delete keys, err:%v", err)
+	}
+	return nil
+}
+
+// etcdV3Member is a member in responses of the v3 JSON gateway, where uint64 ids
+// are strings
+type etcdV3Member struct {
+	ID       string   `json:"ID"`
+	Name     string   `json:"name"`
+	PeerURLs []string `json:"peerURLs"`
+}
+
+type etcdV3MemberAddResponse struct {
+	Member  etcdV3Member   `json:"member"`
+	Members []etcdV3Member `json:"members"`
+}
+
+type etcdV3Status struct {
+	Header struct {
+		MemberID string `json:"member_id"`
+	} `json:"header"`
+	Leader string `json:"leader"`
+}
+
+// etcdInitialCluster returns --initial-cluster of the added member with id, which
+// has no name in the cluster until it starts
+func etcdInitialCluster(members []etcdV3Member, id, name string) string {
+	result := []string{}
+	for _, m := range members {
+		n := m.Name
+		if m.ID == id {
+			n = name
+		}
+		for _, u := range m.PeerURLs {
+			result = append(result, n+"="+u)
+		}
+	}
+	return strings.Join(result, ",")
+}
+
+// etcdV3 posts req to path of the v3 JSON gateway and decodes the response into
+// resp if it's set
+func etcdV3(ctx context.Context, ipport, path string, req, resp interface{}) error {
+	bs, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequest("POST", fmt.Sprintf("http://%s%s", ipport, path), bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(r.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d of %s: %s", res.StatusCode, path, string(body))
+	}
+	if resp == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, resp); err != nil {
+		return fmt.Errorf("fail to decode %s, err:%v", path, err)
+	}
+	return nil
+}
+
+// etcdCluster returns the etcd cluster service at ipport
+func etcdCluster(sl ServiceLauncher, ipport string) (*etcdClusterService, error) {
+	es, ok := sl.Get(ipport).(*etcdClusterService)
+	if !ok {
+		return nil, fmt.Errorf("no etcd cluster at %s", ipport)
+	}
+	return es, nil
+}
+
+// EtcdEndpoints returns client urls of running members of the etcd cluster at ipport,
+// e.g. endpoints of clientv3.Config
+func EtcdEndpoints(sl ServiceLauncher, ipport string) ([]string, error) {
+	es, err := etcdCluster(sl, ipport)
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, i := range es.running() {
+		result = append(result, "http://"+es.members[i].addr())
+	}
+	return result, nil
+}
+
+// EtcdLeader returns index of the leader of the etcd cluster at ipport
+func EtcdLeader(ctx context.Context, sl ServiceLauncher, ipport string) (int, error) {
+	es, err := etcdCluster(sl, ipport)
+	if err != nil {
+		return -1, err
+	}
+	return es.leader(ctx)
+}
+
+// AddEtcdMember adds a member to the etcd cluster at ipport, and returns its index
+// once it joins
+func AddEtcdMember(ctx context.Context, sl ServiceLauncher, ipport string) (int, error) {
+	es, err := etcdCluster(sl, ipport)
+	if err != nil {
+		return -1, err
+	}
+	return es.addMember(ctx)
+}
+
+// RemoveEtcdMember removes the member from the etcd cluster at ipport and stops it.
+// Indexes of other members don't change.
+func RemoveEtcdMember(ctx context.Context, sl ServiceLauncher, ipport string, member int) error {
+	es, err := etcdCluster(sl, ipport)
+	if err != nil {
+		return err
+	}
+	return es.removeMember(ctx, member)
+}
+
+// EtcdClusterSize sets the number of members, which is 3 by default. Odd sizes,
+// e.g. 3 or 5, tolerate the most failures.
+func EtcdClusterSize(n int) ServiceOption {
+	return func(s Service) error {
+		es, ok := s.(*etcdClusterService)
+		if !ok {
+			return fmt.Errorf("can't set etcd cluster size with service %v", s)
+		}
+		es.size = n
+		return nil
+	}
+}
@@ -0,0 +1,72 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestEtcdInitialCluster(t *testing.T) {
+	members := []etcdV3Member{
+		{ID: "1", Name: "m1", PeerURLs: []string{"http://localhost:2"}},
+		{ID: "3", PeerURLs: []string{"http://localhost:4"}},
+	}
+	assert.Equal(t, "m1=http://localhost:2,m3=http://localhost:4", etcdInitialCluster(members, "3", "m3"))
+}
+
+func TestEtcdClusterEndpoints(t *testing.T) {
+	s := &etcdClusterService{members: []*etcdMember{
+		{client: 1, peer: 2, removed: true},
+		{client: 3, peer: 4},
+	}}
+	names := []string{}
+	for _, e := range s.endpoints() {
+		names = append(names, e.Name)
+	}
+	assert.Equal(t, []string{"client_1", "grpc_1", "peer_1"}, names)
+	assert.Equal(t, "grpc://:3", s.endpoints()[1].URL())
+}
+
+func TestEtcdClusterSuite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip etcd cluster test")
+		return
+	}
+	suite.Run(t, new(etcdClusterSuite))
+}
+
+type etcdClusterSuite struct {
+	suite.Suite
+}
+
+func (s *etcdClusterSuite) TestMembership() {
+	ctx := context.Background()
+	sl := NewServiceLauncher()
+	defer sl.StopAll()
+
+	ipport, _, err := sl.Start(EtcdCluster, EtcdClusterSize(3))
+	s.NoError(err)
+	endpoints, err := EtcdEndpoints(sl, ipport)
+	s.NoError(err)
+	s.Len(endpoints, 3)
+
+	leader, err := EtcdLeader(ctx, sl, ipport)
+	s.NoError(err)
+	s.NoError(RemoveEtcdMember(ctx, sl, ipport, leader))
+	endpoints, err = EtcdEndpoints(sl, ipport)
+	s.NoError(err)
+	s.Len(endpoints, 2)
+	newLeader, err := EtcdLeader(ctx, sl, ipport)
+	s.NoError(err)
+	s.NotEqual(leader, newLeader)
+
+	member, err := AddEtcdMember(ctx, sl, ipport)
+	s.NoError(err)
+	s.Equal(3, member)
+	endpoints, err = EtcdEndpoints(sl, ipport)
+	s.NoError(err)
+	s.Len(endpoints, 3)
+	s.NoError(sl.Reset(ctx, ipport))
+}
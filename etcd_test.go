@@ -1,8 +1,11 @@
 package test
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"testing"
 	"time"
 
@@ -62,3 +65,93 @@ func (s *etcdSuite) TestStop() {
 	s.NoError(err, "port is listenering")
 	ln.Close()
 }
+
+func (s *etcdSuite) TestDataDir() {
+	dir, err := ioutil.TempDir("", "etcd-data")
+	s.NoError(err)
+	defer os.RemoveAll(dir)
+
+	service := &etcdService{}
+	s.NoError(EtcdDataDir(dir)(service))
+	ipport, err := service.Start()
+	s.NoError(err)
+	client := etcd.NewClient([]string{fmt.Sprintf("http://%s", ipport)})
+	_, err = client.Set("kept", "v1", 0)
+	s.NoError(err)
+	client.Close()
+	s.NoError(service.Stop())
+	_, err = os.Stat(service.workDir)
+	s.True(os.IsNotExist(err), "work dir isn't removed")
+
+	// another etcd restarts against the existing data
+	service = &etcdService{}
+	s.NoError(EtcdDataDir(dir)(service))
+	ipport, err = service.Start()
+	s.NoError(err)
+	defer service.Stop()
+	client = etcd.NewClient([]string{fmt.Sprintf("http://%s", ipport)})
+	defer client.Close()
+	resp, err := client.Get("kept", false, false)
+	s.NoError(err)
+	s.Equal("v1", resp.Node.Value)
+}
+
+func (s *etcdSuite) TestReset() {
+	service := &etcdService{}
+
+	ipport, err := service.Start()
+	s.NoError(err, "start service error")
+	defer service.Stop()
+
+	ctx := context.Background()
+	s.NoError(etcdV3Put(ctx, ipport, "/dir/aaa", "ccc"), "put key failed")
+	s.NoError(service.Reset(ctx, ipport), "reset error")
+
+	_, ok, err := etcdV3Get(ctx, ipport, "/dir/aaa")
+	s.NoError(err)
+	s.False(ok, "key should be deleted")
+}
+
+func (s *etcdSuite) TestSnapshot() {
+	service := &etcdService{}
+
+	ipport, err := service.Start()
+	s.NoError(err, "start service error")
+	defer service.Stop()
+
+	ctx := context.Background()
+	s.NoError(etcdV3Put(ctx, ipport, "/dir/aaa", "ccc"), "put key failed")
+	s.NoError(service.Snapshot(ctx, ipport, "etcd-suite"), "snapshot error")
+
+	s.NoError(etcdV3Put(ctx, ipport, "/dir/aaa", "ddd"), "put key failed")
+	s.NoError(etcdV3Put(ctx, ipport, "/dir/bbb", "eee"), "put key failed")
+	s.NoError(service.Restore(ctx, ipport, "etcd-suite"), "restore error")
+
+	value, ok, err := etcdV3Get(ctx, ipport, "/dir/aaa")
+	s.NoError(err, "get key failed")
+	s.True(ok)
+	s.Equal("ccc", value)
+	_, ok, err = etcdV3Get(ctx, ipport, "/dir/bbb")
+	s.NoError(err, "get key failed")
+	s.False(ok, "key after the snapshot should be deleted")
+}
+
+// etcdV3Put puts the key via the v3 API
+func etcdV3Put(ctx context.Context, ipport, key, value string) error {
+	return etcdV3(ctx, ipport, "/v3/kv/put",
+		map[string]interface{}{"key": []byte(key), "value": []byte(value)}, nil)
+}
+
+// etcdV3Get gets the key via the v3 API
+func etcdV3Get(ctx context.Context, ipport, key string) (string, bool, error) {
+	var resp struct {
+		Kvs []etcdKey `json:"kvs"`
+	}
+	if err := etcdV3(ctx, ipport, "/v3/kv/range", map[string]interface{}{"key": []byte(key)}, &resp); err != nil {
+		return "", false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", false, nil
+	}
+	return string(resp.Kvs[0].Value), true, nil
+}
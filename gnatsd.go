@@ -1,11 +1,24 @@
 package test
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
 	docker "github.com/fsouza/go-dockerclient"
+	"github.com/nats-io/nats-server/v2/logger"
 	gnatsd "github.com/nats-io/nats-server/v2/server"
 	gnatsdtest "github.com/nats-io/nats-server/v2/test"
 )
 
+const (
+	gnatsdReadyTimeout = 10 * time.Second
+	gnatsdLogFileName  = "gnatsd.log"
+)
+
 func init() {
 	RegisterService(Gnatsd, func() Service {
 		return &gnatsdService{}
@@ -13,39 +26,111 @@ func init() {
 }
 
 type gnatsdService struct {
-	port      int
-	workDir   string
-	gnatsd    *gnatsd.Server
-	container *docker.Container
+	serviceBase
+	port    int
+	workDir string
+	gnatsd  *gnatsd.Server
+	logger  *logger.Logger
 }
 
 func (s *gnatsdService) Start() (string, error) {
-	// perform default check
+	return s.StartContext(context.Background())
+}
+
+func (s *gnatsdService) StartContext(ctx context.Context) (ipport string, err error) {
+	// the server runs in process and boots quickly, only honor ctx upfront
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	// prepare tmp dir for logs
+	s.workDir, err = ioutil.TempDir("", "gnatsd-test")
+	if err != nil {
+		return "", fmt.Errorf("fail to prepare tmp dir, err:%v", err)
+	}
+	defer func() {
+		if err != nil {
+			s.StopContext(context.Background())
+		}
+	}()
+	if err := markOwner(Gnatsd, s.workDir, nil); err != nil {
+		return "", fmt.Errorf("fail to mark owner, err:%v", err)
+	}
+
 	opts := gnatsdtest.DefaultTestOptions
 	opts.Port = gnatsd.RANDOM_PORT
-	s.gnatsd = gnatsdtest.RunServer(&opts)
-	addr := s.gnatsd.Addr()
+	s.gnatsd, err = gnatsd.NewServer(&opts)
+	if err != nil {
+		return "", fmt.Errorf("fail to create gnatsd, err:%v", err)
+	}
+	s.logger = logger.NewFileLogger(s.logFiles()[0], true, false, false, false)
+	s.gnatsd.SetLogger(s.logger, false, false)
+	go s.gnatsd.Start()
+	if !s.gnatsd.ReadyForConnections(gnatsdReadyTimeout) {
+		return "", fmt.Errorf("fail to start gnatsd, not ready after %v", gnatsdReadyTimeout)
+	}
+	ipport = s.gnatsd.Addr().String()
+
+	// the server accepts clients now, so only probes attached by callers are left
+	if err := s.waitReady(ctx, ipport, gnatsdReadyTimeout); err != nil {
+		return "", fmt.Errorf("fail to start gnatsd, err:%v", err)
+	}
+	return ipport, nil
+}
 
-	return addr.String(), nil
+// logFiles returns the log file of gnatsd
+func (s *gnatsdService) logFiles() []string {
+	return []string{filepath.Join(s.workDir, gnatsdLogFileName)}
 }
 
 func (s *gnatsdService) Stop() error {
-	// close process
-	s.gnatsd.Shutdown()
-	return nil
+	return s.StopContext(context.Background())
+}
+
+// StopContext shuts down the server, and removes the work dir with logs
+func (s *gnatsdService) StopContext(ctx context.Context) error {
+	if s.gnatsd != nil {
+		s.gnatsd.Shutdown()
+	}
+	errs := []error{}
+	if s.logger != nil {
+		errs = append(errs, s.logger.Close())
+	}
+	return CombineError(append(errs, os.RemoveAll(s.workDir))...)
 }
 
 // StartDocker start the service via docker
 func (s *gnatsdService) StartDocker(cl *docker.Client) (ipport string, err error) {
-	s.container, ipport, err = StartContainer(
-		cl,
+	return s.StartDockerContext(context.Background(), cl)
+}
+
+// StartDockerContext start the service via docker
+func (s *gnatsdService) StartDockerContext(ctx context.Context, cl *docker.Client) (ipport string, err error) {
+	s.container, ipport, err = StartContainerContext(
+		ctx, cl,
 		SetImage("nats"),
 		SetExposedPorts([]string{"4222/tcp"}),
 	)
-	return ipport, err
+	if err != nil {
+		return "", err
+	}
+	if err := s.waitReady(ctx, ipport, gnatsdReadyTimeout); err != nil {
+		RemoveContainer(cl, s.container)
+		return "", fmt.Errorf("fail to start gnatsd, err:%v", err)
+	}
+	return ipport, nil
 }
 
 // StopDocker stops the service via docker
 func (s *gnatsdService) StopDocker(cl *docker.Client) error {
-	return RemoveContainer(cl, s.container)
+	return s.StopDockerContext(context.Background(), cl)
+}
+
+// StopDockerContext stops the service via docker
+func (s *gnatsdService) StopDockerContext(ctx context.Context, cl *docker.Client) error {
+	return RemoveContainerContext(ctx, cl, s.container)
+}
+
+// Reset does nothing, gnatsd doesn't keep messages or streams
+func (s *gnatsdService) Reset(ctx context.Context, ipport string) error {
+	return nil
 }
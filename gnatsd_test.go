@@ -3,6 +3,7 @@ package test
 import (
 	"fmt"
 	"net"
+	"os"
 	"testing"
 	"time"
 
@@ -68,3 +69,14 @@ func (s *gnatsdSuite) TestStop() {
 	s.NoError(err, "port is listenering")
 	ln.Close()
 }
+
+func (s *gnatsdSuite) TestStopRemovesWorkDir() {
+	service := &gnatsdService{}
+	_, err := service.Start()
+	s.NoError(err, "start service error")
+	s.DirExists(service.workDir)
+
+	s.NoError(service.Stop())
+	_, err = os.Stat(service.workDir)
+	s.True(os.IsNotExist(err), "work dir should be removed")
+}
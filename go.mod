@@ -1,6 +1,6 @@
 module github.com/csigo/test
 
-go 1.13
+go 1.14
 
 require (
 	github.com/coreos/go-etcd v2.0.0+incompatible
@@ -14,4 +14,5 @@ require (
 	github.com/olivere/elastic v6.2.28+incompatible
 	github.com/samuel/go-zookeeper v0.0.0-20190923202752-2cc03de413da
 	github.com/stretchr/testify v1.5.1
+	gopkg.in/yaml.v2 v2.2.8
 )
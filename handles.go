@@ -0,0 +1,264 @@
+package test
+
+// This file provides typed handles of started services. A handle carries endpoints,
+// credentials and a client of the service, which is created on first access and
+// closed once the service is stopped via its launcher.
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/garyburd/redigo/redis"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/nats-io/nats.go"
+	"github.com/olivere/elastic"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// RedisHandle is a started redis service
+type RedisHandle struct {
+	Addr     string
+	Password string
+	Pool     *redis.Pool
+}
+
+// EtcdHandle is a started etcd service
+type EtcdHandle struct {
+	Addr   string
+	Client *etcd.Client
+}
+
+// ZooKeeperHandle is a started zookeeper service or ensemble
+type ZooKeeperHandle struct {
+	Addr string
+	// Servers are client addresses of all members, only Addr if it's standalone
+	Servers []string
+	// Chroot is set by ZkChroot, Conn isn't rooted at it
+	Chroot string
+	// Conn is authenticated if ZkDigestAuth is set
+	Conn *zk.Conn
+}
+
+// ConnString returns the connection string of servers with the chroot, e.g.
+// "localhost:2181/tenant"
+func (h *ZooKeeperHandle) ConnString() string {
+	return strings.Join(h.Servers, ",") + h.Chroot
+}
+
+// ConsulHandle is a started consul service
+type ConsulHandle struct {
+	Addr   string
+	Client *consul.Client
+}
+
+// GnatsdHandle is a started gnatsd service
+type GnatsdHandle struct {
+	Addr string
+	Conn *nats.Conn
+}
+
+// ElasticSearchHandle is a started elastic search service
+type ElasticSearchHandle struct {
+	Addr   string
+	Client *elastic.Client
+}
+
+// DisqueHandle is a started disque service, which speaks redis protocol
+type DisqueHandle struct {
+	Addr string
+	Pool *redis.Pool
+}
+
+// HBaseHandle is a started hbase service
+type HBaseHandle struct {
+	// Addr is the region server thrift endpoint
+	Addr string
+	// ZooKeeper is the quorum hbase registers to
+	ZooKeeper string
+	Shell     HbaseService
+}
+
+// GetRedis returns the handle of the redis service at ipport
+func GetRedis(sl ServiceLauncher, ipport string) (*RedisHandle, error) {
+	rs, ok := sl.Get(ipport).(*redisService)
+	if !ok {
+		return nil, fmt.Errorf("no redis service at %s", ipport)
+	}
+	h, err := rs.handle(func() (interface{}, func() error, error) {
+		pool := newRedisPool(ipport, rs.auth)
+		return &RedisHandle{Addr: ipport, Password: rs.auth, Pool: pool}, pool.Close, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.(*RedisHandle), nil
+}
+
+// GetEtcd returns the handle of the etcd service at ipport
+func GetEtcd(sl ServiceLauncher, ipport string) (*EtcdHandle, error) {
+	es, ok := sl.Get(ipport).(*etcdService)
+	if !ok {
+		return nil, fmt.Errorf("no etcd service at %s", ipport)
+	}
+	h, err := es.handle(func() (interface{}, func() error, error) {
+		client := etcd.NewClient([]string{fmt.Sprintf("http://%s", ipport)})
+		return &EtcdHandle{Addr: ipport, Client: client}, func() error {
+			client.Close()
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.(*EtcdHandle), nil
+}
+
+// GetZooKeeper returns the handle of the zookeeper service or ensemble at ipport
+func GetZooKeeper(sl ServiceLauncher, ipport string) (*ZooKeeperHandle, error) {
+	var sb *serviceBase
+	servers := []string{ipport}
+	// zs connects with options of the standalone service
+	zs := &zkService{}
+	switch s := sl.Get(ipport).(type) {
+	case *zkService:
+		sb, zs = s.base(), s
+	case *zkEnsembleService:
+		sb, servers = s.base(), s.servers()
+	default:
+		return nil, fmt.Errorf("no zookeeper service at %s", ipport)
+	}
+	h, err := sb.handle(func() (interface{}, func() error, error) {
+		conn, err := zs.connect(servers)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &ZooKeeperHandle{Addr: ipport, Servers: servers, Chroot: zs.chroot, Conn: conn}, func() error {
+			conn.Close()
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.(*ZooKeeperHandle), nil
+}
+
+// GetConsul returns the handle of the consul service at ipport
+func GetConsul(sl ServiceLauncher, ipport string) (*ConsulHandle, error) {
+	cs, ok := sl.Get(ipport).(*consulService)
+	if !ok {
+		return nil, fmt.Errorf("no consul service at %s", ipport)
+	}
+	h, err := cs.handle(func() (interface{}, func() error, error) {
+		config := consul.DefaultConfig()
+		config.Address = ipport
+		client, err := consul.NewClient(config)
+		if err != nil {
+			return nil, nil, err
+		}
+		// the client is stateless over http
+		return &ConsulHandle{Addr: ipport, Client: client}, nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.(*ConsulHandle), nil
+}
+
+// GetGnatsd returns the handle of the gnatsd service at ipport
+func GetGnatsd(sl ServiceLauncher, ipport string) (*GnatsdHandle, error) {
+	gs, ok := sl.Get(ipport).(*gnatsdService)
+	if !ok {
+		return nil, fmt.Errorf("no gnatsd service at %s", ipport)
+	}
+	h, err := gs.handle(func() (interface{}, func() error, error) {
+		conn, err := nats.Connect(fmt.Sprintf("nats://%s", ipport))
+		if err != nil {
+			return nil, nil, err
+		}
+		return &GnatsdHandle{Addr: ipport, Conn: conn}, func() error {
+			conn.Close()
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.(*GnatsdHandle), nil
+}
+
+// GetElasticSearch returns the handle of the elastic search service at ipport
+func GetElasticSearch(sl ServiceLauncher, ipport string) (*ElasticSearchHandle, error) {
+	es, ok := sl.Get(ipport).(*esService)
+	if !ok {
+		return nil, fmt.Errorf("no elastic search service at %s", ipport)
+	}
+	h, err := es.handle(func() (interface{}, func() error, error) {
+		client, err := elastic.NewClient(elastic.SetURL(fmt.Sprintf("http://%s", ipport)), elastic.SetSniff(false))
+		if err != nil {
+			return nil, nil, err
+		}
+		return &ElasticSearchHandle{Addr: ipport, Client: client}, func() error {
+			client.Stop()
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.(*ElasticSearchHandle), nil
+}
+
+// GetDisque returns the handle of the disque service at ipport
+func GetDisque(sl ServiceLauncher, ipport string) (*DisqueHandle, error) {
+	ds, ok := sl.Get(ipport).(*disqueService)
+	if !ok {
+		return nil, fmt.Errorf("no disque service at %s", ipport)
+	}
+	h, err := ds.handle(func() (interface{}, func() error, error) {
+		pool := newRedisPool(ipport, "")
+		return &DisqueHandle{Addr: ipport, Pool: pool}, pool.Close, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.(*DisqueHandle), nil
+}
+
+// GetHBase returns the handle of the hbase service at ipport
+func GetHBase(sl ServiceLauncher, ipport string) (*HBaseHandle, error) {
+	hs, ok := sl.Get(ipport).(*hbaseService)
+	if !ok {
+		return nil, fmt.Errorf("no hbase service at %s", ipport)
+	}
+	h, err := hs.handle(func() (interface{}, func() error, error) {
+		zkAddr := hs.zkAddr
+		if zkAddr == "" {
+			host, _, err := net.SplitHostPort(ipport)
+			if err != nil {
+				return nil, nil, err
+			}
+			zkAddr = net.JoinHostPort(host, strconv.Itoa(hs.ports[3]))
+		}
+		return &HBaseHandle{Addr: ipport, ZooKeeper: zkAddr, Shell: hs}, nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.(*HBaseHandle), nil
+}
+
+// newRedisPool returns a pool of connections to the redis protocol server at ipport
+func newRedisPool(ipport, auth string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     4,
+		IdleTimeout: time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", ipport, redis.DialPassword(auth))
+		},
+	}
+}
@@ -0,0 +1,38 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetGnatsd(t *testing.T) {
+	sl := NewServiceLauncher()
+	defer sl.StopAll()
+
+	ipport, stop, err := sl.Start(Gnatsd)
+	assert.NoError(t, err)
+
+	h, err := GetGnatsd(sl, ipport)
+	assert.NoError(t, err)
+	assert.Equal(t, ipport, h.Addr)
+	sub, err := h.Conn.SubscribeSync("handle")
+	assert.NoError(t, err)
+	assert.NoError(t, h.Conn.Publish("handle", []byte("hello")))
+	msg, err := sub.NextMsg(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), msg.Data)
+
+	again, err := GetGnatsd(sl, ipport)
+	assert.NoError(t, err)
+	assert.True(t, h == again, "handle should be cached")
+
+	_, err = GetRedis(sl, ipport)
+	assert.Error(t, err, "not a redis service")
+	_, err = GetGnatsd(sl, "127.0.0.1:1")
+	assert.Error(t, err, "no such service")
+
+	assert.NoError(t, stop())
+	assert.True(t, h.Conn.IsClosed(), "client should be closed on stop")
+}
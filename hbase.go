@@ -2,17 +2,23 @@ package test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
 )
 
 const (
-	hbaseChkTimes = 20
-	hbaseChkDelay = time.Second
+	hbaseReadyTimeout = 20 * time.Second
+	// the image boots its own zookeeper, master, region server and thrift
+	hbaseDockerReadyTimeout = 60 * time.Second
 	// config file name and template
 	hbaseCfgFileName = "hbase-site.xml"
 	hbaseCfgTpl      = `
@@ -57,10 +63,81 @@ const (
     <name>hbase.regionserver.thrift.framed.max_frame_size_in_mb</name>
     <value>16</value>
   </property>
+{{- if .ZK_QUORUM}}
+  <property>
+    <name>hbase.zookeeper.quorum</name>
+    <value>{{.ZK_QUORUM}}</value>
+  </property>
+  <property>
+    <name>zookeeper.znode.parent</name>
+    <value>/hbase-{{.HBASE_REG_THRIFT_PORT}}</value>
+  </property>
+  <property>
+    <name>hbase.cluster.distributed</name>
+    <value>true</value>
+  </property>
+  <property>
+    <name>hbase.master.port</name>
+    <value>{{.HBASE_MASTER_RPC_PORT}}</value>
+  </property>
+  <property>
+    <name>hbase.regionserver.port</name>
+    <value>{{.HBASE_RS_PORT}}</value>
+  </property>
+  <property>
+    <name>hbase.regionserver.info.port</name>
+    <value>{{.HBASE_RS_INFO_PORT}}</value>
+  </property>
+  <property>
+    <name>hbase.unsafe.stream.capability.enforce</name>
+    <value>false</value>
+  </property>
+{{- end}}
 </configuration>
 `
 )
 
+// hbaseResetScript drops all tables listed by the shell, which excludes tables of
+// the hbase namespace
+const hbaseResetScript = `
+list.each { |t| disable(t) if is_enabled(t); drop(t) }
+`
+
+// hbaseSnapshotScript replaces snapshots prefixed by the snapshot name with ones of
+// all user tables, and exports them into the dir. The prefix ends with "-SNAP-",
+// which valid snapshot names never contain, so snapshots of names sharing a prefix
+// don't match.
+const hbaseSnapshotScript = `
+admin = org.apache.hadoop.hbase.client.HBaseAdmin.new(@hbase.configuration)
+admin.deleteSnapshots(java.util.regex.Pattern.quote("%[1]s-SNAP-") + ".*")
+list.each { |t| snapshot(t, "%[1]s-SNAP-" + t.gsub(":", "_")) }
+admin.listSnapshots(java.util.regex.Pattern.quote("%[1]s-SNAP-") + ".*").each { |s|
+  args = ["-snapshot", s.getName, "-copy-to", "file://%[2]s", "-overwrite"].to_java(:string)
+  rc = org.apache.hadoop.util.ToolRunner.run(@hbase.configuration, org.apache.hadoop.hbase.snapshot.ExportSnapshot.new, args)
+  java.lang.System.exit(1) if rc != 0
+}
+`
+
+// hbaseRestoreScript imports snapshots exported into the dir, and clones tables from
+// them
+const hbaseRestoreScript = `
+admin = org.apache.hadoop.hbase.client.HBaseAdmin.new(@hbase.configuration)
+root = org.apache.hadoop.hbase.util.FSUtils.getRootDir(@hbase.configuration).toString
+exported = org.apache.hadoop.fs.Path.new("file://%[2]s/.hbase-snapshot")
+exported.getFileSystem(@hbase.configuration).listStatus(exported).each { |st|
+  name = st.getPath.getName
+  next if name.start_with?(".")
+  args = ["-snapshot", name, "-copy-from", "file://%[2]s", "-copy-to", root, "-overwrite"].to_java(:string)
+  rc = org.apache.hadoop.util.ToolRunner.run(@hbase.configuration, org.apache.hadoop.hbase.snapshot.ExportSnapshot.new, args)
+  java.lang.System.exit(1) if rc != 0
+}
+admin.listSnapshots(java.util.regex.Pattern.quote("%[1]s-SNAP-") + ".*").each { |s| clone_snapshot(s.getName, s.getTable) }
+`
+
+// hbaseDockerSnapshotDir is where the hbase dir of SnapshotDir is mounted in
+// containers
+const hbaseDockerSnapshotDir = "/csigo-snapshots"
+
 // HbaseService represents hbase service
 type HbaseService interface {
 	// RunScript runs the hbase script directly
@@ -73,44 +150,84 @@ func init() {
 	RegisterService(HBase, func() Service {
 		return &hbaseService{}
 	})
+	RegisterSpecOption(HBase, "zookeeper", stringSpecOption(HBaseZooKeeper))
 }
 
 type hbaseService struct {
+	serviceBase
 	ports   []int
 	envs    []string
 	workDir string
+	cl      *docker.Client
+	// zkAddr is ip:port of an external zookeeper, hbase manages its own if empty
+	zkAddr string
 }
 
 func (s *hbaseService) Start() (string, error) {
+	return s.StartContext(context.Background())
+}
+
+func (s *hbaseService) StartContext(ctx context.Context) (ipport string, err error) {
 	// perform default check
-	if err := CheckExecutable("java", "hbase", "hbase-daemon.sh"); err != nil {
+	if err := s.checkNative(); err != nil {
 		return "", err
 	}
 
-	// booking 4 ports
-	var err error
-	s.ports, err = BookPorts(4)
+	// booking 4 ports, plus 3 for master and region server rpc when they run
+	// as separate daemons with an external zookeeper
+	num := 4
+	if s.zkAddr != "" {
+		num = 7
+	}
+	s.ports, err = s.bookPorts(num)
 	if err != nil {
 		return "", fmt.Errorf("fail to book ports, err:%v", err)
 	}
+	defer func() {
+		if err != nil {
+			s.releasePorts()
+		}
+	}()
 
 	// prepare tmp dir
 	s.workDir, err = ioutil.TempDir("", "hbase-test")
 	if err != nil {
 		return "", fmt.Errorf("fail to prepare tmp dir, err:%v", err)
 	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(s.workDir)
+		}
+	}()
+
+	vars := map[string]interface{}{
+		"HBASE_REG_THRIFT_PORT": s.ports[0],
+		"HBASE_THRIFT_PORT":     s.ports[1],
+		"HBASE_MASTER_PORT":     s.ports[2],
+		"ZK_PORT":               s.ports[3],
+		"HBASE_ROOTDIR":         s.workDir,
+	}
+	daemons := []string{"master", "thrift"}
+	if s.zkAddr != "" {
+		host, port, err := net.SplitHostPort(s.zkAddr)
+		if err != nil {
+			return "", fmt.Errorf("invalid zookeeper address %s, err:%v", s.zkAddr, err)
+		}
+		// the booked zk port is unused, point it to the external one
+		s.ports[3], _ = strconv.Atoi(port)
+		vars["ZK_PORT"] = port
+		vars["ZK_QUORUM"] = host
+		vars["HBASE_MASTER_RPC_PORT"] = s.ports[4]
+		vars["HBASE_RS_PORT"] = s.ports[5]
+		vars["HBASE_RS_INFO_PORT"] = s.ports[6]
+		daemons = []string{"master", "regionserver", "thrift"}
+	}
 
 	// prepare cfg
 	if err = ApplyTemplate(
 		filepath.Join(s.workDir, hbaseCfgFileName),
 		hbaseCfgTpl,
-		map[string]interface{}{
-			"HBASE_REG_THRIFT_PORT": s.ports[0],
-			"HBASE_THRIFT_PORT":     s.ports[1],
-			"HBASE_MASTER_PORT":     s.ports[2],
-			"ZK_PORT":               s.ports[3],
-			"HBASE_ROOTDIR":         s.workDir,
-		}); err != nil {
+		vars); err != nil {
 		return "", fmt.Errorf("fail to prepare cfg file, err:%v", err)
 	}
 
@@ -120,55 +237,260 @@ func (s *hbaseService) Start() (string, error) {
 		fmt.Sprintf("HBASE_LOG_DIR=%s", s.workDir),
 		fmt.Sprintf("HBASE_PID_DIR=%s", s.workDir),
 	}
-
-	if err := Exec(s.workDir, s.envs, nil, "hbase-daemon.sh", "start", "master"); err != nil {
-		return "", fmt.Errorf("fail to start hbase master, err:%v", err)
-	}
-	if err := Exec(s.workDir, s.envs, nil, "hbase-daemon.sh", "start", "thrift"); err != nil {
-		return "", fmt.Errorf("fail to start hbase thrift, err:%v", err)
+	if s.zkAddr != "" {
+		s.envs = append(s.envs, "HBASE_MANAGES_ZK=false")
 	}
 
-	for i := 0; i < hbaseChkTimes; i++ {
-		time.Sleep(hbaseChkDelay)
-		if s.check() == nil {
-			return fmt.Sprintf("localhost:%d", s.ports[0]), nil
+	// daemons write pid files into HBASE_PID_DIR
+	if err := markOwner(HBase, s.workDir, nil, "*.pid"); err != nil {
+		return "", fmt.Errorf("fail to mark owner, err:%v", err)
+	}
+	for _, d := range daemons {
+		if err := ExecContext(ctx, s.workDir, s.envs, nil, "hbase-daemon.sh", "start", d); err != nil {
+			s.Stop()
+			return "", fmt.Errorf("fail to start hbase %s, err:%v", d, err)
 		}
 	}
+
 	// only need region server thrift port
-	return "", fmt.Errorf("fail to start hbase")
+	ipport = fmt.Sprintf("localhost:%d", s.ports[0])
+	if err := s.waitReady(ctx, ipport, hbaseReadyTimeout, ProbeFunc(s.check)); err != nil {
+		s.Stop()
+		return "", fmt.Errorf("fail to start hbase, err:%v", err)
+	}
+	return ipport, nil
 }
 
 func (s *hbaseService) Stop() error {
-	return CombineError(
-		Exec(s.workDir, s.envs, nil, "hbase-daemon.sh", "stop", "thrift"),
-		Exec(s.workDir, s.envs, nil, "hbase-daemon.sh", "stop", "master"),
+	return s.StopContext(context.Background())
+}
+
+func (s *hbaseService) StopContext(ctx context.Context) error {
+	defer s.releasePorts()
+	errs := []error{
+		ExecContext(ctx, s.workDir, s.envs, nil, "hbase-daemon.sh", "stop", "thrift"),
+	}
+	if s.zkAddr != "" {
+		errs = append(errs, ExecContext(ctx, s.workDir, s.envs, nil, "hbase-daemon.sh", "stop", "regionserver"))
+	}
+	errs = append(errs, ExecContext(ctx, s.workDir, s.envs, nil, "hbase-daemon.sh", "stop", "master"))
+	return CombineError(errs...)
+}
+
+// endpoints returns endpoints of hbase daemons. The zookeeper endpoint is on the
+// host of the external zookeeper if it's set.
+func (s *hbaseService) endpoints() []Endpoint {
+	eps := []Endpoint{
+		{Name: "region_thrift", Protocol: ProtocolThrift, Port: s.ports[0]},
+		{Name: "thrift_info", Protocol: ProtocolHTTP, Port: s.ports[1]},
+		{Name: "master_info", Protocol: ProtocolHTTP, Port: s.ports[2]},
+		{Name: "zookeeper", Protocol: ProtocolZooKeeper, Port: s.ports[3]},
+	}
+	if s.zkAddr == "" {
+		return eps
+	}
+	eps[3].Host, _, _ = net.SplitHostPort(s.zkAddr)
+	return append(eps,
+		Endpoint{Name: "master", Protocol: ProtocolTCP, Port: s.ports[4]},
+		Endpoint{Name: "regionserver", Protocol: ProtocolTCP, Port: s.ports[5]},
+		Endpoint{Name: "regionserver_info", Protocol: ProtocolHTTP, Port: s.ports[6]},
 	)
 }
 
+// logFiles returns log files of hbase daemons under HBASE_LOG_DIR and outputs of
+// hbase commands
+func (s *hbaseService) logFiles() []string {
+	return globFiles(s.workDir, "*.out", "*.log")
+}
+
+// checkNative checks executables required to start the service natively
+func (s *hbaseService) checkNative() error {
+	return CheckExecutable("java", "hbase", "hbase-daemon.sh")
+}
+
 // StartDocker start the service via docker
 func (s *hbaseService) StartDocker(cl *docker.Client) (string, error) {
-	return "", fmt.Errorf("implmenet this")
+	return s.StartDockerContext(context.Background(), cl)
+}
+
+// StartDockerContext start the service via docker
+func (s *hbaseService) StartDockerContext(ctx context.Context, cl *docker.Client) (ipport string, err error) {
+	if s.zkAddr != "" {
+		return "", fmt.Errorf("external zookeeper isn't supported via docker")
+	}
+
+	// prepare tmp dir
+	s.workDir, err = ioutil.TempDir("", "hbase-test")
+	if err != nil {
+		return "", fmt.Errorf("fail to prepare tmp dir, err:%v", err)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(s.workDir)
+		}
+	}()
+
+	// prepare cfg with ports and paths inside the container
+	s.ports = []int{9090, 9095, 16010, 2181}
+	if err = ApplyTemplate(
+		filepath.Join(s.workDir, hbaseCfgFileName),
+		hbaseCfgTpl,
+		map[string]interface{}{
+			"HBASE_REG_THRIFT_PORT": s.ports[0],
+			"HBASE_THRIFT_PORT":     s.ports[1],
+			"HBASE_MASTER_PORT":     s.ports[2],
+			"ZK_PORT":               s.ports[3],
+			"HBASE_ROOTDIR":         "/hbase-data",
+		}); err != nil {
+		return "", fmt.Errorf("fail to prepare cfg file, err:%v", err)
+	}
+
+	exposed := make([]string, 0, len(s.ports))
+	for _, p := range s.ports {
+		exposed = append(exposed, fmt.Sprintf("%d/tcp", p))
+	}
+	snapshots, err := snapshotDir(HBase)
+	if err != nil {
+		return "", err
+	}
+	s.cl = cl
+	s.container, ipport, err = StartContainerContext(
+		ctx, cl,
+		SetImage("harisekhon/hbase:1.4"),
+		SetExposedPorts(exposed),
+		SetBinds([]string{
+			filepath.Join(s.workDir, hbaseCfgFileName) + ":/hbase/conf/" + hbaseCfgFileName + ":ro",
+			snapshots + ":" + hbaseDockerSnapshotDir,
+		}),
+	)
+	if err != nil {
+		return "", fmt.Errorf("fail to start hbase container, err:%v", err)
+	}
+
+	// thrift should answer and hbase shell should work as the native one does
+	shell := ProbeFunc(func(ctx context.Context, ipport string) error {
+		return ExecContainer(ctx, cl, s.container, strings.NewReader("list"), "hbase", "shell")
+	})
+	if err := s.waitReady(ctx, ipport, hbaseDockerReadyTimeout, TCPProbe(), shell); err != nil {
+		RemoveContainer(cl, s.container)
+		return "", fmt.Errorf("fail to start hbase, err:%v", err)
+	}
+	return ipport, nil
 }
 
 // StopDocker stops the service via docker
 func (s *hbaseService) StopDocker(cl *docker.Client) error {
-	return fmt.Errorf("implmenet this")
+	return s.StopDockerContext(context.Background(), cl)
+}
+
+// StopDockerContext stops the service via docker, and removes the work dir
+func (s *hbaseService) StopDockerContext(ctx context.Context, cl *docker.Client) error {
+	return CombineError(RemoveContainerContext(ctx, cl, s.container), os.RemoveAll(s.workDir))
+}
+
+// Reset drops all user tables
+func (s *hbaseService) Reset(ctx context.Context, ipport string) error {
+	return s.runScriptContext(ctx, hbaseResetScript)
+}
+
+// Snapshot takes hbase snapshots of all user tables, and exports them into the
+// named dir under SnapshotDir
+func (s *hbaseService) Snapshot(ctx context.Context, ipport, name string) error {
+	dir, err := s.snapshotDir(name)
+	if err != nil {
+		return err
+	}
+	// tables dropped since the former snapshot of the same name shouldn't come back
+	if err := s.removeSnapshot(ctx, dir); err != nil {
+		return fmt.Errorf("fail to remove snapshot %s, err:%v", name, err)
+	}
+	if err := s.runScriptContext(ctx, fmt.Sprintf(hbaseSnapshotScript, name, dir)); err != nil {
+		return fmt.Errorf("fail to export snapshot %s, err:%v", name, err)
+	}
+	return nil
+}
+
+// Restore drops all user tables, imports the snapshots exported by Snapshot of any
+// hbase instance and clones tables from them
+func (s *hbaseService) Restore(ctx context.Context, ipport, name string) error {
+	dir, err := s.snapshotDir(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(SnapshotDir, string(HBase), name)); err != nil {
+		return fmt.Errorf("fail to read snapshot %s of %v, err:%v", name, HBase, err)
+	}
+	if err := s.runScriptContext(ctx, hbaseResetScript+fmt.Sprintf(hbaseRestoreScript, name, dir)); err != nil {
+		return fmt.Errorf("fail to restore snapshot %s, err:%v", name, err)
+	}
+	return nil
+}
+
+// snapshotDir returns the dir of the named snapshot as seen by hbase
+func (s *hbaseService) snapshotDir(name string) (string, error) {
+	if err := checkSnapshotName(name); err != nil {
+		return "", err
+	}
+	dir, err := snapshotDir(HBase)
+	if err != nil {
+		return "", err
+	}
+	if s.container != nil {
+		dir = hbaseDockerSnapshotDir
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// removeSnapshot removes the exported snapshot in dir, which is written by root in
+// containers
+func (s *hbaseService) removeSnapshot(ctx context.Context, dir string) error {
+	if s.container != nil {
+		return ExecContainer(ctx, s.cl, s.container, nil, "rm", "-rf", dir)
+	}
+	return os.RemoveAll(dir)
 }
 
 func (s *hbaseService) RunScript(script string) error {
+	return s.runScriptContext(context.Background(), script)
+}
+
+func (s *hbaseService) runScriptContext(ctx context.Context, script string) error {
 	in := bytes.NewReader([]byte(script))
-	return Exec(s.workDir, s.envs, in, "hbase", "shell")
+	if s.container != nil {
+		return ExecContainer(ctx, s.cl, s.container, in, "hbase", "shell")
+	}
+	return ExecContext(ctx, s.workDir, s.envs, in, "hbase", "shell")
 }
 
 func (s *hbaseService) RunScriptFromFile(file string) error {
+	if s.container != nil {
+		// the file lives on host, feed it to the shell in container instead
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		return s.RunScript(string(bs))
+	}
 	return Exec(s.workDir, s.envs, nil, "hbase", "shell", file)
 }
 
-func (s *hbaseService) check() error {
+// check makes sure master and thrift info ports are listening and hbase shell works
+func (s *hbaseService) check(ctx context.Context, ipport string) error {
 	if !CheckListening(s.ports[2], s.ports[1]) {
 		return fmt.Errorf("not listening")
 	}
-	buf := bytes.NewBuffer(nil)
-	buf.Write([]byte("list"))
-	return Exec(s.workDir, s.envs, buf, "hbase", "shell")
+	return CommandProbe(s.workDir, s.envs, "list", "hbase", "shell").Probe(ctx, ipport)
+}
+
+// HBaseZooKeeper points hbase to an external zookeeper at ipport instead of the one
+// managed by hbase. Master and region server then run as separate daemons.
+func HBaseZooKeeper(ipport string) ServiceOption {
+	return func(s Service) error {
+		hs, ok := s.(*hbaseService)
+		if !ok {
+			return fmt.Errorf("can't set hbase zookeeper with service %v", s)
+		}
+		hs.zkAddr = ipport
+		return nil
+	}
 }
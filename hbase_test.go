@@ -0,0 +1,41 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestHBaseSuite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip hbase test")
+		return
+	}
+	suite.Run(t, new(hbaseSuite))
+}
+
+type hbaseSuite struct {
+	suite.Suite
+}
+
+func (s *hbaseSuite) TestSnapshotIntoAnotherInstance() {
+	sl := NewServiceLauncher()
+	defer sl.StopAll()
+	ctx := context.Background()
+
+	ipport, stop, err := sl.Start(HBase)
+	s.Require().NoError(err, "start service error")
+	shell := sl.Get(ipport).(HbaseService)
+	s.NoError(shell.RunScript("create 'snap_t', 'cf'\nput 'snap_t', 'r1', 'cf:q', 'v1'\n"))
+	s.NoError(sl.Snapshot(ctx, ipport, "hbase-suite"), "snapshot error")
+	// the snapshot outlives the instance taking it
+	s.NoError(stop())
+
+	ipport, _, err = sl.Start(HBase)
+	s.Require().NoError(err, "start service error")
+	s.NoError(sl.Restore(ctx, ipport, "hbase-suite"), "restore error")
+	shell = sl.Get(ipport).(HbaseService)
+	s.NoError(shell.RunScript("java.lang.System.exit(1) if count('snap_t') != 1\n"),
+		"restored table should have the row")
+}
@@ -0,0 +1,48 @@
+// Package proc checks processes recorded by pid, which are shared by the test package
+// and its commands.
+package proc
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Alive checks if process of the pid is still running
+func Alive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	// EPERM means the process exists but belongs to another user
+	return err == nil || err == syscall.EPERM
+}
+
+// StartedBefore checks if the process of pid is running and started no later than
+// t, i.e. when its pid was recorded. A pid recycled by a process started later fails
+// the check. Start times of processes have a resolution of seconds.
+func StartedBefore(pid int, t time.Time) bool {
+	if !Alive(pid) {
+		return false
+	}
+	started, err := startTime(pid)
+	if err != nil {
+		return false
+	}
+	return !started.After(t.Truncate(time.Second))
+}
+
+// startTime returns when the process of pid started
+func startTime(pid int) (time.Time, error) {
+	cmd := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid))
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	out, err := cmd.Output()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("fail to get start time of %d, err:%v", pid, err)
+	}
+	return time.ParseInLocation("Mon Jan _2 15:04:05 2006", strings.TrimSpace(string(out)), time.Local)
+}
@@ -0,0 +1,142 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+)
+
+// LogLevel is the severity of log entries
+type LogLevel int
+
+// supported log levels
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var (
+	// DefaultLogger is used if neither the launcher nor the service sets a logger,
+	// it only prints warnings and errors to stderr
+	DefaultLogger = StdLogger(log.New(os.Stderr, "", log.LstdFlags), LevelWarn)
+
+	// NopLogger discards all entries
+	NopLogger Logger = nopLogger{}
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// LogEntry is a log entry of the launcher or a service
+type LogEntry struct {
+	Level LogLevel
+	// Service is the type of the service, empty if not about a service
+	Service ServiceType
+	// Instance identifies the service instance within the process
+	Instance string
+	Message  string
+}
+
+func (e LogEntry) String() string {
+	if e.Instance == "" {
+		return fmt.Sprintf("[%v] %s", e.Level, e.Message)
+	}
+	return fmt.Sprintf("[%v] %s: %s", e.Level, e.Instance, e.Message)
+}
+
+// Logger receives log entries of the launcher and services
+type Logger interface {
+	Log(LogEntry)
+}
+
+// LoggerFunc adapts an ordinary function to Logger
+type LoggerFunc func(LogEntry)
+
+// Log calls f(e)
+func (f LoggerFunc) Log(e LogEntry) {
+	f(e)
+}
+
+// StdLogger returns a logger printing entries not lower than min to l
+func StdLogger(l *log.Logger, min LogLevel) Logger {
+	return LoggerFunc(func(e LogEntry) {
+		if e.Level >= min {
+			l.Print(e)
+		}
+	})
+}
+
+// TestLogger returns a logger printing entries not lower than min to t.Log
+func TestLogger(t testing.TB, min LogLevel) Logger {
+	return LoggerFunc(func(e LogEntry) {
+		if e.Level >= min {
+			t.Log(e)
+		}
+	})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(LogEntry) {}
+
+// LauncherLogger sets the logger of the launcher and its services
+func LauncherLogger(l Logger) LauncherOption {
+	return func(s *serviceLauncherImpl) {
+		s.logger = l
+	}
+}
+
+// ServiceLogger sets the logger of the service, which overrides the logger of the
+// launcher
+func ServiceLogger(l Logger) ServiceOption {
+	return withBase("logger", func(sb *serviceBase) {
+		sb.logger = l
+	})
+}
+
+// logScope is the logger and fields of log entries carried by contexts
+type logScope struct {
+	logger   Logger
+	service  ServiceType
+	instance string
+}
+
+type logScopeKey struct{}
+
+// ContextWithLogger returns a copy of ctx carrying the logger, which is used by
+// functions taking the context, e.g. WaitPortAvailContext and StartContainerContext
+func ContextWithLogger(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, logScopeKey{}, &logScope{logger: l})
+}
+
+// withLogScope returns a copy of ctx carrying the scope
+func withLogScope(ctx context.Context, scope *logScope) context.Context {
+	return context.WithValue(ctx, logScopeKey{}, scope)
+}
+
+// logf logs with the logger carried by ctx, DefaultLogger if there isn't
+func logf(ctx context.Context, level LogLevel, format string, args ...interface{}) {
+	e := LogEntry{Level: level, Message: fmt.Sprintf(format, args...)}
+	scope, _ := ctx.Value(logScopeKey{}).(*logScope)
+	if scope == nil {
+		DefaultLogger.Log(e)
+		return
+	}
+	e.Service, e.Instance = scope.service, scope.instance
+	scope.logger.Log(e)
+}
@@ -0,0 +1,79 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// entryRecorder records log entries
+type entryRecorder struct {
+	entries []LogEntry
+	sync.Mutex
+}
+
+func (r *entryRecorder) Log(e LogEntry) {
+	r.Lock()
+	defer r.Unlock()
+	r.entries = append(r.entries, e)
+}
+
+func (r *entryRecorder) messages() []string {
+	r.Lock()
+	defer r.Unlock()
+	msgs := []string{}
+	for _, e := range r.entries {
+		if e.Level >= LevelInfo {
+			msgs = append(msgs, e.Message)
+		}
+	}
+	return msgs
+}
+
+func TestStdLogger(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	l := StdLogger(log.New(buf, "", 0), LevelInfo)
+	l.Log(LogEntry{Level: LevelDebug, Message: "dial"})
+	l.Log(LogEntry{Level: LevelInfo, Service: Redis, Instance: "redis-1", Message: "started"})
+	assert.Equal(t, "[INFO] redis-1: started\n", buf.String())
+}
+
+func TestContextWithLogger(t *testing.T) {
+	rec := &entryRecorder{}
+	logf(ContextWithLogger(context.Background(), rec), LevelDebug, "hello %s", "world")
+	assert.Equal(t, []LogEntry{{Level: LevelDebug, Message: "hello world"}}, rec.entries)
+
+	defer func(l Logger) {
+		DefaultLogger = l
+	}(DefaultLogger)
+	DefaultLogger = rec
+	logf(context.Background(), LevelWarn, "default")
+	assert.Len(t, rec.entries, 2)
+}
+
+func TestLauncherLogger(t *testing.T) {
+	rec := &entryRecorder{}
+	sl := NewServiceLauncher(LauncherLogger(rec))
+	defer sl.StopAll()
+
+	ipport, stop, err := sl.Start(Gnatsd)
+	assert.NoError(t, err)
+	assert.NoError(t, stop())
+	assert.Equal(t, []string{"starting natively", "started at " + ipport, "stopping", "stopped"}, rec.messages())
+	for _, e := range rec.entries {
+		assert.Equal(t, Gnatsd, e.Service)
+		assert.Equal(t, rec.entries[0].Instance, e.Instance)
+	}
+
+	// logger of the service overrides the one of the launcher
+	srvRec := &entryRecorder{}
+	_, _, err = sl.Start(Gnatsd, ServiceLogger(srvRec))
+	assert.NoError(t, err)
+	assert.Len(t, rec.messages(), 4)
+	assert.Len(t, srvRec.messages(), 2)
+	assert.NotEqual(t, rec.entries[0].Instance, srvRec.entries[0].Instance)
+}
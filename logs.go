@@ -0,0 +1,262 @@
+package test
+
+// This file streams logs of services.
+// 1) Native services write logs into files under their work dirs, which are read in
+//    order and followed by polling them.
+// 2) Logs of containers are read from docker.
+// 3) Logs can be teed into writers, e.g. a testing.TB or a file, while the service
+//    runs.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+var (
+	// logPollInterval is how often log files are checked for new logs when following
+	logPollInterval = 200 * time.Millisecond
+
+	// errNoLogs is returned if the service doesn't keep logs
+	errNoLogs = errors.New("no logs available")
+)
+
+// logSink opens a writer which logs of a service are teed into
+type logSink func() (io.WriteCloser, error)
+
+// LogTee tees logs of the service into w while it runs
+func LogTee(w io.Writer) ServiceOption {
+	return withLogSink("log tee", func() (io.WriteCloser, error) {
+		return nopWriteCloser{w}, nil
+	})
+}
+
+// LogToTest tees logs of the service into t.Log line by line while it runs
+func LogToTest(t testing.TB) ServiceOption {
+	return withLogSink("log to test", func() (io.WriteCloser, error) {
+		w := &testLogWriter{t: t}
+		// t.Log panics once the test is done, while the service may outlive it
+		t.Cleanup(func() { w.Close() })
+		return w, nil
+	})
+}
+
+// LogToFile tees logs of the service into the file while it runs, the file is
+// truncated on start
+func LogToFile(file string) ServiceOption {
+	return withLogSink("log to file", func() (io.WriteCloser, error) {
+		return os.Create(file)
+	})
+}
+
+func withLogSink(name string, sink logSink) ServiceOption {
+	return withBase(name, func(sb *serviceBase) {
+		sb.logSinks = append(sb.logSinks, sink)
+	})
+}
+
+// openLogs returns logs of the service, from its container if it runs via docker,
+// otherwise from its log files. If follow is set, the stream keeps delivering new
+// logs until ctx is done or it's closed.
+func openLogs(ctx context.Context, srv Service, cl *docker.Client, follow bool) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	bs, _ := srv.(baseService)
+	if bs != nil && bs.base().container != nil && cl != nil {
+		go func() {
+			pw.CloseWithError(cl.Logs(docker.LogsOptions{
+				Context:      ctx,
+				Container:    bs.base().container.ID,
+				OutputStream: pw,
+				ErrorStream:  pw,
+				Stdout:       true,
+				Stderr:       true,
+				Follow:       follow,
+			}))
+		}()
+		return &logReader{PipeReader: pr, cancel: cancel}, nil
+	}
+	lf, ok := srv.(logFiler)
+	if !ok {
+		cancel()
+		return nil, errNoLogs
+	}
+	go func() {
+		pw.CloseWithError(tailFiles(ctx, lf, follow, pw))
+	}()
+	return &logReader{PipeReader: pr, cancel: cancel}, nil
+}
+
+// tailFiles copies log files into w, each file is headed by its name as tail does. If
+// follow is set, files are polled for new logs until ctx is done. Files are kept open
+// once found, so logs written while stopping are still copied after services remove
+// their work dirs.
+func tailFiles(ctx context.Context, lf logFiler, follow bool, w io.Writer) error {
+	opened := map[string]*os.File{}
+	defer func() {
+		for _, f := range opened {
+			f.Close()
+		}
+	}()
+	offsets := map[string]int64{}
+	last := ""
+	for {
+		for _, file := range lf.logFiles() {
+			f, ok := opened[file]
+			if !ok {
+				var err error
+				if f, err = os.Open(file); err != nil {
+					// the file may be not yet created
+					continue
+				}
+				opened[file] = f
+			}
+			n, err := copyFrom(f, offsets[file], w, func() error {
+				if file == last {
+					return nil
+				}
+				last = file
+				_, err := fmt.Fprintf(w, "==> %s <==\n", file)
+				return err
+			})
+			offsets[file] += n
+			if err != nil {
+				return err
+			}
+		}
+		if !follow {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			// drain logs written before ctx is done
+			follow = false
+		case <-time.After(logPollInterval):
+		}
+	}
+}
+
+// copyFrom copies the file from offset into w, calling header before copying any
+// byte. It returns number of copied bytes.
+func copyFrom(f *os.File, offset int64, w io.Writer, header func() error) (int64, error) {
+	info, err := f.Stat()
+	if err != nil || info.Size() <= offset {
+		return 0, nil
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, nil
+	}
+	if err := header(); err != nil {
+		return 0, err
+	}
+	return io.CopyN(w, f, info.Size()-offset)
+}
+
+// teeLogs follows logs of the service into its log sinks. It returns a function
+// which stops following once the service is stopped.
+func teeLogs(srv Service, cl *docker.Client) (func(), error) {
+	bs, ok := srv.(baseService)
+	if !ok || len(bs.base().logSinks) == 0 {
+		return func() {}, nil
+	}
+	writers := []io.Writer{}
+	closers := []io.Closer{}
+	for _, sink := range bs.base().logSinks {
+		w, err := sink()
+		if err != nil {
+			for _, c := range closers {
+				c.Close()
+			}
+			return nil, fmt.Errorf("fail to open log sink, err:%v", err)
+		}
+		writers = append(writers, w)
+		closers = append(closers, w)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := openLogs(ctx, srv, cl, true)
+	if err != nil {
+		cancel()
+		for _, c := range closers {
+			c.Close()
+		}
+		if err == errNoLogs {
+			return func() {}, nil
+		}
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(io.MultiWriter(writers...), r)
+		r.Close()
+		for _, c := range closers {
+			c.Close()
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+// logReader cancels the producer of logs once closed
+type logReader struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (r *logReader) Close() error {
+	r.cancel()
+	return r.PipeReader.Close()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// testLogWriter writes complete lines into t.Log, and drops writes once closed
+type testLogWriter struct {
+	t      testing.TB
+	buf    bytes.Buffer
+	closed bool
+	sync.Mutex
+}
+
+func (w *testLogWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return len(p), nil
+	}
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.t.Log(string(w.buf.Next(i + 1)[:i]))
+	}
+}
+
+func (w *testLogWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.buf.Len() > 0 && !w.closed {
+		w.t.Log(w.buf.String())
+		w.buf.Reset()
+	}
+	w.closed = true
+	return nil
+}
@@ -0,0 +1,106 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	buf bytes.Buffer
+	sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestTailFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "a.log")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("first\n"), 0666))
+
+	srv := &logFileService{file: file}
+	r, err := openLogs(context.Background(), srv, nil, true)
+	assert.NoError(t, err)
+	buf := &syncBuffer{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ioutil.ReadAll(io.TeeReader(r, buf))
+	}()
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0666)
+	assert.NoError(t, err)
+	f.WriteString("second\n")
+	f.Close()
+	time.Sleep(3 * logPollInterval)
+	assert.NoError(t, r.Close())
+	<-done
+	assert.Equal(t, "==> "+file+" <==\nfirst\nsecond\n", buf.String())
+}
+
+// logRecorder records logs of t
+type logRecorder struct {
+	testing.TB
+	lines []string
+}
+
+func (r *logRecorder) Log(args ...interface{}) {
+	r.lines = append(r.lines, args[0].(string))
+}
+
+func TestTestLogWriter(t *testing.T) {
+	rec := &logRecorder{TB: t}
+	w := &testLogWriter{t: rec}
+	w.Write([]byte("a\nb"))
+	w.Write([]byte("c\nd"))
+	assert.Equal(t, []string{"a", "bc"}, rec.lines)
+	w.Close()
+	assert.Equal(t, []string{"a", "bc", "d"}, rec.lines)
+	// writes after the test is done are dropped
+	w.Write([]byte("e\n"))
+	assert.Equal(t, []string{"a", "bc", "d"}, rec.lines)
+}
+
+func TestLogs(t *testing.T) {
+	sl := NewServiceLauncher()
+	defer sl.StopAll()
+
+	buf := &syncBuffer{}
+	ipport, stop, err := sl.Start(Gnatsd, LogTee(buf))
+	assert.NoError(t, err)
+
+	r, err := sl.Logs(context.Background(), ipport, false)
+	assert.NoError(t, err)
+	bs, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Contains(t, string(bs), "Server is ready")
+	r.Close()
+
+	assert.NoError(t, stop())
+	assert.Contains(t, buf.String(), "Server is ready")
+	assert.Contains(t, buf.String(), "Server Exiting", "logs written while stopping are teed")
+
+	_, err = sl.Logs(context.Background(), "127.0.0.1:1", false)
+	assert.Error(t, err)
+}
@@ -0,0 +1,110 @@
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/csigo/test/internal/proc"
+)
+
+// Ports booked by BookPorts are leased with files under the lease dir, so test
+// binaries running in parallel never hand out the same port. A lease file is named
+// by the port and holds pid of the owner process. It's removed by ReleasePorts, and
+// leases of dead owners are reclaimed by whoever books the port next. Reclaiming
+// happens under a flock of the port, so two processes can't reclaim the same lease.
+
+var (
+	// portLeaseDir stores lease files of booked ports
+	portLeaseDir = filepath.Join(os.TempDir(), "csigo-test-ports")
+)
+
+// ReleasePorts releases ports booked by this process so that they can be booked
+// again. Ports not booked by this process are left untouched.
+func ReleasePorts(ports ...int) error {
+	errs := []error{}
+	for _, p := range ports {
+		if pid, err := portLeaseOwner(p); err != nil || pid != os.Getpid() {
+			continue
+		}
+		if err := os.Remove(portLeaseFile(p)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return CombineError(errs...)
+}
+
+// leasePort leases the port for this process. It returns false if the port is
+// already leased by a live process, including this one.
+func leasePort(port int) bool {
+	if err := os.MkdirAll(portLeaseDir, 0777); err != nil {
+		return false
+	}
+	ok, err := createLease(port)
+	if ok || !os.IsExist(err) {
+		return ok
+	}
+	return reclaimLease(port)
+}
+
+// createLease creates the lease file of the port if it doesn't exist
+func createLease(port int) (bool, error) {
+	f, err := os.OpenFile(portLeaseFile(port), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return false, err
+	}
+	_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+	f.Close()
+	return err == nil, err
+}
+
+// reclaimLease takes over the lease of a dead owner. The owner is read again under
+// the flock, so a lease just reclaimed by another process is never removed.
+func reclaimLease(port int) bool {
+	lock, err := os.OpenFile(portLeaseFile(port)+".lock", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return false
+	}
+	// closing the file releases the flock
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return false
+	}
+	pid, err := portLeaseOwner(port)
+	if os.IsNotExist(err) {
+		// the lease is released meanwhile
+		ok, _ := createLease(port)
+		return ok
+	}
+	if err != nil || processAlive(pid) {
+		// the owner may be writing its pid, treat unreadable lease as taken
+		return false
+	}
+	if err := os.Remove(portLeaseFile(port)); err != nil {
+		return false
+	}
+	ok, _ := createLease(port)
+	return ok
+}
+
+// portLeaseOwner returns pid of the process leasing the port
+func portLeaseOwner(port int) (int, error) {
+	bs, err := ioutil.ReadFile(portLeaseFile(port))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(bs)))
+}
+
+func portLeaseFile(port int) string {
+	return filepath.Join(portLeaseDir, strconv.Itoa(port))
+}
+
+// processAlive checks if process of the pid is still running
+func processAlive(pid int) bool {
+	return proc.Alive(pid)
+}
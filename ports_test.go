@@ -0,0 +1,69 @@
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortLease(t *testing.T) {
+	ports, err := BookPorts(1)
+	assert.NoError(t, err)
+	port := ports[0]
+
+	pid, err := portLeaseOwner(port)
+	assert.NoError(t, err)
+	assert.Equal(t, os.Getpid(), pid)
+	assert.False(t, leasePort(port), "port leased by this process can't be leased again")
+
+	assert.NoError(t, ReleasePorts(port))
+	_, err = os.Stat(portLeaseFile(port))
+	assert.True(t, os.IsNotExist(err), "lease file should be removed")
+
+	// lease of a live process is respected
+	writeLease(t, port, os.Getppid())
+	assert.False(t, leasePort(port), "port leased by another live process")
+	assert.NoError(t, ReleasePorts(port))
+	pid, _ = portLeaseOwner(port)
+	assert.Equal(t, os.Getppid(), pid, "lease of another process can't be released")
+
+	// lease of a dead process is reclaimed
+	cmd := exec.Command("true")
+	assert.NoError(t, cmd.Run())
+	writeLease(t, port, cmd.Process.Pid)
+	assert.True(t, leasePort(port), "lease of dead process should be reclaimed")
+	assert.NoError(t, ReleasePorts(port))
+}
+
+func writeLease(t *testing.T, port, pid int) {
+	assert.NoError(t, ioutil.WriteFile(portLeaseFile(port), []byte(fmt.Sprintf("%d\n", pid)), 0666))
+}
+
+func TestPortLeaseReclaimRace(t *testing.T) {
+	ports, err := BookPorts(1)
+	assert.NoError(t, err)
+	port := ports[0]
+	cmd := exec.Command("true")
+	assert.NoError(t, cmd.Run())
+	writeLease(t, port, cmd.Process.Pid)
+
+	// only one of the concurrent reclaimers takes over the lease
+	results := make(chan bool, 20)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			results <- leasePort(port)
+		}()
+	}
+	leased := 0
+	for i := 0; i < cap(results); i++ {
+		if <-results {
+			leased++
+		}
+	}
+	assert.Equal(t, 1, leased)
+	assert.NoError(t, ReleasePorts(port))
+}
@@ -0,0 +1,243 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	// DefaultBackoff is the backoff used between readiness checks if the service
+	// or caller doesn't specify one
+	DefaultBackoff = Backoff{
+		Initial: 50 * time.Millisecond,
+		Max:     time.Second,
+		Factor:  2,
+	}
+)
+
+// ReadinessProbe checks whether a service listening on ipport is ready to serve. It
+// returns nil if ready.
+type ReadinessProbe interface {
+	Probe(ctx context.Context, ipport string) error
+}
+
+// ProbeFunc adapts an ordinary function to ReadinessProbe
+type ProbeFunc func(ctx context.Context, ipport string) error
+
+// Probe calls f(ctx, ipport)
+func (f ProbeFunc) Probe(ctx context.Context, ipport string) error {
+	return f(ctx, ipport)
+}
+
+// Backoff defines how long to wait between two readiness checks
+type Backoff struct {
+	// Initial is the delay before the second check
+	Initial time.Duration
+	// Max caps the delay
+	Max time.Duration
+	// Factor multiplies the delay after each failed check, 1 means constant delay
+	Factor float64
+}
+
+// next returns the delay following d
+func (b Backoff) next(d time.Duration) time.Duration {
+	if d <= 0 {
+		return b.Initial
+	}
+	if b.Factor > 1 {
+		d = time.Duration(float64(d) * b.Factor)
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// WaitReady checks ipport with the given probes in order until all of them pass. It
+// returns the last probe error if they still fail after timeout or ctx is done.
+func WaitReady(ctx context.Context, ipport string, timeout time.Duration, backoff Backoff, probes ...ReadinessProbe) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var delay time.Duration
+	for {
+		err := probeAll(ctx, ipport, probes)
+		if err == nil {
+			return nil
+		}
+		logf(ctx, LevelDebug, "%v isn't ready, err:%v", ipport, err)
+		delay = backoff.next(delay)
+		if ctxErr := sleepContext(ctx, delay); ctxErr != nil {
+			return fmt.Errorf("%v is not ready after %v, err:%v", ipport, timeout, err)
+		}
+	}
+}
+
+func probeAll(ctx context.Context, ipport string, probes []ReadinessProbe) error {
+	for _, p := range probes {
+		if err := p.Probe(ctx, ipport); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TCPProbe returns a probe which passes once ipport accepts tcp connections
+func TCPProbe() ReadinessProbe {
+	return ProbeFunc(func(ctx context.Context, ipport string) error {
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "tcp", ipport)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	})
+}
+
+// HTTPProbe returns a probe which passes once GET http://ipport/path responds with
+// the given status code
+func HTTPProbe(path string, status int) ReadinessProbe {
+	return ProbeFunc(func(ctx context.Context, ipport string) error {
+		_, err := httpGet(ctx, ipport, path, status)
+		return err
+	})
+}
+
+// HTTPJSONProbe returns a probe which passes once GET http://ipport/path responds
+// with 200 and a json object satisfying pred
+func HTTPJSONProbe(path string, pred func(map[string]interface{}) bool) ReadinessProbe {
+	return ProbeFunc(func(ctx context.Context, ipport string) error {
+		bs, err := httpGet(ctx, ipport, path, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		var v map[string]interface{}
+		if err := json.Unmarshal(bs, &v); err != nil {
+			return fmt.Errorf("fail to decode %s, err:%v", path, err)
+		}
+		if !pred(v) {
+			return fmt.Errorf("unexpected response of %s: %s", path, string(bs))
+		}
+		return nil
+	})
+}
+
+func httpGet(ctx context.Context, ipport, path string, status int) ([]byte, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s%s", ipport, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != status {
+		return nil, fmt.Errorf("unexpected status %d of %s", resp.StatusCode, path)
+	}
+	return bs, nil
+}
+
+// CommandProbe returns a probe which passes once the command exits with zero. The
+// probed ipport is passed to the command via env CSIGO_TEST_IPPORT.
+func CommandProbe(workdir string, envs []string, stdin string, name string, arg ...interface{}) ReadinessProbe {
+	return ProbeFunc(func(ctx context.Context, ipport string) error {
+		envs := append([]string{"CSIGO_TEST_IPPORT=" + ipport}, envs...)
+		var in io.Reader
+		if stdin != "" {
+			in = strings.NewReader(stdin)
+		}
+		return ExecContext(ctx, workdir, envs, in, name, arg...)
+	})
+}
+
+// RedisPingProbe returns a probe which passes once the redis protocol server
+// answers PING
+func RedisPingProbe(auth string) ReadinessProbe {
+	return ProbeFunc(func(ctx context.Context, ipport string) error {
+		conn, err := redisDial(ctx, ipport, auth)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		reply, err := redis.String(conn.Do("PING"))
+		if err != nil {
+			return err
+		}
+		if reply != "PONG" {
+			return fmt.Errorf("unexpected reply of PING: %s", reply)
+		}
+		return nil
+	})
+}
+
+// redisDial connects the redis protocol server at ipport
+func redisDial(ctx context.Context, ipport, auth string) (redis.Conn, error) {
+	opts := []redis.DialOption{
+		redis.DialNetDial(func(network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}),
+	}
+	if auth != "" {
+		opts = append(opts, redis.DialPassword(auth))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		// redigo doesn't take ctx, bound the round trip by its deadline instead
+		opts = append(opts,
+			redis.DialReadTimeout(time.Until(deadline)),
+			redis.DialWriteTimeout(time.Until(deadline)))
+	}
+	return redis.Dial("tcp", ipport, opts...)
+}
+
+// ZkRuokProbe returns a probe which passes once zookeeper answers "imok" to the
+// "ruok" four letter word
+func ZkRuokProbe() ReadinessProbe {
+	return ProbeFunc(func(ctx context.Context, ipport string) error {
+		reply, err := zkFourLetterWord(ctx, ipport, "ruok")
+		if err != nil {
+			return err
+		}
+		if reply != "imok" {
+			return fmt.Errorf("unexpected reply of ruok: %s", reply)
+		}
+		return nil
+	})
+}
+
+// zkFourLetterWord sends cmd to zookeeper at ipport and returns its trimmed reply
+func zkFourLetterWord(ctx context.Context, ipport, cmd string) (string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", ipport)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		return "", err
+	}
+	bs, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bs)), nil
+}
@@ -0,0 +1,106 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffNext(t *testing.T) {
+	b := Backoff{Initial: 10 * time.Millisecond, Max: 30 * time.Millisecond, Factor: 2}
+	d := b.next(0)
+	assert.Equal(t, 10*time.Millisecond, d)
+	d = b.next(d)
+	assert.Equal(t, 20*time.Millisecond, d)
+	d = b.next(d)
+	assert.Equal(t, 30*time.Millisecond, d, "delay should be capped")
+
+	constant := Backoff{Initial: 10 * time.Millisecond, Factor: 1}
+	assert.Equal(t, 10*time.Millisecond, constant.next(constant.next(0)))
+}
+
+func TestWaitReady(t *testing.T) {
+	backoff := Backoff{Initial: time.Millisecond, Factor: 1}
+
+	calls := int32(0)
+	probe := ProbeFunc(func(ctx context.Context, ipport string) error {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+	assert.NoError(t, WaitReady(context.Background(), "", time.Second, backoff, probe))
+	assert.Equal(t, int32(3), calls)
+
+	never := ProbeFunc(func(ctx context.Context, ipport string) error {
+		return errors.New("never")
+	})
+	err := WaitReady(context.Background(), "", 50*time.Millisecond, backoff, never)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "never")
+}
+
+func TestTCPProbe(t *testing.T) {
+	l, err := net.Listen("tcp4", "localhost:0")
+	assert.NoError(t, err)
+	ipport := l.Addr().String()
+	assert.NoError(t, TCPProbe().Probe(context.Background(), ipport))
+
+	l.Close()
+	assert.Error(t, TCPProbe().Probe(context.Background(), ipport))
+}
+
+func TestHTTPProbe(t *testing.T) {
+	ready := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&ready) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write([]byte(`{"status":"green"}`))
+	}))
+	defer srv.Close()
+	ipport := strings.TrimPrefix(srv.URL, "http://")
+
+	green := HTTPJSONProbe("/health", func(v map[string]interface{}) bool {
+		return v["status"] == "green"
+	})
+	assert.Error(t, HTTPProbe("/health", http.StatusOK).Probe(context.Background(), ipport))
+	assert.Error(t, green.Probe(context.Background(), ipport))
+
+	atomic.StoreInt32(&ready, 1)
+	assert.NoError(t, HTTPProbe("/health", http.StatusOK).Probe(context.Background(), ipport))
+	assert.NoError(t, green.Probe(context.Background(), ipport))
+}
+
+func TestCommandProbe(t *testing.T) {
+	assert.NoError(t, CommandProbe("", nil, "", "true").Probe(context.Background(), ""))
+	assert.Error(t, CommandProbe("", nil, "", "false").Probe(context.Background(), ""))
+}
+
+func TestReadinessProbesOption(t *testing.T) {
+	sl := NewServiceLauncher()
+	defer sl.StopAll()
+
+	probed := ""
+	_, _, err := sl.Start(Gnatsd, ReadinessProbes(ProbeFunc(func(ctx context.Context, ipport string) error {
+		probed = ipport
+		return nil
+	})))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, probed, "probe attached by option isn't run")
+
+	_, _, err = sl.Start(Gnatsd,
+		ReadinessTimeout(50*time.Millisecond),
+		ReadinessProbes(ProbeFunc(func(ctx context.Context, ipport string) error {
+			return errors.New("never")
+		})))
+	assert.Error(t, err)
+}
@@ -0,0 +1,236 @@
+package test
+
+// This file tags launched resources with the run ID of the test process and reaps
+// resources whose owning process is gone.
+// 1) Native services write a marker file into their work dir, which records the
+//    run ID, pid of the test process and pids or pid files of launched processes.
+// 2) Containers are labeled with the run ID, pid and host of the test process.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+
+	"github.com/csigo/test/internal/proc"
+)
+
+const (
+	// ownerMarkerFileName is the marker file in work dirs of native services
+	ownerMarkerFileName = ".csigo-test-owner.json"
+
+	// labels of containers
+	labelRunID = "csigo.test.run"
+	labelOwner = "csigo.test.owner"
+	labelHost  = "csigo.test.host"
+)
+
+var (
+	// runID identifies the current test process
+	runID = fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+)
+
+// RunID returns the ID tagged on every process and container launched by this test
+// process
+func RunID() string {
+	return runID
+}
+
+// ownerMarker records processes launched natively by a test process
+type ownerMarker struct {
+	RunID   string      `json:"run_id"`
+	Owner   int         `json:"owner_pid"`
+	Service ServiceType `json:"service"`
+	// Pids are launched processes
+	Pids []int `json:"pids,omitempty"`
+	// PidFiles are glob patterns, relative to the work dir, of pid files written by
+	// daemonized processes
+	PidFiles []string `json:"pid_files,omitempty"`
+}
+
+// markOwner tags workDir with the run ID so that processes left by a crashed test
+// can be reaped
+func markOwner(t ServiceType, workDir string, pids []int, pidFiles ...string) error {
+	bs, err := json.Marshal(&ownerMarker{
+		RunID:    runID,
+		Owner:    os.Getpid(),
+		Service:  t,
+		Pids:     pids,
+		PidFiles: pidFiles,
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(workDir, ownerMarkerFileName), bs, 0666)
+}
+
+// runLabels returns labels tagged on containers
+func runLabels() map[string]string {
+	host, _ := os.Hostname()
+	return map[string]string{
+		labelRunID: runID,
+		labelOwner: strconv.Itoa(os.Getpid()),
+		labelHost:  host,
+	}
+}
+
+// ReapOptions defines what to reap
+type ReapOptions struct {
+	// RunID reaps all resources of the run even if its owner is still alive. Empty
+	// reaps resources of all runs whose owner is gone.
+	RunID string
+	// Dir is searched for work dirs of native services, default to os.TempDir()
+	Dir string
+	// Docker is used to reap containers, nil skips containers
+	Docker *docker.Client
+	// DryRun only reports resources to reap
+	DryRun bool
+}
+
+// Reaped describes a reaped resource
+type Reaped struct {
+	RunID   string      `json:"run_id"`
+	Service ServiceType `json:"service,omitempty"`
+	// Kind is either "process" or "container"
+	Kind string `json:"kind"`
+	// ID is pid of the process or ID of the container
+	ID string `json:"id"`
+}
+
+// Reap kills processes and removes containers whose owning test process is gone, or
+// which belong to the given run. Work dirs of reaped native services are removed.
+func Reap(opts ReapOptions) ([]Reaped, error) {
+	if opts.Dir == "" {
+		opts.Dir = os.TempDir()
+	}
+	reaped, err := reapProcesses(opts)
+	if opts.Docker == nil {
+		return reaped, err
+	}
+	containers, cerr := reapContainers(opts)
+	return append(reaped, containers...), CombineError(err, cerr)
+}
+
+func reapProcesses(opts ReapOptions) ([]Reaped, error) {
+	markers, err := filepath.Glob(filepath.Join(opts.Dir, "*", ownerMarkerFileName))
+	if err != nil {
+		return nil, err
+	}
+	reaped := []Reaped{}
+	errs := []error{}
+	for _, file := range markers {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		m := ownerMarker{}
+		if err := json.Unmarshal(bs, &m); err != nil {
+			continue
+		}
+		if !shouldReap(opts.RunID, m.RunID, m.Owner) {
+			continue
+		}
+		workDir := filepath.Dir(file)
+		for _, p := range markedPids(workDir, file, &m) {
+			pid := p.pid
+			if !proc.StartedBefore(pid, p.recorded) {
+				// the process is gone, or its pid is recycled by another process
+				continue
+			}
+			reaped = append(reaped, Reaped{RunID: m.RunID, Service: m.Service, Kind: "process", ID: strconv.Itoa(pid)})
+			if opts.DryRun {
+				continue
+			}
+			if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+				errs = append(errs, fmt.Errorf("fail to kill %d of %s, err:%v", pid, m.Service, err))
+			}
+		}
+		if !opts.DryRun {
+			errs = append(errs, os.RemoveAll(workDir))
+		}
+	}
+	return reaped, CombineError(errs...)
+}
+
+// markedPid is a pid recorded in a marker or pid file at the file's mtime
+type markedPid struct {
+	pid      int
+	recorded time.Time
+}
+
+// markedPids returns pids recorded in the marker file and its pid files
+func markedPids(workDir, markerFile string, m *ownerMarker) []markedPid {
+	pids := []markedPid{}
+	if info, err := os.Stat(markerFile); err == nil {
+		for _, pid := range m.Pids {
+			pids = append(pids, markedPid{pid: pid, recorded: info.ModTime()})
+		}
+	}
+	for _, pattern := range m.PidFiles {
+		for _, f := range globFiles(workDir, pattern) {
+			info, err := os.Stat(f)
+			if err != nil {
+				continue
+			}
+			bs, err := ioutil.ReadFile(f)
+			if err != nil {
+				continue
+			}
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(bs))); err == nil {
+				pids = append(pids, markedPid{pid: pid, recorded: info.ModTime()})
+			}
+		}
+	}
+	return pids
+}
+
+func reapContainers(opts ReapOptions) ([]Reaped, error) {
+	filters := map[string][]string{"label": {labelRunID}}
+	if opts.RunID != "" {
+		filters["label"] = []string{labelRunID + "=" + opts.RunID}
+	}
+	containers, err := opts.Docker.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Filters: filters,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail to list containers, err:%v", err)
+	}
+	host, _ := os.Hostname()
+	reaped := []Reaped{}
+	errs := []error{}
+	for _, c := range containers {
+		if opts.RunID == "" && c.Labels[labelHost] != host {
+			// can't tell whether owners on other hosts are alive
+			continue
+		}
+		owner, _ := strconv.Atoi(c.Labels[labelOwner])
+		if !shouldReap(opts.RunID, c.Labels[labelRunID], owner) {
+			continue
+		}
+		reaped = append(reaped, Reaped{RunID: c.Labels[labelRunID], Kind: "container", ID: c.ID})
+		if opts.DryRun {
+			continue
+		}
+		if err := opts.Docker.RemoveContainer(docker.RemoveContainerOptions{ID: c.ID, Force: true}); err != nil {
+			errs = append(errs, fmt.Errorf("fail to remove container %s, err:%v", c.ID, err))
+		}
+	}
+	return reaped, CombineError(errs...)
+}
+
+// shouldReap returns true if the resource of the run belongs to the target run, or
+// its owner is gone when no target run is given
+func shouldReap(target, run string, owner int) bool {
+	if target != "" {
+		return target == run
+	}
+	return !processAlive(owner)
+}
@@ -0,0 +1,52 @@
+// Command reaper kills processes and removes containers left by crashed test runs.
+//
+// Usage:
+//
+//	reaper [-run RUN_ID] [-dir DIR] [-docker=false] [-dry-run]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	docker "github.com/fsouza/go-dockerclient"
+
+	"github.com/csigo/test"
+)
+
+var (
+	runID    = flag.String("run", "", "reap resources of the run even if its owner is alive, reap all orphans if empty")
+	dir      = flag.String("dir", "", "dir to search for work dirs of native services, default to the temp dir")
+	withDock = flag.Bool("docker", true, "reap containers via docker")
+	dryRun   = flag.Bool("dry-run", false, "only print resources to reap")
+)
+
+func run() error {
+	opts := test.ReapOptions{
+		RunID:  *runID,
+		Dir:    *dir,
+		DryRun: *dryRun,
+	}
+	if *withDock {
+		cl, err := docker.NewClient("unix:///var/run/docker.sock")
+		if err == nil && cl.Ping() == nil {
+			opts.Docker = cl
+		} else {
+			fmt.Fprintln(os.Stderr, "docker isn't available, skip containers")
+		}
+	}
+	reaped, err := test.Reap(opts)
+	for _, r := range reaped {
+		fmt.Printf("%s\t%s\t%s\t%s\n", r.Kind, r.ID, r.Service, r.RunID)
+	}
+	return err
+}
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
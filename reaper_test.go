@@ -0,0 +1,92 @@
+package test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reaper-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a service left by a dead owner, recorded by pid file
+	dead := exec.Command("true")
+	assert.NoError(t, dead.Run())
+	orphan := startSleep(t)
+	orphanDir := writeMarker(t, dir, "orphan", &ownerMarker{
+		RunID:    "dead-run",
+		Owner:    dead.Process.Pid,
+		Service:  Redis,
+		PidFiles: []string{"*.pid"},
+	})
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(orphanDir, "redis.pid"), []byte(strconv.Itoa(orphan.Process.Pid)+"\n"), 0666))
+
+	// a service owned by this process
+	owned := startSleep(t)
+	defer owned.Process.Kill()
+	ownedDir := writeMarker(t, dir, "owned", &ownerMarker{
+		RunID:   RunID(),
+		Owner:   os.Getpid(),
+		Service: Etcd,
+		Pids:    []int{owned.Process.Pid},
+	})
+
+	// a pid recorded before the process starts is recycled by another process
+	recycled := startSleep(t)
+	defer recycled.Process.Kill()
+	recycledDir := writeMarker(t, dir, "recycled", &ownerMarker{
+		RunID:    "dead-run",
+		Owner:    dead.Process.Pid,
+		Service:  Redis,
+		PidFiles: []string{"*.pid"},
+	})
+	pidFile := filepath.Join(recycledDir, "redis.pid")
+	assert.NoError(t, ioutil.WriteFile(pidFile, []byte(strconv.Itoa(recycled.Process.Pid)+"\n"), 0666))
+	past := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(pidFile, past, past))
+
+	reaped, err := Reap(ReapOptions{Dir: dir, DryRun: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []Reaped{{RunID: "dead-run", Service: Redis, Kind: "process", ID: strconv.Itoa(orphan.Process.Pid)}}, reaped)
+	assert.True(t, processAlive(orphan.Process.Pid), "dry run shouldn't kill")
+
+	reaped, err = Reap(ReapOptions{Dir: dir})
+	assert.NoError(t, err)
+	assert.Len(t, reaped, 1)
+	assert.True(t, processAlive(recycled.Process.Pid), "recycled pid shouldn't be killed")
+	orphan.Wait()
+	_, err = os.Stat(orphanDir)
+	assert.True(t, os.IsNotExist(err), "work dir of orphan should be removed")
+	_, err = os.Stat(ownedDir)
+	assert.NoError(t, err, "work dir of live owner should be kept")
+
+	reaped, err = Reap(ReapOptions{Dir: dir, RunID: RunID()})
+	assert.NoError(t, err)
+	assert.Equal(t, []Reaped{{RunID: RunID(), Service: Etcd, Kind: "process", ID: strconv.Itoa(owned.Process.Pid)}}, reaped)
+}
+
+func startSleep(t *testing.T) *exec.Cmd {
+	cmd := exec.Command("sleep", "60")
+	assert.NoError(t, cmd.Start())
+	// wait until the process is running
+	time.Sleep(10 * time.Millisecond)
+	return cmd
+}
+
+func writeMarker(t *testing.T, dir, name string, m *ownerMarker) string {
+	workDir := filepath.Join(dir, name)
+	assert.NoError(t, os.Mkdir(workDir, 0777))
+	bs, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(workDir, ownerMarkerFileName), bs, 0666))
+	return workDir
+}
@@ -1,17 +1,23 @@
 package test
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
+	"github.com/garyburd/redigo/redis"
 )
 
 const (
-	redisChkTimes = 10
-	redisChkDelay = 1 * time.Second
+	redisReadyTimeout = 10 * time.Second
+	redisLogFileName  = "redis.log"
+	// redisBusPortOffset is the offset of the cluster bus port to the client port
+	redisBusPortOffset = 10000
 )
 
 func init() {
@@ -21,28 +27,69 @@ func init() {
 			port:      6379,
 		}
 	})
+	RegisterSpecOption(Redis, "auth", stringSpecOption(RedisAuth))
+	RegisterSpecOption(Redis, "memory", stringSpecOption(RedisMemory))
+	RegisterSpecOption(Redis, "persistence", stringSpecOption(func(v string) ServiceOption {
+		return RedisPersistenceMode(RedisPersistence(v))
+	}))
+	RegisterSpecOption(Redis, "eviction_policy", stringSpecOption(RedisEvictionPolicy))
+	RegisterSpecOption(Redis, "image", stringSpecOption(RedisImage))
 }
 
 type redisService struct {
+	serviceBase
 	port      int
 	workDir   string
 	auth      string
 	maxMemory string
-	container *docker.Container
+	// clusterEnabled starts the server as a node of redis cluster
+	clusterEnabled bool
+	// replicaOf is ip:port of the master which the server replicates
+	replicaOf   string
+	persistence RedisPersistence
+	tls         *redisTLS
+	// modules are paths of modules followed by their arguments
+	modules [][]string
+	// config are directives set by RedisConfig
+	config []redisDirective
+	image  string
 }
 
 func (s *redisService) Start() (string, error) {
+	return s.StartContext(context.Background())
+}
+
+func (s *redisService) StartContext(ctx context.Context) (ipport string, err error) {
 	// perform default check
-	if err := CheckExecutable("redis-server", "redis-cli"); err != nil {
+	if err := s.checkNative(); err != nil {
 		return "", err
 	}
 
-	// booking 1 ports
-	ports, err := BookPorts(1)
+	// booking 1 ports, plus the cluster bus port of cluster nodes
+	defer func() {
+		if err != nil {
+			s.releasePorts()
+		}
+	}()
+	if s.clusterEnabled {
+		s.port, err = s.bookBusPort(redisBusPortOffset)
+	} else {
+		var ports []int
+		ports, err = s.bookPorts(1)
+		if err == nil {
+			s.port = ports[0]
+		}
+	}
+	if err == nil && s.tls != nil {
+		var ports []int
+		ports, err = s.bookPorts(1)
+		if err == nil {
+			s.tls.port = ports[0]
+		}
+	}
 	if err != nil {
 		return "", fmt.Errorf("fail to book ports, err:%v", err)
 	}
-	s.port = ports[0]
 
 	// prepare tmp dir
 	s.workDir, err = ioutil.TempDir("", "redis-test")
@@ -51,69 +98,283 @@ func (s *redisService) Start() (string, error) {
 	}
 
 	pidFile := filepath.Join(s.workDir, "redis.pid")
-	logFile := filepath.Join(s.workDir, "redis.log")
+	logFile := filepath.Join(s.workDir, redisLogFileName)
 
-	cmds := []interface{}{
-		"--daemonize", "yes",
-		"--port", s.port,
-		"--pidfile", pidFile,
-		"--logfile", logFile,
-		"--dir", s.workDir,
-		"--maxmemory", s.maxMemory,
+	if err := s.writeConf([]redisDirective{
+		{"daemonize", "yes"},
+		{"port", strconv.Itoa(s.port)},
+		{"pidfile", pidFile},
+		{"logfile", logFile},
+		{"dir", s.workDir},
+	}, func(path string) string {
+		return path
+	}); err != nil {
+		return "", err
 	}
 
-	if s.auth != "" {
-		cmds = append(cmds, "--requirepass", s.auth)
+	if err := markOwner(Redis, s.workDir, nil, filepath.Base(pidFile)); err != nil {
+		return "", fmt.Errorf("fail to mark owner, err:%v", err)
 	}
-
-	if err := Exec(s.workDir, nil, nil, "redis-server", cmds...); err != nil {
+	if err := ExecContext(ctx, s.workDir, nil, nil, "redis-server", filepath.Join(s.workDir, redisConfFileName)); err != nil {
+		s.Stop()
 		return "", fmt.Errorf("fail to start redis server, err:%v", err)
 	}
 
-	for i := 0; i < redisChkTimes; i++ {
-		time.Sleep(redisChkDelay)
-		if CheckListening(s.port) {
-			return fmt.Sprintf("localhost:%d", s.port), nil
-		}
+	ipport = fmt.Sprintf("localhost:%d", s.port)
+	if err := s.waitReady(ctx, ipport, redisReadyTimeout, RedisPingProbe(s.auth)); err != nil {
+		s.Stop()
+		return "", fmt.Errorf("fail to start redis, err:%v", err)
 	}
-	// only need region server thrift port
-	return "", fmt.Errorf("fail to start redis")
+	return ipport, nil
 }
 
 func (s *redisService) Stop() error {
+	return s.StopContext(context.Background())
+}
+
+func (s *redisService) StopContext(ctx context.Context) error {
+	defer s.releasePorts()
 	// close process
-	return Exec(
-		s.workDir, nil, nil,
-		"redis-cli",
-		"-h", "localhost",
-		"-p", s.port,
-		"shutdown")
+	args := []interface{}{"-h", "localhost", "-p", s.port}
+	if s.auth != "" {
+		args = append(args, "-a", s.auth)
+	}
+	return ExecContext(ctx, s.workDir, nil, nil, "redis-cli", append(args, "shutdown")...)
+}
+
+// logFiles returns the log file of redis and outputs of redis-server and redis-cli
+func (s *redisService) logFiles() []string {
+	return []string{filepath.Join(s.workDir, redisLogFileName), filepath.Join(s.workDir, execLogFileName)}
+}
+
+// checkNative checks executables required to start the service natively
+func (s *redisService) checkNative() error {
+	return CheckExecutable("redis-server", "redis-cli")
 }
 
 // StartDocker start the service via docker
 func (s *redisService) StartDocker(cl *docker.Client) (ipport string, err error) {
-	Cmds := []string{
-		"redis-server",
-		"--port", fmt.Sprintf("%d", s.port),
-		"--maxmemory", s.maxMemory,
-		"--maxmemory-policy", "allkeys-lru", // TODO: default to allkeys-lru, will it change
+	return s.StartDockerContext(context.Background(), cl)
+}
+
+// StartDockerContext start the service via docker. redis.conf and files of options
+// are mounted into the container.
+func (s *redisService) StartDockerContext(ctx context.Context, cl *docker.Client) (ipport string, err error) {
+	// prepare tmp dir
+	s.workDir, err = ioutil.TempDir("", "redis-test")
+	if err != nil {
+		return "", fmt.Errorf("fail to prepare tmp dir, err:%v", err)
 	}
-	if s.auth != "" {
-		Cmds = append(Cmds, "--requirepass", s.auth)
+	defer func() {
+		if err != nil {
+			os.RemoveAll(s.workDir)
+		}
+	}()
+
+	exposed := []string{fmt.Sprintf("%d/tcp", s.port)}
+	if s.clusterEnabled {
+		exposed = append(exposed, fmt.Sprintf("%d/tcp", s.port+redisBusPortOffset))
+	}
+	if s.tls != nil {
+		s.tls.port = redisDockerTLSPort
+		exposed = append(exposed, fmt.Sprintf("%d/tcp", s.tls.port))
+	}
+	binds := []string{filepath.Join(s.workDir, redisConfFileName) + ":" + redisDockerConfFile + ":ro"}
+	if err := s.writeConf([]redisDirective{
+		{"port", strconv.Itoa(s.port)},
+		{"dir", "/data"},
+	}, func(path string) string {
+		mounted := fmt.Sprintf("/csigo/%d-%s", len(binds), filepath.Base(path))
+		binds = append(binds, path+":"+mounted+":ro")
+		return mounted
+	}); err != nil {
+		return "", err
+	}
+	image := s.image
+	if image == "" {
+		image = redisDockerImage
 	}
 
-	s.container, ipport, err = StartContainer(
-		cl,
-		SetImage("redis:3-alpine"),
-		SetExposedPorts([]string{fmt.Sprintf("%d/tcp", s.port)}),
-		SetCommand(Cmds),
+	s.container, ipport, err = StartContainerContext(
+		ctx, cl,
+		SetImage(image),
+		SetExposedPorts(exposed),
+		SetBinds(binds),
+		SetCommand([]string{"redis-server", redisDockerConfFile}),
 	)
-	return ipport, err
+	if err != nil {
+		return "", err
+	}
+	if err := s.waitReady(ctx, ipport, redisReadyTimeout, RedisPingProbe(s.auth)); err != nil {
+		RemoveContainer(cl, s.container)
+		return "", fmt.Errorf("fail to start redis, err:%v", err)
+	}
+	return ipport, nil
 }
 
 // StopDocker stops the service via docker
 func (s *redisService) StopDocker(cl *docker.Client) error {
-	return RemoveContainer(cl, s.container)
+	return s.StopDockerContext(context.Background(), cl)
+}
+
+// StopDockerContext stops the service via docker, and removes the work dir
+func (s *redisService) StopDockerContext(ctx context.Context, cl *docker.Client) error {
+	return CombineError(RemoveContainerContext(ctx, cl, s.container), os.RemoveAll(s.workDir))
+}
+
+// Reset flushes all databases
+func (s *redisService) Reset(ctx context.Context, ipport string) error {
+	conn, err := redisDial(ctx, ipport, s.auth)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("FLUSHALL")
+	return err
+}
+
+// redisKey is a key in redis snapshots
+type redisKey struct {
+	DB  int    `json:"db"`
+	Key string `json:"key"`
+	// TTL is in milliseconds, 0 means no expiry
+	TTL int64 `json:"ttl"`
+	// Value is serialized by DUMP
+	Value []byte `json:"value"`
+}
+
+// redisScanCount is the hint of keys scanned and dumped per round trip
+const redisScanCount = 1000
+
+// Snapshot dumps keys of all databases
+func (s *redisService) Snapshot(ctx context.Context, ipport, name string) error {
+	conn, err := redisDial(ctx, ipport, s.auth)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	keys := []redisKey{}
+	for db := 0; db < maxRedisDB; db++ {
+		if _, err := conn.Do("SELECT", db); err != nil {
+			// the server may be configured with less databases
+			break
+		}
+		// SCAN may return a key more than once
+		seen := map[string]bool{}
+		cursor := "0"
+		for {
+			reply, err := redis.Values(conn.Do("SCAN", cursor, "COUNT", redisScanCount))
+			if err != nil {
+				return err
+			}
+			var names []string
+			if _, err := redis.Scan(reply, &cursor, &names); err != nil {
+				return err
+			}
+			batch := names[:0]
+			for _, key := range names {
+				if !seen[key] {
+					seen[key] = true
+					batch = append(batch, key)
+				}
+			}
+			dumped, err := redisDumpKeys(conn, db, batch)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, dumped...)
+			if cursor == "0" {
+				break
+			}
+		}
+	}
+	return writeSnapshot(Redis, name, keys)
+}
+
+// redisDumpKeys dumps keys of the selected database in one round trip
+func redisDumpKeys(conn redis.Conn, db int, names []string) ([]redisKey, error) {
+	for _, key := range names {
+		conn.Send("DUMP", key)
+		conn.Send("PTTL", key)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	keys := make([]redisKey, 0, len(names))
+	for _, key := range names {
+		value, err := redis.Bytes(conn.Receive())
+		if err != nil && err != redis.ErrNil {
+			return nil, fmt.Errorf("fail to dump %s, err:%v", key, err)
+		}
+		ttl, ttlErr := redis.Int64(conn.Receive())
+		if ttlErr != nil {
+			return nil, ttlErr
+		}
+		if err == redis.ErrNil {
+			// expired meanwhile
+			continue
+		}
+		if ttl < 0 {
+			ttl = 0
+		}
+		keys = append(keys, redisKey{DB: db, Key: key, TTL: ttl, Value: value})
+	}
+	return keys, nil
+}
+
+// Restore flushes all databases and restores keys of the snapshot
+func (s *redisService) Restore(ctx context.Context, ipport, name string) error {
+	keys := []redisKey{}
+	if err := readSnapshot(Redis, name, &keys); err != nil {
+		return err
+	}
+	if err := s.Reset(ctx, ipport); err != nil {
+		return err
+	}
+	conn, err := redisDial(ctx, ipport, s.auth)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > redisScanCount {
+			n = redisScanCount
+		}
+		if err := redisRestoreKeys(conn, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// redisRestoreKeys restores keys in one round trip
+func redisRestoreKeys(conn redis.Conn, keys []redisKey) error {
+	// replies in order, an empty name marks the one of SELECT
+	names := make([]string, 0, len(keys))
+	db := -1
+	for _, k := range keys {
+		if k.DB != db {
+			db = k.DB
+			conn.Send("SELECT", db)
+			names = append(names, "")
+		}
+		conn.Send("RESTORE", k.Key, k.TTL, k.Value)
+		names = append(names, k.Key)
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	for _, key := range names {
+		if _, err := conn.Receive(); err != nil {
+			if key == "" {
+				return err
+			}
+			return fmt.Errorf("fail to restore %s, err:%v", key, err)
+		}
+	}
+	return nil
 }
 
 func RedisMemory(maxMem string) ServiceOption {
@@ -140,11 +401,16 @@ func RedisPort(port int) ServiceOption {
 
 func RedisAuth(password string) ServiceOption {
 	return func(s Service) error {
-		rs, ok := s.(*redisService)
-		if !ok {
+		switch rs := s.(type) {
+		case *redisService:
+			rs.auth = password
+		case *redisClusterService:
+			rs.auth = password
+		case *redisSentinelService:
+			rs.auth = password
+		default:
 			return fmt.Errorf("can't set redis auth with service %v", s)
 		}
-		rs.auth = password
 		return nil
 	}
 }
@@ -0,0 +1,326 @@
+package test
+
+// This file handles redis cluster, which consists of masters sharing the hash slots
+// and their replicas. Every node is a redis service started with cluster enabled,
+// and the cluster is formed with CLUSTER MEET, ADDSLOTS and REPLICATE, which works
+// with redis versions lacking `redis-cli --cluster`.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	redisClusterSlots        = 16384
+	redisClusterNodeTimeout  = 5 * time.Second
+	redisClusterReadyTimeout = 30 * time.Second
+)
+
+func init() {
+	RegisterService(RedisCluster, func() Service {
+		return &redisClusterService{
+			masters:   3,
+			maxMemory: "64mb",
+		}
+	})
+	RegisterSpecOption(RedisCluster, "masters", intSpecOption(RedisClusterMasters))
+	RegisterSpecOption(RedisCluster, "replicas", intSpecOption(RedisClusterReplicas))
+	RegisterSpecOption(RedisCluster, "auth", stringSpecOption(RedisAuth))
+}
+
+type redisClusterService struct {
+	serviceBase
+	masters int
+	// replicas is the number of replicas of each master
+	replicas  int
+	auth      string
+	maxMemory string
+	// nodes are masters followed by replicas of the first master, the second one
+	// and so on, and addrs are their ip:port
+	nodes []*redisService
+	addrs []string
+	cl    *docker.Client
+}
+
+// Start starts nodes and returns ip:port of the first master
+func (s *redisClusterService) Start() (string, error) {
+	return s.StartContext(context.Background())
+}
+
+// StartContext starts nodes and returns ip:port of the first master
+func (s *redisClusterService) StartContext(ctx context.Context) (string, error) {
+	if err := s.checkNative(); err != nil {
+		return "", err
+	}
+	return s.start(ctx, nil)
+}
+
+// StartDocker starts nodes via docker
+func (s *redisClusterService) StartDocker(cl *docker.Client) (string, error) {
+	return s.StartDockerContext(context.Background(), cl)
+}
+
+// StartDockerContext starts nodes via docker. Nodes announce addresses of their
+// containers, so the cluster is only reachable where container ips are.
+func (s *redisClusterService) StartDockerContext(ctx context.Context, cl *docker.Client) (string, error) {
+	return s.start(ctx, cl)
+}
+
+// start starts nodes natively, or via docker if cl is set, and forms the cluster
+func (s *redisClusterService) start(ctx context.Context, cl *docker.Client) (string, error) {
+	if s.masters < 1 || s.replicas < 0 {
+		return "", fmt.Errorf("invalid cluster of %d masters with %d replicas", s.masters, s.replicas)
+	}
+	s.cl = cl
+	for i := 0; i < s.masters*(1+s.replicas); i++ {
+		node := &redisService{
+			port:           6379,
+			auth:           s.auth,
+			maxMemory:      s.maxMemory,
+			clusterEnabled: true,
+		}
+		var ipport string
+		var err error
+		if cl != nil {
+			ipport, err = node.StartDockerContext(ctx, cl)
+		} else {
+			ipport, err = node.StartContext(ctx)
+		}
+		if err != nil {
+			// the failed node isn't stopped with started ones
+			node.releasePorts()
+			s.stop(context.Background())
+			return "", fmt.Errorf("fail to start redis node %d, err:%v", i, err)
+		}
+		s.nodes = append(s.nodes, node)
+		s.addrs = append(s.addrs, ipport)
+	}
+	if err := s.form(ctx); err != nil {
+		s.stop(context.Background())
+		return "", fmt.Errorf("fail to form redis cluster, err:%v", err)
+	}
+	ipport := s.addrs[0]
+	if err := s.waitReady(ctx, ipport, redisClusterReadyTimeout, ProbeFunc(s.checkState)); err != nil {
+		s.stop(context.Background())
+		return "", fmt.Errorf("fail to start redis cluster, err:%v", err)
+	}
+	return ipport, nil
+}
+
+// form introduces nodes to each other, assigns slots to masters evenly and lets
+// replicas follow their masters
+func (s *redisClusterService) form(ctx context.Context) error {
+	// introduce all nodes to the first one, and gossip spreads them
+	for _, addr := range s.addrs[1:] {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		ip, err := net.ResolveIPAddr("ip4", host)
+		if err != nil {
+			return fmt.Errorf("fail to resolve %s, err:%v", host, err)
+		}
+		if _, err := s.do(ctx, s.addrs[0], "CLUSTER", "MEET", ip.String(), port); err != nil {
+			return fmt.Errorf("fail to meet %s, err:%v", addr, err)
+		}
+	}
+
+	ids := make([]string, s.masters)
+	for i := range ids {
+		args := []interface{}{"ADDSLOTS"}
+		for slot := i * redisClusterSlots / s.masters; slot < (i+1)*redisClusterSlots/s.masters; slot++ {
+			args = append(args, slot)
+		}
+		if _, err := s.do(ctx, s.addrs[i], "CLUSTER", args...); err != nil {
+			return fmt.Errorf("fail to assign slots to %s, err:%v", s.addrs[i], err)
+		}
+		nodes, err := redis.String(s.do(ctx, s.addrs[i], "CLUSTER", "NODES"))
+		if err != nil {
+			return err
+		}
+		if ids[i] = redisClusterMyID(nodes); ids[i] == "" {
+			return fmt.Errorf("fail to get node id of %s", s.addrs[i])
+		}
+	}
+
+	for i, addr := range s.addrs[s.masters:] {
+		master := ids[i/s.replicas]
+		// replicas can only follow masters they have heard of, retry until gossip
+		// reaches them
+		replicate := ProbeFunc(func(ctx context.Context, ipport string) error {
+			_, err := s.do(ctx, ipport, "CLUSTER", "REPLICATE", master)
+			return err
+		})
+		if err := WaitReady(ctx, addr, redisClusterReadyTimeout, DefaultBackoff, replicate); err != nil {
+			return fmt.Errorf("fail to replicate %s with %s, err:%v", addr, master, err)
+		}
+	}
+	return nil
+}
+
+// checkState checks if all nodes consider the cluster ok
+func (s *redisClusterService) checkState(ctx context.Context, ipport string) error {
+	probe := RedisClusterStateProbe(s.auth)
+	for _, addr := range s.addrs {
+		if err := probe.Probe(ctx, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// do runs the command on the node at ipport
+func (s *redisClusterService) do(ctx context.Context, ipport, cmd string, args ...interface{}) (interface{}, error) {
+	conn, err := redisDial(ctx, ipport, s.auth)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Do(cmd, args...)
+}
+
+// Stop stops all nodes
+func (s *redisClusterService) Stop() error {
+	return s.StopContext(context.Background())
+}
+
+// StopContext stops all nodes
+func (s *redisClusterService) StopContext(ctx context.Context) error {
+	return s.stop(ctx)
+}
+
+// StopDocker stops all nodes via docker
+func (s *redisClusterService) StopDocker(cl *docker.Client) error {
+	return s.StopDockerContext(context.Background(), cl)
+}
+
+// StopDockerContext stops all nodes via docker
+func (s *redisClusterService) StopDockerContext(ctx context.Context, cl *docker.Client) error {
+	return s.stop(ctx)
+}
+
+// stop stops started nodes
+func (s *redisClusterService) stop(ctx context.Context) error {
+	errs := []error{}
+	for _, node := range s.nodes {
+		if s.cl != nil {
+			errs = append(errs, node.StopDockerContext(ctx, s.cl))
+		} else {
+			errs = append(errs, node.StopContext(ctx))
+		}
+	}
+	s.nodes, s.addrs = nil, nil
+	return CombineError(errs...)
+}
+
+// checkNative checks executables required to start the service natively
+func (s *redisClusterService) checkNative() error {
+	return CheckExecutable("redis-server", "redis-cli")
+}
+
+// logFiles returns log files of nodes started natively
+func (s *redisClusterService) logFiles() []string {
+	files := []string{}
+	for _, node := range s.nodes {
+		if node.workDir != "" {
+			files = append(files, node.logFiles()...)
+		}
+	}
+	return files
+}
+
+// endpoints returns endpoints of all nodes
+func (s *redisClusterService) endpoints() []Endpoint {
+	eps := []Endpoint{}
+	for i, addr := range s.addrs {
+		name := fmt.Sprintf("master_%d", i)
+		if i >= s.masters {
+			i -= s.masters
+			name = fmt.Sprintf("replica_%d_%d", i/s.replicas, i%s.replicas)
+		}
+		host, port, _ := net.SplitHostPort(addr)
+		p, _ := strconv.Atoi(port)
+		eps = append(eps, Endpoint{Name: name, Protocol: ProtocolRedis, Host: host, Port: p})
+	}
+	return eps
+}
+
+// Reset flushes all masters, which replicate to their replicas
+func (s *redisClusterService) Reset(ctx context.Context, ipport string) error {
+	for _, addr := range s.addrs[:s.masters] {
+		if _, err := s.do(ctx, addr, "FLUSHALL"); err != nil {
+			return fmt.Errorf("fail to flush %s, err:%v", addr, err)
+		}
+	}
+	return nil
+}
+
+// redisClusterMyID returns id of the node answering CLUSTER NODES
+func redisClusterMyID(nodes string) string {
+	for _, line := range strings.Split(nodes, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		for _, flag := range strings.Split(fields[2], ",") {
+			if flag == "myself" {
+				return fields[0]
+			}
+		}
+	}
+	return ""
+}
+
+// RedisClusterStateProbe returns a probe which passes once the redis cluster node
+// reports cluster_state:ok
+func RedisClusterStateProbe(auth string) ReadinessProbe {
+	return ProbeFunc(func(ctx context.Context, ipport string) error {
+		conn, err := redisDial(ctx, ipport, auth)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		info, err := redis.String(conn.Do("CLUSTER", "INFO"))
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(info, "\n") {
+			if strings.TrimSpace(line) == "cluster_state:ok" {
+				return nil
+			}
+		}
+		return fmt.Errorf("cluster state of %s isn't ok", ipport)
+	})
+}
+
+// RedisClusterMasters sets the number of masters, which is 3 by default
+func RedisClusterMasters(n int) ServiceOption {
+	return func(s Service) error {
+		rs, ok := s.(*redisClusterService)
+		if !ok {
+			return fmt.Errorf("can't set redis cluster masters with service %v", s)
+		}
+		rs.masters = n
+		return nil
+	}
+}
+
+// RedisClusterReplicas sets the number of replicas of each master, which is 0 by
+// default
+func RedisClusterReplicas(n int) ServiceOption {
+	return func(s Service) error {
+		rs, ok := s.(*redisClusterService)
+		if !ok {
+			return fmt.Errorf("can't set redis cluster replicas with service %v", s)
+		}
+		rs.replicas = n
+		return nil
+	}
+}
@@ -0,0 +1,71 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestRedisClusterMyID(t *testing.T) {
+	nodes := "07c37dfeb235213a872192d90877d0cd55635b91 127.0.0.1:30004@31004 slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238317239 4 connected\n" +
+		"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001 myself,master - 0 0 1 connected 0-5460\n"
+	assert.Equal(t, "e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca", redisClusterMyID(nodes))
+	assert.Equal(t, "", redisClusterMyID(""))
+}
+
+func TestRedisClusterEndpoints(t *testing.T) {
+	s := &redisClusterService{
+		masters:  2,
+		replicas: 2,
+		addrs:    []string{"a:1", "b:2", "c:3", "d:4", "e:5", "f:6"},
+	}
+	names := []string{}
+	for _, e := range s.endpoints() {
+		names = append(names, e.Name)
+	}
+	assert.Equal(t, []string{"master_0", "master_1", "replica_0_0", "replica_0_1", "replica_1_0", "replica_1_1"}, names)
+	assert.Equal(t, "redis://f:6", s.endpoints()[5].URL())
+}
+
+func TestRedisClusterSuite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip redis cluster test")
+		return
+	}
+	suite.Run(t, new(redisClusterSuite))
+}
+
+type redisClusterSuite struct {
+	suite.Suite
+}
+
+func (s *redisClusterSuite) TestService() {
+	sl := NewServiceLauncher()
+	defer sl.StopAll()
+
+	desc, _, err := sl.StartDescriptor(context.Background(), RedisCluster,
+		RedisClusterMasters(3), RedisClusterReplicas(1))
+	s.NoError(err)
+	s.Len(desc.Endpoints, 6)
+
+	for _, e := range desc.Endpoints {
+		conn, err := redis.Dial("tcp", e.Addr())
+		s.NoError(err)
+		info, err := redis.String(conn.Do("CLUSTER", "INFO"))
+		s.NoError(err)
+		s.Contains(info, "cluster_state:ok")
+		s.Contains(info, "cluster_known_nodes:6")
+		conn.Close()
+	}
+
+	replica, _ := desc.Endpoint("replica_0_0")
+	conn, err := redis.Dial("tcp", replica.Addr())
+	s.NoError(err)
+	defer conn.Close()
+	role, err := redis.Values(conn.Do("ROLE"))
+	s.NoError(err)
+	s.Equal("slave", string(role[0].([]byte)))
+}
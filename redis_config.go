@@ -0,0 +1,226 @@
+package test
+
+// This file renders redis.conf of redis services. Settings of all options become
+// directives of the file, which native servers and containers load alike.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	redisConfFileName = "redis.conf"
+	// redisDockerImage is the image of containers unless RedisImage is set
+	redisDockerImage = "redis:3-alpine"
+	// redisDockerConfFile is where redis.conf is mounted in containers
+	redisDockerConfFile = "/usr/local/etc/redis/redis.conf"
+	// redisDockerTLSPort is the tls port inside the container
+	redisDockerTLSPort = 6380
+)
+
+// RedisPersistence is how redis persists data
+type RedisPersistence string
+
+// supported persistence modes
+const (
+	// RedisPersistenceNone disables both RDB snapshots and AOF
+	RedisPersistenceNone RedisPersistence = "none"
+	// RedisPersistenceRDB saves RDB snapshots periodically
+	RedisPersistenceRDB RedisPersistence = "rdb"
+	// RedisPersistenceAOF appends writes to AOF only
+	RedisPersistenceAOF RedisPersistence = "aof"
+	// RedisPersistenceBoth enables both RDB snapshots and AOF
+	RedisPersistenceBoth RedisPersistence = "both"
+)
+
+// redisDefaultSaves are the default save points of RDB snapshots
+var redisDefaultSaves = []redisDirective{
+	{"save", "900", "1"},
+	{"save", "300", "10"},
+	{"save", "60", "10000"},
+}
+
+// redisDirective is a directive of redis.conf, the name followed by arguments
+type redisDirective []string
+
+func (d redisDirective) String() string {
+	args := make([]string, 0, len(d))
+	for _, arg := range d {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'\\#") {
+			arg = strconv.Quote(arg)
+		}
+		args = append(args, arg)
+	}
+	return strings.Join(args, " ")
+}
+
+// redisTLS is the tls listener of redis services
+type redisTLS struct {
+	port     int
+	certFile string
+	keyFile  string
+	caFile   string
+}
+
+// writeConf renders redis.conf into the work dir with the base directives followed
+// by the ones of options, so later directives override earlier ones. file maps files
+// on the host to paths seen by the server.
+func (s *redisService) writeConf(base []redisDirective, file func(string) string) error {
+	lines := []string{}
+	for _, d := range append(base, s.directives(file)...) {
+		lines = append(lines, d.String())
+	}
+	conf := strings.Join(lines, "\n") + "\n"
+	if err := ioutil.WriteFile(filepath.Join(s.workDir, redisConfFileName), []byte(conf), 0666); err != nil {
+		return fmt.Errorf("fail to write %s, err:%v", redisConfFileName, err)
+	}
+	return nil
+}
+
+// directives returns directives of options shared by native and docker
+func (s *redisService) directives(file func(string) string) []redisDirective {
+	ds := []redisDirective{}
+	if s.maxMemory != "" {
+		ds = append(ds, redisDirective{"maxmemory", s.maxMemory})
+	}
+	if s.auth != "" {
+		// replicas authenticate to their masters with the same password
+		ds = append(ds, redisDirective{"requirepass", s.auth}, redisDirective{"masterauth", s.auth})
+	}
+	if s.replicaOf != "" {
+		// replicaof since redis 5, slaveof is accepted by all versions
+		host, port, _ := net.SplitHostPort(s.replicaOf)
+		ds = append(ds, redisDirective{"slaveof", host, port})
+	}
+	if s.clusterEnabled {
+		ds = append(ds,
+			redisDirective{"cluster-enabled", "yes"},
+			redisDirective{"cluster-config-file", "nodes.conf"},
+			redisDirective{"cluster-node-timeout", strconv.Itoa(int(redisClusterNodeTimeout / time.Millisecond))})
+	}
+	switch s.persistence {
+	case RedisPersistenceNone:
+		ds = append(ds, redisDirective{"save", ""}, redisDirective{"appendonly", "no"})
+	case RedisPersistenceRDB:
+		ds = append(append(ds, redisDirective{"save", ""}), redisDefaultSaves...)
+		ds = append(ds, redisDirective{"appendonly", "no"})
+	case RedisPersistenceAOF:
+		ds = append(ds, redisDirective{"save", ""}, redisDirective{"appendonly", "yes"})
+	case RedisPersistenceBoth:
+		ds = append(append(ds, redisDirective{"save", ""}), redisDefaultSaves...)
+		ds = append(ds, redisDirective{"appendonly", "yes"})
+	}
+	if s.tls != nil {
+		ds = append(ds,
+			redisDirective{"tls-port", strconv.Itoa(s.tls.port)},
+			redisDirective{"tls-cert-file", file(s.tls.certFile)},
+			redisDirective{"tls-key-file", file(s.tls.keyFile)},
+			redisDirective{"tls-ca-cert-file", file(s.tls.caFile)})
+	}
+	for _, m := range s.modules {
+		ds = append(ds, append(redisDirective{"loadmodule", file(m[0])}, m[1:]...))
+	}
+	return append(ds, s.config...)
+}
+
+// endpoints returns the client endpoint, and the tls one if it's set
+func (s *redisService) endpoints() []Endpoint {
+	eps := []Endpoint{{Name: "client", Protocol: ProtocolRedis, Port: s.port}}
+	if s.tls != nil {
+		eps = append(eps, Endpoint{Name: "tls", Protocol: ProtocolRedisTLS, Port: s.tls.port})
+	}
+	return eps
+}
+
+// redisOption applies f to the redis service
+func redisOption(name string, f func(*redisService)) ServiceOption {
+	return func(s Service) error {
+		rs, ok := s.(*redisService)
+		if !ok {
+			return fmt.Errorf("can't set redis %s with service %v", name, s)
+		}
+		f(rs)
+		return nil
+	}
+}
+
+// RedisConfig appends the directive to redis.conf, e.g. RedisConfig("save", "") or
+// RedisConfig("notify-keyspace-events", "KEA"). It overrides directives set by other
+// options.
+func RedisConfig(name string, args ...string) ServiceOption {
+	return redisOption("config", func(rs *redisService) {
+		rs.config = append(rs.config, append(redisDirective{name}, args...))
+	})
+}
+
+// RedisPersistenceMode sets how redis persists data, the server default if not set
+func RedisPersistenceMode(mode RedisPersistence) ServiceOption {
+	return func(s Service) error {
+		switch mode {
+		case RedisPersistenceNone, RedisPersistenceRDB, RedisPersistenceAOF, RedisPersistenceBoth:
+		default:
+			return fmt.Errorf("unsupported redis persistence %q", mode)
+		}
+		return redisOption("persistence", func(rs *redisService) {
+			rs.persistence = mode
+		})(s)
+	}
+}
+
+// RedisEvictionPolicy sets maxmemory-policy, e.g. "allkeys-lru". The server default
+// is used if not set.
+func RedisEvictionPolicy(policy string) ServiceOption {
+	return RedisConfig("maxmemory-policy", policy)
+}
+
+// RedisACLUser adds the ACL user with the rules, e.g.
+// RedisACLUser("app", "on", ">secret", "~*", "+@all"). It requires redis 6 or later.
+func RedisACLUser(name string, rules ...string) ServiceOption {
+	return RedisConfig("user", append([]string{name}, rules...)...)
+}
+
+// RedisTLS adds a tls listener with the certificate, key and CA certificate files,
+// which is the "tls" endpoint of the service. Relative paths are resolved against
+// the working dir. It requires redis 6 or later built with tls.
+func RedisTLS(certFile, keyFile, caFile string) ServiceOption {
+	return func(s Service) error {
+		files := []string{certFile, keyFile, caFile}
+		for i, file := range files {
+			abs, err := filepath.Abs(file)
+			if err != nil {
+				return fmt.Errorf("invalid redis tls file %s, err:%v", file, err)
+			}
+			files[i] = abs
+		}
+		return redisOption("tls", func(rs *redisService) {
+			rs.tls = &redisTLS{certFile: files[0], keyFile: files[1], caFile: files[2]}
+		})(s)
+	}
+}
+
+// RedisModule loads the module at path, which is resolved against the working dir
+// if relative, with the arguments. It requires redis 4 or later.
+func RedisModule(path string, args ...string) ServiceOption {
+	return func(s Service) error {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return fmt.Errorf("invalid redis module %s, err:%v", path, err)
+		}
+		return redisOption("module", func(rs *redisService) {
+			rs.modules = append(rs.modules, append([]string{abs}, args...))
+		})(s)
+	}
+}
+
+// RedisImage sets the image of containers, which is redis:3-alpine by default. Set
+// it for features of newer versions, e.g. RedisImage("redis:6-alpine") for ACL users.
+func RedisImage(image string) ServiceOption {
+	return redisOption("image", func(rs *redisService) {
+		rs.image = image
+	})
+}
@@ -0,0 +1,71 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisDirective(t *testing.T) {
+	assert.Equal(t, `save ""`, redisDirective{"save", ""}.String())
+	assert.Equal(t, `user app on >secret ~app:*`, redisDirective{"user", "app", "on", ">secret", "~app:*"}.String())
+	assert.Equal(t, `requirepass "pass word"`, redisDirective{"requirepass", "pass word"}.String())
+}
+
+func TestRedisWriteConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-conf-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := &redisService{workDir: dir, maxMemory: "64mb", auth: "pass"}
+	for _, opt := range []ServiceOption{
+		RedisPersistenceMode(RedisPersistenceAOF),
+		RedisEvictionPolicy("allkeys-lru"),
+		RedisTLS("/certs/redis.crt", "/certs/redis.key", "/certs/ca.crt"),
+		RedisModule("/modules/redisbloom.so", "INITIAL_SIZE", "400"),
+		RedisConfig("maxmemory", "128mb"),
+	} {
+		assert.NoError(t, opt(s))
+	}
+	s.tls.port = 6380
+	assert.Error(t, RedisPersistenceMode("sometimes")(s))
+	assert.Error(t, RedisConfig("save", "")(&etcdService{}))
+
+	mounted := []string{}
+	assert.NoError(t, s.writeConf([]redisDirective{{"port", "6379"}}, func(path string) string {
+		mounted = append(mounted, path)
+		return "/mnt/" + filepath.Base(path)
+	}))
+	bs, err := ioutil.ReadFile(filepath.Join(dir, redisConfFileName))
+	assert.NoError(t, err)
+	assert.Equal(t, `port 6379
+maxmemory 64mb
+requirepass pass
+masterauth pass
+save ""
+appendonly yes
+tls-port 6380
+tls-cert-file /mnt/redis.crt
+tls-key-file /mnt/redis.key
+tls-ca-cert-file /mnt/ca.crt
+loadmodule /mnt/redisbloom.so INITIAL_SIZE 400
+maxmemory-policy allkeys-lru
+maxmemory 128mb
+`, string(bs))
+	assert.Equal(t, []string{"/certs/redis.crt", "/certs/redis.key", "/certs/ca.crt", "/modules/redisbloom.so"}, mounted)
+
+	eps := s.endpoints()
+	assert.Len(t, eps, 2)
+	assert.Equal(t, ProtocolRedisTLS, eps[1].Protocol)
+
+	// relative paths are resolved by options
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, RedisModule("modules/redisbloom.so")(s))
+	assert.Equal(t, filepath.Join(wd, "modules/redisbloom.so"), s.modules[1][0])
+	assert.NoError(t, RedisTLS("redis.crt", "redis.key", "ca.crt")(s))
+	assert.Equal(t, filepath.Join(wd, "ca.crt"), s.tls.caFile)
+}
@@ -0,0 +1,541 @@
+package test
+
+// This file handles redis sentinel, which consists of a master, its replicas and
+// three sentinels monitoring the master as RedisSentinelMasterName. The service is
+// reached via sentinels, and RedisFailover fails the master over for testing clients.
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// RedisSentinelMasterName is the name which sentinels monitor the master as
+	RedisSentinelMasterName = "csigo"
+
+	redisSentinels               = 3
+	redisSentinelQuorum          = 2
+	redisSentinelDockerPort      = 26379
+	redisSentinelConfFileName    = "sentinel.conf"
+	redisSentinelDownAfter       = time.Second
+	redisSentinelReadyTimeout    = 30 * time.Second
+	redisSentinelFailoverTimeout = 30 * time.Second
+)
+
+// RedisFailoverMode is how RedisFailover fails the master
+type RedisFailoverMode int
+
+// supported failover modes
+const (
+	// RedisFailoverCommand asks sentinels to fail over by SENTINEL FAILOVER
+	RedisFailoverCommand RedisFailoverMode = iota
+	// RedisFailoverKill stops the master and lets sentinels detect it's down
+	RedisFailoverKill
+)
+
+func init() {
+	RegisterService(RedisSentinel, func() Service {
+		return &redisSentinelService{
+			replicas:  2,
+			maxMemory: "64mb",
+		}
+	})
+	RegisterSpecOption(RedisSentinel, "replicas", intSpecOption(RedisSentinelReplicas))
+	RegisterSpecOption(RedisSentinel, "auth", stringSpecOption(RedisAuth))
+}
+
+type redisSentinelService struct {
+	serviceBase
+	replicas  int
+	auth      string
+	maxMemory string
+	// nodes are the initial master followed by replicas, and addrs are their
+	// ip:port. Nodes stopped by RedisFailoverKill are nil.
+	nodes         []*redisService
+	addrs         []string
+	sentinels     []*sentinelNode
+	sentinelAddrs []string
+	cl            *docker.Client
+}
+
+// Start starts the topology and returns ip:port of the first sentinel
+func (s *redisSentinelService) Start() (string, error) {
+	return s.StartContext(context.Background())
+}
+
+// StartContext starts the topology and returns ip:port of the first sentinel
+func (s *redisSentinelService) StartContext(ctx context.Context) (string, error) {
+	if err := s.checkNative(); err != nil {
+		return "", err
+	}
+	return s.start(ctx, nil)
+}
+
+// StartDocker starts the topology via docker
+func (s *redisSentinelService) StartDocker(cl *docker.Client) (string, error) {
+	return s.StartDockerContext(context.Background(), cl)
+}
+
+// StartDockerContext starts the topology via docker. Sentinels report addresses of
+// containers, so masters are only reachable where container ips are.
+func (s *redisSentinelService) StartDockerContext(ctx context.Context, cl *docker.Client) (string, error) {
+	return s.start(ctx, cl)
+}
+
+// start starts nodes natively, or via docker if cl is set, then sentinels
+func (s *redisSentinelService) start(ctx context.Context, cl *docker.Client) (string, error) {
+	if s.replicas < 1 {
+		return "", fmt.Errorf("invalid sentinel topology with %d replicas", s.replicas)
+	}
+	s.cl = cl
+	var master string
+	for i := 0; i <= s.replicas; i++ {
+		node := &redisService{
+			port:      6379,
+			auth:      s.auth,
+			maxMemory: s.maxMemory,
+			replicaOf: master,
+		}
+		ipport, err := s.startNode(ctx, node)
+		if err != nil {
+			s.stop(context.Background())
+			return "", fmt.Errorf("fail to start redis node %d, err:%v", i, err)
+		}
+		s.nodes = append(s.nodes, node)
+		s.addrs = append(s.addrs, ipport)
+		if i == 0 {
+			// replicas and sentinels need the ip of the master
+			if master, err = resolveIPPort(ipport); err != nil {
+				s.stop(context.Background())
+				return "", err
+			}
+		}
+	}
+
+	host, port, _ := net.SplitHostPort(master)
+	conf := []string{
+		fmt.Sprintf("sentinel monitor %s %s %s %d", RedisSentinelMasterName, host, port, redisSentinelQuorum),
+		fmt.Sprintf("sentinel down-after-milliseconds %s %d", RedisSentinelMasterName, redisSentinelDownAfter/time.Millisecond),
+		fmt.Sprintf("sentinel failover-timeout %s %d", RedisSentinelMasterName, redisSentinelFailoverTimeout/time.Millisecond),
+	}
+	if s.auth != "" {
+		conf = append(conf, fmt.Sprintf("sentinel auth-pass %s %s", RedisSentinelMasterName, s.auth))
+	}
+	for i := 0; i < redisSentinels; i++ {
+		node := &sentinelNode{conf: conf}
+		ipport, err := s.startNode(ctx, node)
+		if err != nil {
+			s.stop(context.Background())
+			return "", fmt.Errorf("fail to start sentinel %d, err:%v", i, err)
+		}
+		s.sentinels = append(s.sentinels, node)
+		s.sentinelAddrs = append(s.sentinelAddrs, ipport)
+	}
+
+	ipport := s.sentinelAddrs[0]
+	if err := s.waitReady(ctx, ipport, redisSentinelReadyTimeout, ProbeFunc(s.checkMonitored)); err != nil {
+		s.stop(context.Background())
+		return "", fmt.Errorf("fail to start redis sentinel, err:%v", err)
+	}
+	return ipport, nil
+}
+
+// sentinelTopologyNode is a node of the topology
+type sentinelTopologyNode interface {
+	StartContext(context.Context) (string, error)
+	StopContext(context.Context) error
+	StartDockerContext(context.Context, *docker.Client) (string, error)
+	StopDockerContext(context.Context, *docker.Client) error
+}
+
+// startNode starts the node natively or via docker
+func (s *redisSentinelService) startNode(ctx context.Context, node sentinelTopologyNode) (string, error) {
+	if s.cl != nil {
+		return node.StartDockerContext(ctx, s.cl)
+	}
+	return node.StartContext(ctx)
+}
+
+// stopNode stops the node natively or via docker
+func (s *redisSentinelService) stopNode(ctx context.Context, node sentinelTopologyNode) error {
+	if s.cl != nil {
+		return node.StopDockerContext(ctx, s.cl)
+	}
+	return node.StopContext(ctx)
+}
+
+// checkMonitored checks if every sentinel has discovered the replicas and the other
+// sentinels, which is required to fail over
+func (s *redisSentinelService) checkMonitored(ctx context.Context, ipport string) error {
+	for _, addr := range s.sentinelAddrs {
+		conn, err := redisDial(ctx, addr, "")
+		if err != nil {
+			return err
+		}
+		state, err := redis.StringMap(conn.Do("SENTINEL", "MASTER", RedisSentinelMasterName))
+		conn.Close()
+		if err != nil {
+			return err
+		}
+		if n, _ := strconv.Atoi(state["num-slaves"]); n < s.replicas {
+			return fmt.Errorf("sentinel %s knows %d replicas", addr, n)
+		}
+		if n, _ := strconv.Atoi(state["num-other-sentinels"]); n < redisSentinels-1 {
+			return fmt.Errorf("sentinel %s knows %d other sentinels", addr, n)
+		}
+	}
+	return nil
+}
+
+// master returns ip:port of the master reported by the sentinel at addr
+func (s *redisSentinelService) master(ctx context.Context, addr string) (string, error) {
+	conn, err := redisDial(ctx, addr, "")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", RedisSentinelMasterName))
+	if err != nil {
+		return "", err
+	}
+	if len(reply) != 2 {
+		return "", fmt.Errorf("unexpected master address %v", reply)
+	}
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// failover fails the master over and waits until a new master is promoted
+func (s *redisSentinelService) failover(ctx context.Context, mode RedisFailoverMode) (string, error) {
+	old, err := s.master(ctx, s.sentinelAddrs[0])
+	if err != nil {
+		return "", err
+	}
+	switch mode {
+	case RedisFailoverCommand:
+		conn, err := redisDial(ctx, s.sentinelAddrs[0], "")
+		if err != nil {
+			return "", err
+		}
+		_, err = conn.Do("SENTINEL", "FAILOVER", RedisSentinelMasterName)
+		conn.Close()
+		if err != nil {
+			return "", fmt.Errorf("fail to fail over, err:%v", err)
+		}
+	case RedisFailoverKill:
+		i := s.nodeIndex(old)
+		if i < 0 {
+			return "", fmt.Errorf("master %s isn't a node of the service", old)
+		}
+		err = s.stopNode(ctx, s.nodes[i])
+		s.nodes[i] = nil
+		if err != nil {
+			return "", fmt.Errorf("fail to kill master %s, err:%v", old, err)
+		}
+	default:
+		return "", fmt.Errorf("unsupported failover mode %v", mode)
+	}
+
+	var promoted string
+	probe := ProbeFunc(func(ctx context.Context, ipport string) error {
+		promoted = ""
+		for _, addr := range s.sentinelAddrs {
+			m, err := s.master(ctx, addr)
+			if err != nil {
+				return err
+			}
+			if m == old {
+				return fmt.Errorf("sentinel %s still reports %s", addr, old)
+			}
+			if promoted != "" && m != promoted {
+				return fmt.Errorf("sentinels disagree on %s and %s", promoted, m)
+			}
+			promoted = m
+		}
+		conn, err := redisDial(ctx, promoted, s.auth)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		role, err := redis.Values(conn.Do("ROLE"))
+		if err != nil {
+			return err
+		}
+		if r, _ := redis.String(role[0], nil); r != "master" {
+			return fmt.Errorf("%s is still a %s", promoted, r)
+		}
+		return nil
+	})
+	if err := WaitReady(ctx, old, redisSentinelFailoverTimeout, DefaultBackoff, probe); err != nil {
+		return "", fmt.Errorf("no master is promoted, err:%v", err)
+	}
+	return promoted, nil
+}
+
+// nodeIndex returns index of the node at ip:port addr, -1 if not found
+func (s *redisSentinelService) nodeIndex(addr string) int {
+	for i, a := range s.addrs {
+		if ip, err := resolveIPPort(a); err == nil && ip == addr && s.nodes[i] != nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// Stop stops sentinels and nodes
+func (s *redisSentinelService) Stop() error {
+	return s.StopContext(context.Background())
+}
+
+// StopContext stops sentinels and nodes
+func (s *redisSentinelService) StopContext(ctx context.Context) error {
+	return s.stop(ctx)
+}
+
+// StopDocker stops sentinels and nodes via docker
+func (s *redisSentinelService) StopDocker(cl *docker.Client) error {
+	return s.StopDockerContext(context.Background(), cl)
+}
+
+// StopDockerContext stops sentinels and nodes via docker
+func (s *redisSentinelService) StopDockerContext(ctx context.Context, cl *docker.Client) error {
+	return s.stop(ctx)
+}
+
+// stop stops started sentinels first, so they don't fail over meanwhile
+func (s *redisSentinelService) stop(ctx context.Context) error {
+	errs := []error{}
+	for _, node := range s.sentinels {
+		errs = append(errs, s.stopNode(ctx, node))
+	}
+	for _, node := range s.nodes {
+		if node != nil {
+			errs = append(errs, s.stopNode(ctx, node))
+		}
+	}
+	s.sentinels, s.sentinelAddrs, s.nodes, s.addrs = nil, nil, nil, nil
+	return CombineError(errs...)
+}
+
+// checkNative checks executables required to start the service natively
+func (s *redisSentinelService) checkNative() error {
+	return CheckExecutable("redis-server", "redis-cli")
+}
+
+// logFiles returns log files of nodes and sentinels started natively
+func (s *redisSentinelService) logFiles() []string {
+	files := []string{}
+	for _, node := range s.nodes {
+		if node != nil && node.workDir != "" {
+			files = append(files, node.logFiles()...)
+		}
+	}
+	for _, node := range s.sentinels {
+		if node.workDir != "" {
+			files = append(files, node.logFile(), filepath.Join(node.workDir, execLogFileName))
+		}
+	}
+	return files
+}
+
+// endpoints returns endpoints of sentinels and running nodes, where node_0 is the
+// initial master
+func (s *redisSentinelService) endpoints() []Endpoint {
+	eps := []Endpoint{}
+	for i, addr := range s.sentinelAddrs {
+		eps = append(eps, redisEndpoint(fmt.Sprintf("sentinel_%d", i), addr))
+	}
+	for i, addr := range s.addrs {
+		if s.nodes[i] != nil {
+			eps = append(eps, redisEndpoint(fmt.Sprintf("node_%d", i), addr))
+		}
+	}
+	return eps
+}
+
+// Reset flushes the current master, which replicates to its replicas
+func (s *redisSentinelService) Reset(ctx context.Context, ipport string) error {
+	master, err := s.master(ctx, s.sentinelAddrs[0])
+	if err != nil {
+		return err
+	}
+	conn, err := redisDial(ctx, master, s.auth)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("FLUSHALL")
+	return err
+}
+
+// sentinelNode is a redis server running as a sentinel
+type sentinelNode struct {
+	serviceBase
+	port    int
+	workDir string
+	// conf are directives of sentinel.conf
+	conf []string
+}
+
+// StartContext starts the sentinel natively
+func (n *sentinelNode) StartContext(ctx context.Context) (string, error) {
+	ports, err := n.bookPorts(1)
+	if err != nil {
+		return "", fmt.Errorf("fail to book ports, err:%v", err)
+	}
+	n.port = ports[0]
+	if err := n.writeConf(); err != nil {
+		n.cleanUp()
+		return "", err
+	}
+	pidFile := filepath.Join(n.workDir, "redis.pid")
+	if err := markOwner(RedisSentinel, n.workDir, nil, filepath.Base(pidFile)); err != nil {
+		n.cleanUp()
+		return "", fmt.Errorf("fail to mark owner, err:%v", err)
+	}
+	if err := ExecContext(ctx, n.workDir, nil, nil, "redis-server",
+		filepath.Join(n.workDir, redisSentinelConfFileName), "--sentinel",
+		"--daemonize", "yes",
+		"--port", n.port,
+		"--pidfile", pidFile,
+		"--logfile", n.logFile(),
+		"--dir", n.workDir); err != nil {
+		n.StopContext(context.Background())
+		return "", fmt.Errorf("fail to start redis sentinel, err:%v", err)
+	}
+	ipport := fmt.Sprintf("localhost:%d", n.port)
+	if err := n.waitReady(ctx, ipport, redisReadyTimeout, RedisPingProbe("")); err != nil {
+		n.StopContext(context.Background())
+		return "", fmt.Errorf("fail to start redis sentinel, err:%v", err)
+	}
+	return ipport, nil
+}
+
+// StopContext stops the sentinel started natively, and removes the work dir
+func (n *sentinelNode) StopContext(ctx context.Context) error {
+	defer n.cleanUp()
+	return ExecContext(ctx, n.workDir, nil, nil, "redis-cli", "-h", "localhost", "-p", n.port, "shutdown")
+}
+
+// cleanUp releases the port and removes the work dir of the sentinel started
+// natively
+func (n *sentinelNode) cleanUp() {
+	n.releasePorts()
+	if n.workDir != "" {
+		os.RemoveAll(n.workDir)
+	}
+}
+
+// StartDockerContext starts the sentinel via docker, whose config is mounted as
+// sentinels rewrite it
+func (n *sentinelNode) StartDockerContext(ctx context.Context, cl *docker.Client) (ipport string, err error) {
+	n.port = redisSentinelDockerPort
+	defer func() {
+		if err != nil && n.workDir != "" {
+			os.RemoveAll(n.workDir)
+		}
+	}()
+	if err = n.writeConf(); err != nil {
+		return "", err
+	}
+	n.container, ipport, err = StartContainerContext(
+		ctx, cl,
+		SetImage("redis:3-alpine"),
+		SetExposedPorts([]string{fmt.Sprintf("%d/tcp", n.port)}),
+		SetBinds([]string{n.workDir + ":/data"}),
+		SetCommand([]string{
+			"redis-server", "/data/" + redisSentinelConfFileName, "--sentinel",
+			"--port", strconv.Itoa(n.port),
+		}),
+	)
+	if err != nil {
+		return "", err
+	}
+	if err := n.waitReady(ctx, ipport, redisReadyTimeout, RedisPingProbe("")); err != nil {
+		RemoveContainer(cl, n.container)
+		return "", fmt.Errorf("fail to start redis sentinel, err:%v", err)
+	}
+	return ipport, nil
+}
+
+// StopDockerContext stops the sentinel started via docker, and removes the work dir
+func (n *sentinelNode) StopDockerContext(ctx context.Context, cl *docker.Client) error {
+	return CombineError(RemoveContainerContext(ctx, cl, n.container), os.RemoveAll(n.workDir))
+}
+
+// writeConf writes sentinel.conf into a new work dir
+func (n *sentinelNode) writeConf() (err error) {
+	n.workDir, err = ioutil.TempDir("", "redis-sentinel-test")
+	if err != nil {
+		return fmt.Errorf("fail to prepare tmp dir, err:%v", err)
+	}
+	conf := strings.Join(n.conf, "\n") + "\n"
+	return ioutil.WriteFile(filepath.Join(n.workDir, redisSentinelConfFileName), []byte(conf), 0666)
+}
+
+// logFile returns the log file of the sentinel started natively
+func (n *sentinelNode) logFile() string {
+	return filepath.Join(n.workDir, redisLogFileName)
+}
+
+// resolveIPPort replaces the host of ipport with its ipv4 address
+func resolveIPPort(ipport string) (string, error) {
+	host, port, err := net.SplitHostPort(ipport)
+	if err != nil {
+		return "", err
+	}
+	ip, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return "", fmt.Errorf("fail to resolve %s, err:%v", host, err)
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// redisEndpoint returns the redis endpoint at ipport
+func redisEndpoint(name, ipport string) Endpoint {
+	host, port, _ := net.SplitHostPort(ipport)
+	p, _ := strconv.Atoi(port)
+	return Endpoint{Name: name, Protocol: ProtocolRedis, Host: host, Port: p}
+}
+
+// RedisSentinelMaster returns ip:port of the current master of the redis sentinel
+// service at ipport
+func RedisSentinelMaster(ctx context.Context, sl ServiceLauncher, ipport string) (string, error) {
+	rs, ok := sl.Get(ipport).(*redisSentinelService)
+	if !ok {
+		return "", fmt.Errorf("no redis sentinel service at %s", ipport)
+	}
+	return rs.master(ctx, ipport)
+}
+
+// RedisFailover fails the master of the redis sentinel service at ipport over and
+// waits until sentinels agree on a promoted replica. It returns ip:port of the new
+// master.
+func RedisFailover(ctx context.Context, sl ServiceLauncher, ipport string, mode RedisFailoverMode) (string, error) {
+	rs, ok := sl.Get(ipport).(*redisSentinelService)
+	if !ok {
+		return "", fmt.Errorf("no redis sentinel service at %s", ipport)
+	}
+	return rs.failover(ctx, mode)
+}
+
+// RedisSentinelReplicas sets the number of replicas, which is 2 by default
+func RedisSentinelReplicas(n int) ServiceOption {
+	return func(s Service) error {
+		rs, ok := s.(*redisSentinelService)
+		if !ok {
+			return fmt.Errorf("can't set redis sentinel replicas with service %v", s)
+		}
+		rs.replicas = n
+		return nil
+	}
+}
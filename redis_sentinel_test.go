@@ -0,0 +1,68 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestResolveIPPort(t *testing.T) {
+	ipport, err := resolveIPPort("localhost:6379")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:6379", ipport)
+	_, err = resolveIPPort("localhost")
+	assert.Error(t, err)
+}
+
+func TestRedisSentinelEndpoints(t *testing.T) {
+	s := &redisSentinelService{
+		nodes:         []*redisService{nil, {}, {}},
+		addrs:         []string{"a:1", "b:2", "c:3"},
+		sentinelAddrs: []string{"d:4", "e:5", "f:6"},
+	}
+	names := []string{}
+	for _, e := range s.endpoints() {
+		names = append(names, e.Name)
+	}
+	assert.Equal(t, []string{"sentinel_0", "sentinel_1", "sentinel_2", "node_1", "node_2"}, names,
+		"killed nodes are skipped")
+}
+
+func TestRedisSentinelSuite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip redis sentinel test")
+		return
+	}
+	suite.Run(t, new(redisSentinelSuite))
+}
+
+type redisSentinelSuite struct {
+	suite.Suite
+}
+
+func (s *redisSentinelSuite) TestFailover() {
+	ctx := context.Background()
+	sl := NewServiceLauncher()
+	defer sl.StopAll()
+
+	ipport, _, err := sl.Start(RedisSentinel, RedisAuth("password"))
+	s.NoError(err)
+	master, err := RedisSentinelMaster(ctx, sl, ipport)
+	s.NoError(err)
+
+	for _, mode := range []RedisFailoverMode{RedisFailoverCommand, RedisFailoverKill} {
+		promoted, err := RedisFailover(ctx, sl, ipport, mode)
+		s.NoError(err)
+		s.NotEqual(master, promoted)
+
+		conn, err := redis.Dial("tcp", promoted, redis.DialPassword("password"))
+		s.NoError(err)
+		_, err = conn.Do("SET", "aaa", "bbb")
+		s.NoError(err, "new master accepts writes")
+		conn.Close()
+		master = promoted
+	}
+}
@@ -1,6 +1,7 @@
 package test
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"testing"
@@ -77,3 +78,82 @@ func (s *redisSuite) TestAuth() {
 	_, err = conn.Do("SET", "aaa", "bbb")
 	s.NoError(err, "set data error")
 }
+
+func (s *redisSuite) TestStartForTest() {
+	auth := "password"
+	ipport := StartForTest(s.T(), Redis, RedisAuth(auth))
+
+	conn, err := redis.Dial("tcp", ipport, redis.DialPassword(auth))
+	s.NoError(err, "get conn error")
+	defer conn.Close()
+
+	_, err = conn.Do("SET", "aaa", "bbb")
+	s.NoError(err, "set data error")
+}
+
+func (s *redisSuite) TestReset() {
+	service := &redisService{}
+
+	ipport, err := service.Start()
+	s.NoError(err, "start service error")
+	defer service.Stop()
+
+	conn, err := redis.Dial("tcp", ipport)
+	s.NoError(err, "get conn error")
+	defer conn.Close()
+
+	_, err = conn.Do("SET", "aaa", "bbb")
+	s.NoError(err, "set data error")
+
+	s.NoError(service.Reset(context.Background(), ipport), "reset error")
+
+	reply, err := conn.Do("GET", "aaa")
+	s.NoError(err, "get data error")
+	s.Nil(reply, "data should be flushed")
+}
+
+func (s *redisSuite) TestSnapshot() {
+	service := &redisService{}
+
+	ipport, err := service.Start()
+	s.NoError(err, "start service error")
+	defer service.Stop()
+
+	conn, err := redis.Dial("tcp", ipport)
+	s.NoError(err, "get conn error")
+	defer conn.Close()
+
+	_, err = conn.Do("SET", "aaa", "bbb")
+	s.NoError(err, "set data error")
+	s.NoError(service.Snapshot(context.Background(), ipport, "redis-suite"), "snapshot error")
+
+	_, err = conn.Do("SET", "aaa", "ccc")
+	s.NoError(err, "set data error")
+	s.NoError(service.Restore(context.Background(), ipport, "redis-suite"), "restore error")
+
+	reply, err := redis.String(conn.Do("GET", "aaa"))
+	s.NoError(err, "get data error")
+	s.Equal("bbb", reply, "data should be restored")
+}
+
+func (s *redisSuite) TestConfig() {
+	ipport := StartForTest(s.T(), Redis,
+		RedisPersistenceMode(RedisPersistenceAOF),
+		RedisEvictionPolicy("allkeys-lru"),
+		RedisConfig("notify-keyspace-events", "KEA"))
+
+	conn, err := redis.Dial("tcp", ipport)
+	s.NoError(err, "get conn error")
+	defer conn.Close()
+
+	for name, value := range map[string]string{
+		"appendonly":             "yes",
+		"save":                   "",
+		"maxmemory-policy":       "allkeys-lru",
+		"notify-keyspace-events": "AKE",
+	} {
+		reply, err := redis.Strings(conn.Do("CONFIG", "GET", name))
+		s.NoError(err, "get config error")
+		s.Equal([]string{name, value}, reply)
+	}
+}
@@ -0,0 +1,150 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// baseService is implemented by services embedding serviceBase, which lets options
+// shared by all services reach the embedded settings
+type baseService interface {
+	base() *serviceBase
+}
+
+// serviceBase holds settings shared by all services
+type serviceBase struct {
+	// probes are readiness probes attached by callers, they run after the default
+	// probes of the service
+	probes []ReadinessProbe
+	// readyTimeout overrides the default readiness timeout of the service
+	readyTimeout time.Duration
+	// backoff overrides DefaultBackoff
+	backoff *Backoff
+	// backend overrides the default backend of the launcher
+	backend Backend
+	// container is set if the service is started via docker
+	container *docker.Container
+	// leased are ports booked by the service and released on stop
+	leased []int
+	// logSinks are teed logs of the service while it runs
+	logSinks []logSink
+	// logger overrides the logger of the launcher
+	logger Logger
+	// h is the typed handle of the service created on first access, and closeH
+	// closes its client
+	h      interface{}
+	closeH func() error
+	hLock  sync.Mutex
+}
+
+func (b *serviceBase) base() *serviceBase {
+	return b
+}
+
+// handle returns the typed handle of the service, creating it by create on first
+// call. create also returns the function closing its client, which may be nil.
+func (b *serviceBase) handle(create func() (interface{}, func() error, error)) (interface{}, error) {
+	b.hLock.Lock()
+	defer b.hLock.Unlock()
+	if b.h != nil {
+		return b.h, nil
+	}
+	h, closeH, err := create()
+	if err != nil {
+		return nil, fmt.Errorf("fail to create handle, err:%v", err)
+	}
+	b.h, b.closeH = h, closeH
+	return h, nil
+}
+
+// closeHandle closes client of the typed handle if created
+func (b *serviceBase) closeHandle() error {
+	b.hLock.Lock()
+	defer b.hLock.Unlock()
+	closeH := b.closeH
+	b.h, b.closeH = nil, nil
+	if closeH == nil {
+		return nil
+	}
+	return closeH()
+}
+
+// bookPorts books ports which are released by releasePorts
+func (b *serviceBase) bookPorts(num int) ([]int, error) {
+	ports, err := BookPorts(num)
+	if err != nil {
+		return nil, err
+	}
+	b.leased = append(b.leased, ports...)
+	return ports, nil
+}
+
+// bookBusPort books a port together with its cluster bus port, which is offset
+// higher. Both are released by releasePorts.
+func (b *serviceBase) bookBusPort(offset int) (int, error) {
+	port, err := bookPortPair(offset)
+	if err != nil {
+		return 0, err
+	}
+	b.leased = append(b.leased, port, port+offset)
+	return port, nil
+}
+
+// releasePorts releases ports booked by bookPorts
+func (b *serviceBase) releasePorts() error {
+	err := ReleasePorts(b.leased...)
+	b.leased = nil
+	return err
+}
+
+// waitReady waits until ipport passes the given default probes and the probes
+// attached by callers
+func (b *serviceBase) waitReady(ctx context.Context, ipport string, timeout time.Duration, defaults ...ReadinessProbe) error {
+	if b.readyTimeout > 0 {
+		timeout = b.readyTimeout
+	}
+	backoff := DefaultBackoff
+	if b.backoff != nil {
+		backoff = *b.backoff
+	}
+	probes := append(append([]ReadinessProbe{}, defaults...), b.probes...)
+	return WaitReady(ctx, ipport, timeout, backoff, probes...)
+}
+
+// withBase applies f to the settings shared by all services
+func withBase(name string, f func(*serviceBase)) ServiceOption {
+	return func(s Service) error {
+		bs, ok := s.(baseService)
+		if !ok {
+			return fmt.Errorf("can't set %s with service %v", name, s)
+		}
+		f(bs.base())
+		return nil
+	}
+}
+
+// ReadinessProbes attaches extra probes which must pass before the service is
+// considered ready
+func ReadinessProbes(probes ...ReadinessProbe) ServiceOption {
+	return withBase("readiness probes", func(b *serviceBase) {
+		b.probes = append(b.probes, probes...)
+	})
+}
+
+// ReadinessTimeout overrides how long to wait for the service to become ready
+func ReadinessTimeout(timeout time.Duration) ServiceOption {
+	return withBase("readiness timeout", func(b *serviceBase) {
+		b.readyTimeout = timeout
+	})
+}
+
+// ReadinessBackoff overrides the delay between readiness checks
+func ReadinessBackoff(backoff Backoff) ServiceOption {
+	return withBase("readiness backoff", func(b *serviceBase) {
+		b.backoff = &backoff
+	})
+}
@@ -1,14 +1,15 @@
 package test
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"runtime"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
@@ -16,22 +17,14 @@ import (
 
 // ServiceDocker defines an interface to create service via docker
 type ServiceDocker interface {
-	// Start creates and starts an instance of supported service by the give type. It
-	// returns its listening ip:port and the corresponding stop function.
-	Start(ServiceType, ...ServiceOption) (ipport string, stopFunc func() error, err error)
-	// StopAll stop all created services
-	StopAll() error
-	// Get retruns service, return nil if no service for the given ipport
-	Get(ipport string) interface{}
+	ServiceLauncher
 }
 
-// NewServiceDocker returns an instance of ServiceDocker
+// NewServiceDocker returns an instance of ServiceDocker, which is a ServiceLauncher
+// launching all services via docker
 // TODO: with specified docker address
 func NewServiceDocker() ServiceDocker {
-	return &serviceDockerImpl{
-		services:     map[string]Service{},
-		dockerclient: NewDockerClient(),
-	}
+	return newServiceLauncher(BackendDocker)
 }
 
 // ContainerOptionFunc is a function that configures a Client.
@@ -45,92 +38,45 @@ type ContainerNode struct {
 	Port    []string
 }
 
-// serviceDockerImpl implements ServiceDocker
-type serviceDockerImpl struct {
-	// docker client
-	dockerclient *docker.Client
-	// service stores created services
-	services map[string]Service
-	// mutx to protected services
-	sync.Mutex
-}
-
-// Create returns an instance of supported service by the give type
-func (s *serviceDockerImpl) Start(t ServiceType, options ...ServiceOption) (string, func() error, error) {
-	s.Lock()
-	defer s.Unlock()
-
-	srvFactories.RLock()
-	fac, ok := srvFactories.facs[t]
-	srvFactories.RUnlock()
-	if !ok {
-		return "", nil, fmt.Errorf("unsupported service type %v", t)
-	}
-	// guard with state checker
-	srv := &stateChkService{
-		state:   stateNew,
-		Service: fac(),
-		cl:      s.dockerclient,
-	}
-	// apply option functions
-	for _, opt := range options {
-		if err := opt(srv.Service); err != nil {
-			return "", nil, fmt.Errorf("failed to apply option %v", opt)
-		}
-	}
-	// start service
-	ipport, err := srv.Start()
-	if err != nil {
-		return "", nil, fmt.Errorf("unable to start service %v, err %v", t, err)
-	}
-	// store raw service
-	s.services[ipport] = srv.Service
-	return ipport, srv.Stop, nil
-}
-
-// StopAll stop all created services
-func (s *serviceDockerImpl) StopAll() error {
-	s.Lock()
-	defer s.Unlock()
-
-	errs := []error{}
-	for _, ss := range s.services {
-		errs = append(errs, ss.StopDocker(s.dockerclient))
-	}
-	s.services = map[string]Service{}
-	return CombineError(errs...)
-}
-
-// Get return service by givne ip port
-func (s *serviceDockerImpl) Get(ipport string) interface{} {
-	s.Lock()
-	defer s.Unlock()
-	return s.services[ipport]
-}
-
 // NewDockerClient create docker client via unix socket
 func NewDockerClient() (cl *docker.Client) {
-	endpoint := "unix:///var/run/docker.sock"
-	var err error
-	cl, err = docker.NewClient(endpoint)
+	cl, err := newDockerClient()
 	if err != nil {
 		log.Fatal(err)
 	}
 	return cl
 }
 
+func newDockerClient() (*docker.Client, error) {
+	endpoint := "unix:///var/run/docker.sock"
+	return docker.NewClient(endpoint)
+}
+
 // RemoveContainer remove the started container
 func RemoveContainer(client *docker.Client, container *docker.Container) error {
+	return RemoveContainerContext(context.Background(), client, container)
+}
+
+// RemoveContainerContext is like RemoveContainer but bounded by ctx
+func RemoveContainerContext(ctx context.Context, client *docker.Client, container *docker.Container) error {
+	if container == nil {
+		return fmt.Errorf("container is not started")
+	}
 	return client.RemoveContainer(docker.RemoveContainerOptions{
-		ID:    container.ID,
-		Force: true,
+		ID:      container.ID,
+		Force:   true,
+		Context: ctx,
 	})
 }
 
 // StartContainer starts the required container
 func StartContainer(client *docker.Client, options ...ContainerOptionFunc) (c *docker.Container, ipaddr string, err error) {
-	// TODO: handle context
-	ctx := context.Background()
+	return StartContainerContext(context.Background(), client, options...)
+}
+
+// StartContainerContext is like StartContainer but gives up once ctx is done. The
+// container is removed if it fails to become reachable.
+func StartContainerContext(ctx context.Context, client *docker.Client, options ...ContainerOptionFunc) (c *docker.Container, ipaddr string, err error) {
 	opts, err := createDockerOptions(ctx, options...)
 	if err != nil {
 		return c, "", err
@@ -139,22 +85,26 @@ func StartContainer(client *docker.Client, options ...ContainerOptionFunc) (c *d
 	if err != nil {
 		return c, "", err
 	}
+	// ctx may already be done when cleaning up, so remove with a fresh one
+	created := c
+	defer func() {
+		if err != nil {
+			RemoveContainer(client, created)
+		}
+	}()
 
 	err = client.StartContainerWithContext(c.ID, nil, ctx)
 	if err != nil {
-		RemoveContainer(client, c)
 		return c, "", err
 	}
 
 	// wait for container to wake up
-	if err := waitStarted(client, c.ID, 5*time.Second); err != nil {
-		RemoveContainer(client, c)
+	if err = waitStarted(ctx, client, c.ID, 5*time.Second); err != nil {
 		return c, "", err
 	}
 	c, err = client.InspectContainerWithContext(c.ID, ctx)
 	if err != nil {
-		RemoveContainer(client, c)
-		return c, "", err
+		return created, "", err
 	}
 
 	// determine IP address for Component
@@ -168,9 +118,8 @@ func StartContainer(client *docker.Client, options ...ContainerOptionFunc) (c *d
 
 	// wait Component to wake up
 	ipaddr = fmt.Sprintf("%s:%s", ip, port)
-	fmt.Printf("%s\n", ipaddr)
+	logf(ctx, LevelDebug, "container %s listens on %s", c.ID, ipaddr)
 	if err = waitReachable(ctx, ipaddr, 10*time.Second); err != nil {
-		RemoveContainer(client, c)
 		return c, "", err
 	}
 	return c, ipaddr, nil
@@ -185,16 +134,16 @@ func StartContainer(client *docker.Client, options ...ContainerOptionFunc) (c *d
 func SetExposedPorts(ports []string) ContainerOptionFunc {
 	return func(opts *docker.CreateContainerOptions) error {
 		for i, exp := range ports {
-
-			if i == 0 { // only first port will be checked and exposed
-				connectPort := docker.Port(exp).Port()
-				if runtime.GOOS == "darwin" {
-					connectPort = strconv.Itoa(GetPort())
-					opts.HostConfig.PortBindings[docker.Port(exp)] = append(opts.HostConfig.PortBindings[docker.Port(exp)], docker.PortBinding{
-						HostPort: connectPort,
-						HostIP:   "",
-					})
-				}
+			// all ports are published, but only first port will be checked
+			connectPort := docker.Port(exp).Port()
+			if runtime.GOOS == "darwin" {
+				connectPort = strconv.Itoa(GetPort())
+				opts.HostConfig.PortBindings[docker.Port(exp)] = append(opts.HostConfig.PortBindings[docker.Port(exp)], docker.PortBinding{
+					HostPort: connectPort,
+					HostIP:   "",
+				})
+			}
+			if i == 0 {
 				opts.Context = context.WithValue(opts.Context, "csigo_test_port", connectPort)
 			}
 			opts.Config.ExposedPorts[docker.Port(exp)] = struct{}{}
@@ -227,10 +176,54 @@ func SetCommand(cmd []string) ContainerOptionFunc {
 	}
 }
 
+// SetBinds bind mounts host files or dirs into the container, accepts format as
+// "/host/path:/container/path[:ro]"
+func SetBinds(binds []string) ContainerOptionFunc {
+	return func(opts *docker.CreateContainerOptions) error {
+		opts.HostConfig.Binds = append(opts.HostConfig.Binds, binds...)
+		return nil
+	}
+}
+
+// ExecContainer runs cmd inside the running container and waits until it finishes.
+// It returns error if fail to execute or exit code is not zero.
+func ExecContainer(ctx context.Context, client *docker.Client, container *docker.Container, stdin io.Reader, cmd ...string) error {
+	exec, err := client.CreateExec(docker.CreateExecOptions{
+		Container:    container.ID,
+		Cmd:          cmd,
+		AttachStdin:  stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+		Context:      ctx,
+	})
+	if err != nil {
+		return fmt.Errorf("fail to create exec %v, err:%v", cmd, err)
+	}
+	out := bytes.NewBuffer(nil)
+	if err := client.StartExec(exec.ID, docker.StartExecOptions{
+		InputStream:  stdin,
+		OutputStream: out,
+		ErrorStream:  out,
+		Context:      ctx,
+	}); err != nil {
+		return fmt.Errorf("fail to exec %v, output:%s, err:%v", cmd, out.String(), err)
+	}
+	inspect, err := client.InspectExec(exec.ID)
+	if err != nil {
+		return fmt.Errorf("fail to inspect exec %v, err:%v", cmd, err)
+	}
+	if inspect.ExitCode != 0 {
+		return fmt.Errorf("fail to exec %v, output:%s, exit code:%d", cmd, out.String(), inspect.ExitCode)
+	}
+	return nil
+}
+
 func createDockerOptions(ctx context.Context, options ...ContainerOptionFunc) (docker.CreateContainerOptions, error) {
 	opts := docker.CreateContainerOptions{
 		Config: &docker.Config{
 			ExposedPorts: map[docker.Port]struct{}{},
+			// tag with run ID so that the reaper can remove containers left by crashed tests
+			Labels: runLabels(),
 		},
 		HostConfig: &docker.HostConfig{
 			PortBindings: map[docker.Port][]docker.PortBinding{},
@@ -256,7 +249,9 @@ func waitReachable(ctx context.Context, hostport string, maxWait time.Duration)
 		select {
 		case <-time.After(100 * time.Millisecond):
 			c, err := net.DialTimeout("tcp", hostport, 3*time.Second)
-			fmt.Printf("%s %v\n", hostport, err)
+			if err != nil {
+				logf(ctx, LevelDebug, "attempt to dial %s failed, err %v", hostport, err)
+			}
 			if err == nil {
 				c.Close()
 				return nil
@@ -268,17 +263,19 @@ func waitReachable(ctx context.Context, hostport string, maxWait time.Duration)
 }
 
 // waitStarted waits for a container to start for the maxWait time.
-func waitStarted(client *docker.Client, id string, maxWait time.Duration) error {
-	done := time.Now().Add(maxWait)
-	for time.Now().Before(done) {
-		c, err := client.InspectContainer(id)
+func waitStarted(ctx context.Context, client *docker.Client, id string, maxWait time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+	for {
+		c, err := client.InspectContainerWithContext(id, ctx)
 		if err != nil {
-			break
+			return fmt.Errorf("cannot start container %s for %v: %v", id, maxWait, err)
 		}
 		if c.State.Running {
 			return nil
 		}
-		time.Sleep(100 * time.Millisecond)
+		if err := sleepContext(ctx, 100*time.Millisecond); err != nil {
+			return fmt.Errorf("cannot start container %s for %v: %v", id, maxWait, err)
+		}
 	}
-	return fmt.Errorf("cannot start container %s for %v", id, maxWait)
 }
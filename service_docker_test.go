@@ -15,6 +15,10 @@ func TestSrvDockerSuite(t *testing.T) {
 			return
 		}
 	*/
+	if _, err := newServiceLauncher(BackendDocker).docker(); err != nil {
+		t.Skipf("skip service docker test: %v", err)
+		return
+	}
 	suite.Run(t, new(srvDockerSuite))
 }
 
@@ -56,6 +60,18 @@ func (s *srvDockerSuite) TestAll() {
 	}
 }
 
+func (s *srvDockerSuite) TestMore() {
+	sl := NewServiceDocker()
+	defer sl.StopAll()
+
+	for _, t := range []ServiceType{ZooKeeper, Consul, Disque, HBase} {
+		ipport, _, err := sl.Start(t)
+		s.NoError(err, "fail to start %v", t)
+		_, err = net.DialTimeout("tcp", ipport, time.Second)
+		s.NoError(err, "fail to dial %v", t)
+	}
+}
+
 func (s *srvDockerSuite) TestDoubleStop() {
 	sl := NewServiceDocker()
 	defer sl.StopAll()
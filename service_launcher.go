@@ -1,7 +1,9 @@
 package test
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"sync"
 	"sync/atomic"
 
@@ -11,9 +13,13 @@ import (
 // supported service types
 const (
 	ZooKeeper     ServiceType = "zookeeper"
+	ZkEnsemble    ServiceType = "zookeeper-ensemble"
 	HBase         ServiceType = "hbase"
 	Redis         ServiceType = "redis"
+	RedisCluster  ServiceType = "redis-cluster"
+	RedisSentinel ServiceType = "redis-sentinel"
 	Etcd          ServiceType = "etcd"
+	EtcdCluster   ServiceType = "etcd-cluster"
 	Gnatsd        ServiceType = "gnatsd"
 	Disque        ServiceType = "disque"
 	Consul        ServiceType = "consul"
@@ -29,6 +35,9 @@ const (
 )
 
 var (
+	// instanceSeq numbers service instances of the process
+	instanceSeq int64
+
 	srvFactories = struct {
 		sync.RWMutex
 		facs map[ServiceType]ServiceFactory
@@ -46,10 +55,35 @@ type ServiceLauncher interface {
 	// Start creates and starts an instance of supported service by the give type. It
 	// returns its listening ip:port and the corresponding stop function.
 	Start(ServiceType, ...ServiceOption) (ipport string, stopFunc func() error, err error)
+	// StartContext is like Start but aborts the boot once ctx is done and tears
+	// down whatever was half-started.
+	StartContext(context.Context, ServiceType, ...ServiceOption) (ipport string, stopFunc func() error, err error)
+	// StartDescriptor is like StartContext but returns the descriptor of all endpoints
+	// of the service, e.g. the transport port of elastic search.
+	StartDescriptor(context.Context, ServiceType, ...ServiceOption) (desc *ServiceDescriptor, stopFunc func() error, err error)
+	// StartAll starts services of the requests concurrently and returns their ip:port
+	// in order of requests. If any of them fails, the started ones are stopped.
+	StartAll(context.Context, ...ServiceRequest) (ipports []string, err error)
 	// StopAll stop all created services
 	StopAll() error
-	// Get retruns service, return nil if no service for the given ipport
+	// StopAllContext is like StopAll but bounded by ctx
+	StopAllContext(context.Context) error
+	// Get retruns service, return nil if no service for the given ipport. Prefer typed
+	// accessors like GetRedis, which return handles with ready-made clients.
 	Get(ipport string) interface{}
+	// Describe returns the descriptor of the service at ipport
+	Describe(ipport string) (*ServiceDescriptor, error)
+	// Reset drops data of the service at ipport without restarting it
+	Reset(ctx context.Context, ipport string) error
+	// ResetAll resets all created services
+	ResetAll(context.Context) error
+	// Snapshot saves data of the service at ipport as the named snapshot
+	Snapshot(ctx context.Context, ipport, name string) error
+	// Restore replaces data of the service at ipport with the named snapshot
+	Restore(ctx context.Context, ipport, name string) error
+	// Logs returns logs of the service at ipport. If follow is set, the stream keeps
+	// delivering new logs until ctx is done or it's closed.
+	Logs(ctx context.Context, ipport string, follow bool) (io.ReadCloser, error)
 }
 
 // Service represents a service
@@ -62,6 +96,36 @@ type Service interface {
 	StartDocker(*docker.Client) (string, error)
 	// Stop stops the service via docker
 	StopDocker(*docker.Client) error
+	// StartContext is like Start but gives up and cleans up once ctx is done
+	StartContext(context.Context) (string, error)
+	// StopContext is like Stop but bounded by ctx
+	StopContext(context.Context) error
+	// StartDockerContext is like StartDocker but gives up and cleans up once ctx is done
+	StartDockerContext(context.Context, *docker.Client) (string, error)
+	// StopDockerContext is like StopDocker but bounded by ctx
+	StopDockerContext(context.Context, *docker.Client) error
+}
+
+// Resettable is implemented by services which can drop their data without restart
+type Resettable interface {
+	// Reset drops data of the service listening on ipport
+	Reset(ctx context.Context, ipport string) error
+}
+
+// Snapshotter is implemented by services which can save their data and restore it
+// later, possibly into another instance of the same type. Snapshot names consist of
+// lower case letters, digits, '_', '.' and '-'.
+type Snapshotter interface {
+	// Snapshot saves data of the service listening on ipport as the named snapshot
+	Snapshot(ctx context.Context, ipport, name string) error
+	// Restore replaces data of the service listening on ipport with the named snapshot
+	Restore(ctx context.Context, ipport, name string) error
+}
+
+// ServiceRequest describes a service to start by StartAll
+type ServiceRequest struct {
+	Type    ServiceType
+	Options []ServiceOption
 }
 
 // ServiceFactory represents service factory
@@ -78,26 +142,46 @@ func RegisterService(t ServiceType, f ServiceFactory) {
 	srvFactories.facs[t] = f
 }
 
-// NewServiceLauncher returns an instance of ServiceLauncher
-func NewServiceLauncher() ServiceLauncher {
-	return &serviceLauncherImpl{
-		services: map[string]Service{},
+// NewServiceLauncher returns an instance of ServiceLauncher. Services are launched
+// with the backend named by env CSIGO_TEST_BACKEND, natively if it's not set.
+func NewServiceLauncher(options ...LauncherOption) ServiceLauncher {
+	return newServiceLauncher(backendFromEnv(BackendNative), options...)
+}
+
+func newServiceLauncher(backend Backend, options ...LauncherOption) *serviceLauncherImpl {
+	s := &serviceLauncherImpl{
+		services: map[string]*stateChkService{},
+		backend:  backend,
+		logger:   DefaultLogger,
+	}
+	for _, opt := range options {
+		opt(s)
 	}
+	return s
 }
 
 // serviceLauncherImpl implements ServiceLauncher
 type serviceLauncherImpl struct {
 	// service stores created services
-	services map[string]Service
+	services map[string]*stateChkService
+	// backend is the default backend of services
+	backend Backend
+	// dockerclient is created on first use of docker backend
+	dockerclient *docker.Client
+	// logger is the default logger of services
+	logger Logger
 	// mutx to protected services
 	sync.Mutex
 }
 
 // Create returns an instance of supported service by the give type
 func (s *serviceLauncherImpl) Start(t ServiceType, options ...ServiceOption) (string, func() error, error) {
-	s.Lock()
-	defer s.Unlock()
+	return s.StartContext(context.Background(), t, options...)
+}
 
+// StartContext returns an instance of supported service by the give type. The
+// launcher is only locked around its registry, so services boot concurrently.
+func (s *serviceLauncherImpl) StartContext(ctx context.Context, t ServiceType, options ...ServiceOption) (string, func() error, error) {
 	srvFactories.RLock()
 	fac, ok := srvFactories.facs[t]
 	srvFactories.RUnlock()
@@ -108,6 +192,7 @@ func (s *serviceLauncherImpl) Start(t ServiceType, options ...ServiceOption) (st
 	srv := &stateChkService{
 		state:   stateNew,
 		Service: fac(),
+		t:       t,
 	}
 	// apply option functions
 	for _, opt := range options {
@@ -115,26 +200,148 @@ func (s *serviceLauncherImpl) Start(t ServiceType, options ...ServiceOption) (st
 			return "", nil, fmt.Errorf("failed to apply option %v", opt)
 		}
 	}
+	srv.scope = &logScope{
+		logger:   s.logger,
+		service:  t,
+		instance: fmt.Sprintf("%s-%d", t, atomic.AddInt64(&instanceSeq, 1)),
+	}
+	if bs, ok := srv.Service.(baseService); ok && bs.base().logger != nil {
+		srv.scope.logger = bs.base().logger
+	}
+	// pick up backend
+	cl, err := s.resolveBackend(srv.Service)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to start service %v, err %w", t, err)
+	}
+	srv.cl = cl
 	// start service
-	ipport, err := srv.Start()
+	ipport, err := srv.StartContext(ctx)
 	if err != nil {
 		return "", nil, fmt.Errorf("unable to start service %v, err %v", t, err)
 	}
-	// store raw service
-	s.services[ipport] = srv.Service
+	if srv.stopTee, err = teeLogs(srv.Service, cl); err != nil {
+		srv.Stop()
+		return "", nil, fmt.Errorf("unable to tee logs of service %v, err %v", t, err)
+	}
+	// store guarded service
+	s.Lock()
+	s.services[ipport] = srv
+	s.Unlock()
 	return ipport, srv.Stop, nil
 }
 
+// StartDescriptor starts the service and returns its descriptor
+func (s *serviceLauncherImpl) StartDescriptor(ctx context.Context, t ServiceType, options ...ServiceOption) (*ServiceDescriptor, func() error, error) {
+	ipport, stop, err := s.StartContext(ctx, t, options...)
+	if err != nil {
+		return nil, nil, err
+	}
+	desc, err := s.Describe(ipport)
+	if err != nil {
+		stop()
+		return nil, nil, err
+	}
+	return desc, stop, nil
+}
+
+// StartAll starts services of the requests concurrently
+func (s *serviceLauncherImpl) StartAll(ctx context.Context, reqs ...ServiceRequest) ([]string, error) {
+	var wg sync.WaitGroup
+	ipports := make([]string, len(reqs))
+	stops := make([]func() error, len(reqs))
+	errs := make([]error, len(reqs))
+	for i, req := range reqs {
+		wg.Add(1)
+		go func(i int, req ServiceRequest) {
+			defer wg.Done()
+			ipports[i], stops[i], errs[i] = s.StartContext(ctx, req.Type, req.Options...)
+		}(i, req)
+	}
+	wg.Wait()
+
+	if err := CombineError(errs...); err != nil {
+		// roll back services already started
+		for i, stop := range stops {
+			if stop != nil {
+				stop()
+				s.Lock()
+				delete(s.services, ipports[i])
+				s.Unlock()
+			}
+		}
+		return nil, err
+	}
+	return ipports, nil
+}
+
+// resolveBackend decides the backend of the service. It returns the docker client
+// if the service should run via docker, otherwise nil.
+func (s *serviceLauncherImpl) resolveBackend(srv Service) (*docker.Client, error) {
+	backend := s.backend
+	if bs, ok := srv.(baseService); ok && bs.base().backend != "" {
+		backend = bs.base().backend
+	}
+	switch backend {
+	case BackendNative:
+		if err := checkNative(srv); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBackendUnavailable, err)
+		}
+		return nil, nil
+	case BackendDocker:
+		return s.docker()
+	case BackendAuto:
+		err := checkNative(srv)
+		if err == nil {
+			return nil, nil
+		}
+		cl, dockerErr := s.docker()
+		if dockerErr != nil {
+			return nil, fmt.Errorf("%w: neither native (%v) nor docker (%v) is available",
+				ErrBackendUnavailable, err, dockerErr)
+		}
+		return cl, nil
+	}
+	return nil, fmt.Errorf("unsupported backend %q", backend)
+}
+
+// docker returns the docker client, creating it on first call
+func (s *serviceLauncherImpl) docker() (*docker.Client, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.dockerclient != nil {
+		return s.dockerclient, nil
+	}
+	cl, err := newDockerClient()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBackendUnavailable, err)
+	}
+	if err := cl.Ping(); err != nil {
+		return nil, fmt.Errorf("%w: docker isn't running, err %v", ErrBackendUnavailable, err)
+	}
+	s.dockerclient = cl
+	return cl, nil
+}
+
 // StopAll stop all created services
 func (s *serviceLauncherImpl) StopAll() error {
+	return s.StopAllContext(context.Background())
+}
+
+// StopAllContext stop all created services, services already stopped by their stop
+// functions are skipped
+func (s *serviceLauncherImpl) StopAllContext(ctx context.Context) error {
 	s.Lock()
 	defer s.Unlock()
 
 	errs := []error{}
-	for _, s := range s.services {
-		errs = append(errs, s.Stop())
+	for _, srv := range s.services {
+		if atomic.LoadInt32(&srv.state) == stateStopped {
+			continue
+		}
+		errs = append(errs, srv.StopContext(ctx))
 	}
-	s.services = map[string]Service{}
+	s.services = map[string]*stateChkService{}
 	return CombineError(errs...)
 }
 
@@ -142,38 +349,187 @@ func (s *serviceLauncherImpl) StopAll() error {
 func (s *serviceLauncherImpl) Get(ipport string) interface{} {
 	s.Lock()
 	defer s.Unlock()
-	return s.services[ipport]
+	srv, ok := s.services[ipport]
+	if !ok {
+		return nil
+	}
+	// return raw service
+	return srv.Service
+}
+
+// Describe returns the descriptor of the service at ipport
+func (s *serviceLauncherImpl) Describe(ipport string) (*ServiceDescriptor, error) {
+	s.Lock()
+	srv, ok := s.services[ipport]
+	s.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no service at %s", ipport)
+	}
+	return describe(srv.t, srv.Service, ipport)
+}
+
+// Reset drops data of the service at ipport
+func (s *serviceLauncherImpl) Reset(ctx context.Context, ipport string) error {
+	s.Lock()
+	srv, ok := s.services[ipport]
+	s.Unlock()
+	if !ok {
+		return fmt.Errorf("no service at %s", ipport)
+	}
+	return srv.Reset(ctx, ipport)
+}
+
+// ResetAll resets all created services
+func (s *serviceLauncherImpl) ResetAll(ctx context.Context) error {
+	s.Lock()
+	services := make(map[string]*stateChkService, len(s.services))
+	for ipport, srv := range s.services {
+		services[ipport] = srv
+	}
+	s.Unlock()
+
+	errs := []error{}
+	for ipport, srv := range services {
+		if atomic.LoadInt32(&srv.state) == stateStopped {
+			continue
+		}
+		errs = append(errs, srv.Reset(ctx, ipport))
+	}
+	return CombineError(errs...)
+}
+
+// Snapshot saves data of the service at ipport as the named snapshot
+func (s *serviceLauncherImpl) Snapshot(ctx context.Context, ipport, name string) error {
+	ss, err := s.snapshotter(ipport)
+	if err != nil {
+		return err
+	}
+	return ss.Snapshot(ctx, ipport, name)
+}
+
+// Restore replaces data of the service at ipport with the named snapshot
+func (s *serviceLauncherImpl) Restore(ctx context.Context, ipport, name string) error {
+	ss, err := s.snapshotter(ipport)
+	if err != nil {
+		return err
+	}
+	return ss.Restore(ctx, ipport, name)
+}
+
+// snapshotter returns the ready service at ipport if it supports snapshots
+func (s *serviceLauncherImpl) snapshotter(ipport string) (Snapshotter, error) {
+	s.Lock()
+	srv, ok := s.services[ipport]
+	s.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no service at %s", ipport)
+	}
+	if atomic.LoadInt32(&srv.state) != stateReady {
+		return nil, fmt.Errorf("state is not ready")
+	}
+	ss, ok := srv.Service.(Snapshotter)
+	if !ok {
+		return nil, fmt.Errorf("service %T at %s doesn't support snapshots", srv.Service, ipport)
+	}
+	return ss, nil
+}
+
+// Logs returns logs of the service at ipport
+func (s *serviceLauncherImpl) Logs(ctx context.Context, ipport string, follow bool) (io.ReadCloser, error) {
+	s.Lock()
+	srv, ok := s.services[ipport]
+	s.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no service at %s", ipport)
+	}
+	return openLogs(ctx, srv.Service, srv.cl, follow)
 }
 
 // stateChkService helps to guard status of the embed service
 // state machine: new -> starting -> ready -> stopped
 type stateChkService struct {
 	Service
+	t     ServiceType
 	state int32
 	cl    *docker.Client
+	// stopTee stops teeing logs, nil if logs aren't teed
+	stopTee func()
+	// scope is the logger and fields of logs of the service
+	scope *logScope
 }
 
 func (s *stateChkService) Start() (ipport string, err error) {
+	return s.StartContext(context.Background())
+}
+
+func (s *stateChkService) StartContext(ctx context.Context) (ipport string, err error) {
 	if !atomic.CompareAndSwapInt32(&s.state, stateNew, stateStarting) {
 		return "", fmt.Errorf("state is not ready")
 	}
+	ctx = s.logContext(ctx)
 	if s.cl != nil {
-		ipport, err = s.Service.StartDocker(s.cl)
+		logf(ctx, LevelInfo, "starting via docker")
+		ipport, err = s.Service.StartDockerContext(ctx, s.cl)
 	} else {
-		ipport, err = s.Service.Start()
+		logf(ctx, LevelInfo, "starting natively")
+		ipport, err = s.Service.StartContext(ctx)
 	}
-	if err == nil {
-		atomic.StoreInt32(&s.state, stateReady)
+	if err != nil {
+		logf(ctx, LevelError, "fail to start, err:%v", err)
+		return ipport, err
 	}
-	return ipport, err
+	logf(ctx, LevelInfo, "started at %s", ipport)
+	atomic.StoreInt32(&s.state, stateReady)
+	return ipport, nil
 }
 
 func (s *stateChkService) Stop() error {
+	return s.StopContext(context.Background())
+}
+
+func (s *stateChkService) StopContext(ctx context.Context) (err error) {
 	if !atomic.CompareAndSwapInt32(&s.state, stateReady, stateStopped) {
 		return fmt.Errorf("state is not ready")
 	}
+	if s.stopTee != nil {
+		// logs written while stopping are still teed
+		defer s.stopTee()
+	}
+	ctx = s.logContext(ctx)
+	logf(ctx, LevelInfo, "stopping")
+	if bs, ok := s.Service.(baseService); ok {
+		if err := bs.base().closeHandle(); err != nil {
+			logf(ctx, LevelWarn, "fail to close client, err:%v", err)
+		}
+	}
 	if s.cl != nil {
-		return s.Service.StopDocker(s.cl)
+		err = s.Service.StopDockerContext(ctx, s.cl)
+	} else {
+		err = s.Service.StopContext(ctx)
+	}
+	if err != nil {
+		logf(ctx, LevelError, "fail to stop, err:%v", err)
+		return err
+	}
+	logf(ctx, LevelInfo, "stopped")
+	return nil
+}
+
+// logContext returns ctx carrying the log scope of the service
+func (s *stateChkService) logContext(ctx context.Context) context.Context {
+	if s.scope == nil {
+		return ctx
+	}
+	return withLogScope(ctx, s.scope)
+}
+
+func (s *stateChkService) Reset(ctx context.Context, ipport string) error {
+	if atomic.LoadInt32(&s.state) != stateReady {
+		return fmt.Errorf("state is not ready")
+	}
+	rs, ok := s.Service.(Resettable)
+	if !ok {
+		return fmt.Errorf("service %T at %s isn't resettable", s.Service, ipport)
 	}
-	return s.Service.Stop()
+	return rs.Reset(ctx, ipport)
 }
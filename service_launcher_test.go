@@ -1,6 +1,7 @@
 package test
 
 import (
+	"context"
 	"net"
 	"testing"
 	"time"
@@ -8,6 +9,18 @@ import (
 	"github.com/stretchr/testify/suite"
 )
 
+const (
+	// noResetType is a service type which can't reset
+	noResetType ServiceType = "noreset"
+)
+
+func init() {
+	RegisterService(noResetType, func() Service {
+		// only methods of Service are promoted, which hides Reset of gnatsd
+		return &struct{ Service }{&gnatsdService{}}
+	})
+}
+
 func TestSrvLauncherSuite(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skip service launcher test")
@@ -22,6 +35,7 @@ type srvLauncherSuite struct {
 
 func (s *srvLauncherSuite) TestAll() {
 	sl := NewServiceLauncher()
+	defer sl.StopAll()
 
 	var err error
 	var ipports = make([]string, 5)
@@ -75,3 +89,76 @@ func (s *srvLauncherSuite) TestGet() {
 	_, ok := sl.Get(port).(*gnatsdService)
 	s.True(ok, "service is not gnatsd service")
 }
+
+func (s *srvLauncherSuite) TestStartContextCanceled() {
+	sl := NewServiceLauncher()
+	defer sl.StopAll()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := sl.StartContext(ctx, Gnatsd)
+	s.Error(err, "canceled context should abort start")
+}
+
+func (s *srvLauncherSuite) TestStartAll() {
+	sl := NewServiceLauncher()
+	defer sl.StopAll()
+
+	ipports, err := sl.StartAll(context.Background(),
+		ServiceRequest{Type: Gnatsd},
+		ServiceRequest{Type: Gnatsd},
+		ServiceRequest{Type: Gnatsd})
+	s.NoError(err)
+	s.Len(ipports, 3)
+	for _, ipport := range ipports {
+		_, ok := sl.Get(ipport).(*gnatsdService)
+		s.True(ok, "service is not gnatsd service")
+	}
+
+	// a failed request rolls back the others
+	calls := make(chan string, 1)
+	_, err = sl.StartAll(context.Background(),
+		ServiceRequest{Type: Gnatsd, Options: []ServiceOption{
+			ReadinessProbes(ProbeFunc(func(ctx context.Context, ipport string) error {
+				select {
+				case calls <- ipport:
+				default:
+				}
+				return nil
+			})),
+		}},
+		ServiceRequest{Type: unavailable, Options: []ServiceOption{ServiceBackend(BackendNative)}})
+	s.Error(err)
+	rolledBack := <-calls
+	_, err = net.DialTimeout("tcp", rolledBack, time.Second)
+	s.Error(err, "started service should be stopped")
+	s.Nil(sl.Get(rolledBack), "stopped service should be removed")
+}
+
+func (s *srvLauncherSuite) TestReset() {
+	sl := NewServiceLauncher()
+	defer sl.StopAll()
+
+	ipport, _, err := sl.Start(Gnatsd)
+	s.NoError(err)
+	s.NoError(sl.Reset(context.Background(), ipport))
+	s.NoError(sl.ResetAll(context.Background()))
+	s.Error(sl.Reset(context.Background(), "127.0.0.1:1"), "no such service")
+
+	// services which can't reset fail ResetAll
+	ipport, _, err = sl.Start(noResetType)
+	s.NoError(err)
+	s.Error(sl.Reset(context.Background(), ipport))
+	s.Error(sl.ResetAll(context.Background()))
+}
+
+func (s *srvLauncherSuite) TestSnapshotUnsupported() {
+	sl := NewServiceLauncher()
+	defer sl.StopAll()
+
+	ipport, _, err := sl.Start(Gnatsd)
+	s.NoError(err)
+	s.Error(sl.Snapshot(context.Background(), ipport, "fixture"))
+	s.Error(sl.Restore(context.Background(), ipport, "fixture"))
+	s.Error(sl.Snapshot(context.Background(), "127.0.0.1:1", "fixture"), "no such service")
+}
@@ -0,0 +1,79 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var (
+	// SnapshotDir stores snapshots of services, so that a fixture built once can be
+	// restored by later tests and test binaries
+	SnapshotDir = filepath.Join(os.TempDir(), "csigo-test-snapshots")
+
+	// snapshotNameRegexp defines valid snapshot names, which are accepted as file
+	// names and by services keeping snapshots themselves
+	snapshotNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+)
+
+// checkSnapshotName returns error if name isn't a valid snapshot name
+func checkSnapshotName(name string) error {
+	if !snapshotNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid snapshot name %q, expect %s", name, snapshotNameRegexp)
+	}
+	return nil
+}
+
+// snapshotDir returns the dir storing snapshots of the service type
+func snapshotDir(t ServiceType) (string, error) {
+	dir := filepath.Join(SnapshotDir, string(t))
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", fmt.Errorf("fail to prepare snapshot dir, err:%v", err)
+	}
+	// containers may run as other users
+	return dir, os.Chmod(dir, 0777)
+}
+
+// writeSnapshot saves v as the named snapshot of the service type
+func writeSnapshot(t ServiceType, name string, v interface{}) error {
+	if err := checkSnapshotName(name); err != nil {
+		return err
+	}
+	dir, err := snapshotDir(t)
+	if err != nil {
+		return err
+	}
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// write to a temp file first so that readers never see partial snapshots
+	tmp, err := ioutil.TempFile(dir, name+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name+".json"))
+}
+
+// readSnapshot loads the named snapshot of the service type into v
+func readSnapshot(t ServiceType, name string, v interface{}) error {
+	if err := checkSnapshotName(name); err != nil {
+		return err
+	}
+	bs, err := ioutil.ReadFile(filepath.Join(SnapshotDir, string(t), name+".json"))
+	if err != nil {
+		return fmt.Errorf("fail to read snapshot %s of %v, err:%v", name, t, err)
+	}
+	return json.Unmarshal(bs, v)
+}
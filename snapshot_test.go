@@ -0,0 +1,31 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(old string) {
+		SnapshotDir = old
+	}(SnapshotDir)
+	SnapshotDir = dir
+
+	assert.NoError(t, writeSnapshot(Redis, "fixture-1", []string{"a", "b"}))
+	v := []string{}
+	assert.NoError(t, readSnapshot(Redis, "fixture-1", &v))
+	assert.Equal(t, []string{"a", "b"}, v)
+
+	// snapshots are kept per service type
+	assert.Error(t, readSnapshot(Etcd, "fixture-1", &v))
+
+	for _, name := range []string{"", "Upper", "../escape", "a/b", ".hidden"} {
+		assert.Error(t, writeSnapshot(Redis, name, v), name)
+	}
+}
@@ -0,0 +1,246 @@
+// Command testenv launches services used by tests for manual debugging.
+//
+// Usage:
+//
+//	testenv up [-format text|json|env] [-backend BACKEND] [-spec FILE] [[NAME=]TYPE ...]
+//	testenv down [-timeout DURATION] RUN_ID
+//	testenv broker [-socket FILE] [-idle DURATION]
+//
+// up starts the services of the spec file and the given types, prints their
+// endpoints and stays in the foreground until interrupted, then stops them. down
+// tears down the environment of a run, e.g. one left by a killed up. broker shares
+// services with test binaries run with env CSIGO_TEST_BROKER set to its socket.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+
+	"github.com/csigo/test"
+	"github.com/csigo/test/internal/proc"
+)
+
+var (
+	// stateDir stores states of running environments keyed by run ID
+	stateDir = filepath.Join(os.TempDir(), "csigo-test-envs")
+)
+
+// state records a running environment
+type state struct {
+	RunID     string            `json:"run_id"`
+	Pid       int               `json:"pid"`
+	Endpoints map[string]string `json:"endpoints"`
+}
+
+func stateFile(runID string) string {
+	return filepath.Join(stateDir, runID+".json")
+}
+
+func up(args []string) error {
+	fs := flag.NewFlagSet("up", flag.ExitOnError)
+	format := fs.String("format", "text", "output format of endpoints, text, json or env")
+	backend := fs.String("backend", "", "backend of services, native, docker or auto")
+	specFile := fs.String("spec", "", "yaml or json environment spec")
+	fs.Parse(args)
+
+	spec := &test.EnvSpec{Services: map[string]*test.ServiceSpec{}}
+	if *specFile != "" {
+		var err error
+		if spec, err = test.LoadEnvSpec(*specFile); err != nil {
+			return err
+		}
+	}
+	for _, arg := range fs.Args() {
+		name, typ := arg, arg
+		if i := strings.Index(arg, "="); i >= 0 {
+			name, typ = arg[:i], arg[i+1:]
+		}
+		if _, ok := spec.Services[name]; ok {
+			return fmt.Errorf("duplicated service %s", name)
+		}
+		spec.Services[name] = &test.ServiceSpec{Type: test.ServiceType(typ)}
+	}
+	if len(spec.Services) == 0 {
+		return fmt.Errorf("no service to start")
+	}
+	if *backend != "" {
+		spec.Backend = test.Backend(*backend)
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	env, err := test.StartEnv(ctx, spec)
+	if err != nil {
+		return err
+	}
+	defer env.Stop()
+
+	st := &state{RunID: test.RunID(), Pid: os.Getpid(), Endpoints: env.Endpoints()}
+	if err := writeState(st); err != nil {
+		return err
+	}
+	defer os.Remove(stateFile(st.RunID))
+	if err := printState(st, *format); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "environment %s is up, press Ctrl-C to stop\n", st.RunID)
+	<-ctx.Done()
+	fmt.Fprintln(os.Stderr, "stopping environment")
+	return env.Stop()
+}
+
+func writeState(st *state) error {
+	if err := os.MkdirAll(stateDir, 0777); err != nil {
+		return err
+	}
+	bs, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(stateFile(st.RunID), bs, 0666)
+}
+
+func printState(st *state, format string) error {
+	names := make([]string, 0, len(st.Endpoints))
+	for name := range st.Endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	switch format {
+	case "text":
+		fmt.Printf("run_id\t%s\n", st.RunID)
+		for _, name := range names {
+			fmt.Printf("%s\t%s\n", name, st.Endpoints[name])
+		}
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(st)
+	case "env":
+		fmt.Printf("export CSIGO_TEST_RUN_ID=%s\n", st.RunID)
+		for _, name := range names {
+			fmt.Printf("export %s=%s\n", envName(name), st.Endpoints[name])
+		}
+	default:
+		return fmt.Errorf("unsupported format %q", format)
+	}
+	return nil
+}
+
+// envName converts service name to name of environment variable, e.g. zk-1 to
+// CSIGO_TEST_ZK_1
+func envName(name string) string {
+	return "CSIGO_TEST_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func down(args []string) error {
+	fs := flag.NewFlagSet("down", flag.ExitOnError)
+	timeout := fs.Duration("timeout", time.Minute, "time to wait for up to stop services")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: testenv down RUN_ID")
+	}
+	runID := fs.Arg(0)
+
+	// ask up to stop its services gracefully, unless its pid is recycled by another
+	// process started after up wrote the state
+	if info, err := os.Stat(stateFile(runID)); err == nil {
+		st := state{}
+		bs, err := ioutil.ReadFile(stateFile(runID))
+		if err == nil {
+			err = json.Unmarshal(bs, &st)
+		}
+		if err == nil && proc.StartedBefore(st.Pid, info.ModTime()) &&
+			syscall.Kill(st.Pid, syscall.SIGTERM) == nil {
+			for deadline := time.Now().Add(*timeout); time.Now().Before(deadline); {
+				if syscall.Kill(st.Pid, 0) != nil {
+					break
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		os.Remove(stateFile(runID))
+	}
+
+	// reap whatever is left
+	opts := test.ReapOptions{RunID: runID}
+	cl, err := docker.NewClient("unix:///var/run/docker.sock")
+	if err == nil && cl.Ping() == nil {
+		opts.Docker = cl
+	}
+	reaped, err := test.Reap(opts)
+	for _, r := range reaped {
+		fmt.Printf("%s\t%s\t%s\n", r.Kind, r.ID, r.Service)
+	}
+	return err
+}
+
+func broker(args []string) error {
+	fs := flag.NewFlagSet("broker", flag.ExitOnError)
+	socket := fs.String("socket", test.DefaultBrokerSocket, "unix socket to listen on")
+	idle := fs.Duration("idle", 5*time.Minute, "time to keep services without leases")
+	fs.Parse(args)
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	fmt.Fprintf(os.Stderr, "broker is listening on %s, run tests with %s=%s\n", *socket, test.EnvBroker, *socket)
+	return test.NewBroker(*socket, *idle).Serve(ctx)
+}
+
+// signalContext returns a context canceled on Ctrl-C or SIGTERM
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: testenv up|down|broker [flags] [args]")
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "up":
+		err = up(os.Args[2:])
+	case "down":
+		err = down(os.Args[2:])
+	case "broker":
+		err = broker(os.Args[2:])
+	default:
+		err = fmt.Errorf("unknown command %q", os.Args[1])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,67 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// logFiler is implemented by services writing logs into files
+type logFiler interface {
+	logFiles() []string
+}
+
+// StartForTest starts a service of the given type for the test and returns its
+// listening ip:port. The backend is picked by env CSIGO_TEST_BACKEND as
+// NewServiceLauncher does.
+//
+// The service is stopped via t.Cleanup once the test and its subtests complete, and
+// its logs are attached to the test output if the test fails. Lifecycle events of
+// the service are logged via t.Log. The test is skipped if
+// the backend isn't available, e.g. executables are missing or docker isn't running.
+func StartForTest(t testing.TB, typ ServiceType, options ...ServiceOption) string {
+	t.Helper()
+
+	sl := newServiceLauncher(backendFromEnv(BackendNative), LauncherLogger(TestLogger(t, LevelInfo)))
+	ipport, stop, err := sl.Start(typ, options...)
+	if errors.Is(err, ErrBackendUnavailable) {
+		t.Skipf("skip test as %v is unavailable: %v", typ, err)
+	}
+	if err != nil {
+		t.Fatalf("fail to start %v, err:%v", typ, err)
+	}
+	sl.Lock()
+	srv := sl.services[ipport]
+	sl.Unlock()
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("logs of %v at %v:\n%s", typ, ipport, serviceLogs(srv, sl.dockerclient))
+		}
+		if err := stop(); err != nil {
+			t.Errorf("fail to stop %v at %v, err:%v", typ, ipport, err)
+		}
+	})
+	return ipport
+}
+
+// serviceLogs returns logs of the service, either from its container or from its
+// log files
+func serviceLogs(srv *stateChkService, cl *docker.Client) string {
+	r, err := openLogs(context.Background(), srv.Service, cl, false)
+	if err != nil {
+		return err.Error()
+	}
+	defer r.Close()
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Sprintf("%s\nfail to read logs, err:%v", bs, err)
+	}
+	if len(bs) == 0 {
+		return errNoLogs.Error()
+	}
+	return string(bs)
+}
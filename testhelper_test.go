@@ -0,0 +1,67 @@
+package test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	// unavailable is a service type which can't start on any backend
+	unavailable ServiceType = "unavailable"
+)
+
+func init() {
+	RegisterService(unavailable, func() Service {
+		return &nativeLessService{}
+	})
+}
+
+func TestStartForTest(t *testing.T) {
+	ipport := ""
+	t.Run("start", func(t *testing.T) {
+		ipport = StartForTest(t, Gnatsd)
+		conn, err := net.DialTimeout("tcp", ipport, time.Second)
+		assert.NoError(t, err)
+		conn.Close()
+	})
+	_, err := net.DialTimeout("tcp", ipport, time.Second)
+	assert.Error(t, err, "service should be stopped on cleanup")
+
+	skipped := false
+	t.Run("skip", func(t *testing.T) {
+		defer func() {
+			skipped = t.Skipped()
+		}()
+		StartForTest(t, unavailable, ServiceBackend(BackendNative))
+	})
+	assert.True(t, skipped, "test should be skipped if backend is unavailable")
+}
+
+// logFileService is a service writing logs into a file
+type logFileService struct {
+	gnatsdService
+	file string
+}
+
+func (s *logFileService) logFiles() []string {
+	return []string{s.file}
+}
+
+func TestServiceLogs(t *testing.T) {
+	srv := &stateChkService{Service: &nativeLessService{}}
+	assert.Equal(t, "no logs available", serviceLogs(srv, nil))
+
+	f, err := ioutil.TempFile("", "log-test")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("server is ready")
+	f.Close()
+
+	srv = &stateChkService{Service: &logFileService{file: f.Name()}}
+	assert.Contains(t, serviceLogs(srv, nil), "server is ready")
+}
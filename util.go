@@ -1,14 +1,18 @@
 package test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"text/template"
 	"time"
 )
@@ -17,27 +21,65 @@ const (
 	// define min and max port range
 	maxPort = 65535
 	minPort = 10000
+	// execLogFileName is where ExecContext appends outputs in the work dir
+	execLogFileName = "exec.log"
 )
 
 var (
 	curPort = int32(maxPort + 1)
 )
 
-// BookPorts books free portsx
+// BookPorts books free portsx. Booked ports are leased across processes until they
+// are released by ReleasePorts or the booking process exits.
 func BookPorts(num int, host ...string) ([]int, error) {
 	result := make([]int, 0, num)
-	for len(result) < num {
+	for tries := 0; len(result) < num; tries++ {
+		if tries > maxPort-minPort {
+			ReleasePorts(result...)
+			return nil, errors.New("running out of available ports")
+		}
 		newPort := atomic.AddInt32(&curPort, -1)
 		if newPort < minPort {
-			return nil, errors.New("running out of available ports")
+			// wrap around as released ports can be booked again
+			atomic.CompareAndSwapInt32(&curPort, newPort, maxPort+1)
+			continue
 		}
-		if portAvailable(newPort, host...) {
+		if !portAvailable(newPort, host...) {
+			continue
+		}
+		if leasePort(int(newPort)) {
 			result = append(result, int(newPort))
 		}
 	}
 	return result, nil
 }
 
+// bookPortPair books a free port together with the one offset higher, e.g. the
+// cluster bus port of redis nodes. It returns the lower port.
+func bookPortPair(offset int) (int, error) {
+	for tries := 0; tries <= maxPort-minPort; tries++ {
+		newPort := atomic.AddInt32(&curPort, -1)
+		if newPort < minPort {
+			// wrap around as released ports can be booked again
+			atomic.CompareAndSwapInt32(&curPort, newPort, maxPort+1)
+			continue
+		}
+		port, pair := int(newPort), int(newPort)+offset
+		if pair > maxPort || !portAvailable(newPort) || !portAvailable(int32(pair)) {
+			continue
+		}
+		if !leasePort(port) {
+			continue
+		}
+		if !leasePort(pair) {
+			ReleasePorts(port)
+			continue
+		}
+		return port, nil
+	}
+	return 0, errors.New("running out of available ports")
+}
+
 // CheckExecutable checks if given names are executables
 func CheckExecutable(names ...string) error {
 	for _, name := range names {
@@ -78,17 +120,29 @@ func CheckListening(ports ...int) bool {
 // Exec runs "name" and "arg" in directory "workdir" with environements "envs" and wait util
 // process finined. It returns error if fail to execute or exit code is not zero.
 func Exec(workdir string, envs []string, stdin io.Reader, name string, arg ...interface{}) error {
+	return ExecContext(context.Background(), workdir, envs, stdin, name, arg...)
+}
+
+// ExecContext is like Exec but kills the process if ctx is done before it finishes.
+// The command and its output are appended to exec.log in workdir if it's set.
+func ExecContext(ctx context.Context, workdir string, envs []string, stdin io.Reader, name string, arg ...interface{}) error {
 	argStr := make([]string, 0, len(arg))
 	for _, a := range arg {
 		argStr = append(argStr, fmt.Sprintf("%v", a))
 	}
-	cmd := exec.Command(name, argStr...)
+	cmd := exec.CommandContext(ctx, name, argStr...)
 	cmd.Env = append(os.Environ(), envs...)
 	cmd.Dir = workdir
 	if stdin != nil {
 		cmd.Stdin = stdin
 	}
 	bs, err := cmd.CombinedOutput()
+	if workdir != "" {
+		appendExecLog(workdir, name, argStr, bs)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("fail to start process, output:%s, err:%v", string(bs), ctx.Err())
+	}
 	if err != nil {
 		return fmt.Errorf("fail to start process, output:%s, err:%v", string(bs), err)
 	}
@@ -98,6 +152,30 @@ func Exec(workdir string, envs []string, stdin io.Reader, name string, arg ...in
 	return nil
 }
 
+// appendExecLog appends the command and its output to exec.log in workdir. It's best
+// effort, as outputs are also in errors of failed commands.
+func appendExecLog(workdir, name string, args []string, output []byte) {
+	f, err := os.OpenFile(filepath.Join(workdir, execLogFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "$ %s\n%s", strings.Join(append([]string{name}, args...), " "), output)
+	if len(output) > 0 && output[len(output)-1] != '\n' {
+		f.Write([]byte{'\n'})
+	}
+}
+
+// globFiles returns files in dir matching any of the patterns
+func globFiles(dir string, patterns ...string) []string {
+	result := []string{}
+	for _, p := range patterns {
+		matches, _ := filepath.Glob(filepath.Join(dir, p))
+		result = append(result, matches...)
+	}
+	return result
+}
+
 // CombineError given errors into one err, note that nil error will be ignored
 func CombineError(errs ...error) error {
 	result := []string{}
@@ -115,7 +193,7 @@ func CombineError(errs ...error) error {
 func portAvailable(port int32, host ...string) bool {
 	// Listen to tcp4 only instead of tcp which may return an ipv6 address port.
 	h := ""
-	if len(h) != 0 {
+	if len(host) != 0 {
 		h = host[0]
 	}
 	l, err := net.Listen("tcp4", fmt.Sprintf("%s:%d", h, port))
@@ -129,29 +207,77 @@ func portAvailable(port int32, host ...string) bool {
 // WaitPortAvail waits until the port becomes dialable. It returns error if it's not
 // available after timeout.
 func WaitPortAvail(port int, timeout time.Duration, host ...string) error {
+	return WaitPortAvailContext(context.Background(), port, timeout, host...)
+}
+
+// WaitPortAvailContext is like WaitPortAvail but also gives up once ctx is done.
+func WaitPortAvailContext(ctx context.Context, port int, timeout time.Duration, host ...string) error {
 	h := "localhost"
 	if len(host) != 0 {
 		h = host[0]
 	}
-	addr := fmt.Sprintf("%s:%d", h, port)
-	timer := time.NewTimer(timeout)
+	addr := net.JoinHostPort(h, strconv.Itoa(port))
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 	wait := 1 * time.Second
 	for {
-		c, err := net.Dial("tcp", addr)
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "tcp", addr)
 		if err == nil {
 			c.Close()
-			timer.Stop()
 			return nil
 		}
-		fmt.Printf("Attempt to dial %v failed, err %v\n", addr, err)
+		logf(ctx, LevelDebug, "attempt to dial %v failed, err %v", addr, err)
+		if err := sleepContext(ctx, wait); err != nil {
+			return fmt.Errorf("attempt to dial %v timeout after %v: %v", port, timeout, err)
+		}
+		logf(ctx, LevelDebug, "do another try after waiting for %v", wait)
+		wait *= 2
+	}
+}
+
+// sleepContext pauses for d. It returns ctx.Err() if ctx is done earlier.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// stopProcess terminates the process of cmd with SIGTERM and waits for its exit. The
+// process is killed if it doesn't exit within timeout or before ctx is done, which
+// isn't an error as the process is reaped anyway. It's a no-op if the process isn't
+// started.
+func stopProcess(ctx context.Context, cmd *exec.Cmd, timeout time.Duration) error {
+	if cmd == nil || cmd.Process == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		// the exit status of terminated processes is an error
+		cmd.Wait()
+		close(done)
+	}()
+	if err := cmd.Process.Signal(syscall.SIGTERM); err == nil {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
 		select {
+		case <-done:
+			return nil
 		case <-timer.C:
-			return fmt.Errorf("attempt to dial %v timeout after %v", port, timeout)
-		case <-time.After(wait):
-			fmt.Printf("Do another try after waiting for %v\n", wait)
-			wait *= 2
+			logf(ctx, LevelWarn, "process %d doesn't exit after %v, kill it", cmd.Process.Pid, timeout)
+		case <-ctx.Done():
+			logf(ctx, LevelWarn, "process %d doesn't exit before ctx is done, kill it", cmd.Process.Pid)
 		}
 	}
+	// killing fails only if the process has exited
+	cmd.Process.Kill()
+	<-done
+	return nil
 }
 
 func GetPort() int {
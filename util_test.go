@@ -1,9 +1,16 @@
 package test
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -27,5 +34,86 @@ func TestBookPorts(t *testing.T) {
 		}()
 	}
 	wg.Wait()
+	for p := range ports {
+		assert.NoError(t, ReleasePorts(p))
+	}
 	fmt.Println("done")
 }
+
+func TestBookBusPort(t *testing.T) {
+	// the cursor is low enough that bus ports of lower candidates exceed maxPort
+	atomic.StoreInt32(&curPort, minPort+10)
+	b := &serviceBase{}
+	defer b.releasePorts()
+	for i := 0; i < 20; i++ {
+		port, err := b.bookBusPort(10000)
+		assert.NoError(t, err)
+		assert.True(t, port >= minPort && port+10000 <= maxPort)
+		owner, err := portLeaseOwner(port + 10000)
+		assert.NoError(t, err)
+		assert.Equal(t, os.Getpid(), owner)
+	}
+	assert.Len(t, b.leased, 40, "only booked pairs are leased")
+}
+
+func TestWaitPortAvailContext(t *testing.T) {
+	ports, err := BookPorts(1)
+	assert.NoError(t, err)
+	defer ReleasePorts(ports...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = WaitPortAvailContext(ctx, ports[0], time.Minute)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "ctx isn't honored")
+}
+
+func TestStopProcess(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	assert.NoError(t, cmd.Start())
+	start := time.Now()
+	assert.NoError(t, stopProcess(context.Background(), cmd, time.Minute))
+	assert.True(t, time.Since(start) < 5*time.Second, "sleep isn't terminated")
+
+	// processes ignoring SIGTERM are killed after timeout
+	cmd = exec.Command("sh", "-c", `trap "" TERM; sleep 10`)
+	assert.NoError(t, cmd.Start())
+	// let sh set the trap
+	time.Sleep(200 * time.Millisecond)
+	start = time.Now()
+	assert.NoError(t, stopProcess(context.Background(), cmd, 100*time.Millisecond))
+	assert.True(t, time.Since(start) >= 100*time.Millisecond, "sh isn't trapping SIGTERM")
+	assert.True(t, time.Since(start) < 5*time.Second, "sh isn't killed")
+
+	// stopping again is harmless
+	assert.NoError(t, stopProcess(context.Background(), cmd, time.Second))
+
+	// processes killed as ctx is done are still stopped cleanly
+	cmd = exec.Command("sh", "-c", `trap "" TERM; sleep 10`)
+	assert.NoError(t, cmd.Start())
+	time.Sleep(200 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, stopProcess(ctx, cmd, time.Minute))
+	assert.NotNil(t, cmd.ProcessState, "sh isn't reaped")
+}
+
+func TestStopProcessNotStarted(t *testing.T) {
+	assert.NoError(t, stopProcess(context.Background(), nil, time.Second))
+	assert.NoError(t, stopProcess(context.Background(), exec.Command("sleep", "10"), time.Second))
+	// stopping etcd which never starts doesn't panic
+	assert.NoError(t, (&etcdService{}).Stop())
+}
+
+func TestExecContextLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, ExecContext(context.Background(), dir, nil, nil, "echo", "hello"))
+	assert.Error(t, ExecContext(context.Background(), dir, nil, nil, "sh", "-c", "printf oops; exit 1"))
+	bs, err := ioutil.ReadFile(filepath.Join(dir, execLogFileName))
+	assert.NoError(t, err)
+	assert.Equal(t, "$ echo hello\nhello\n$ sh -c printf oops; exit 1\noops\n", string(bs))
+}
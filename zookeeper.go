@@ -1,12 +1,16 @@
 package test
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
+	"github.com/samuel/go-zookeeper/zk"
 )
 
 const (
@@ -18,28 +22,52 @@ initLimit=20
 syncLimit=20
 dataDir={{.ZK_DATA_DIR}}
 clientPort={{.ZK_PORT}}
-`
+4lw.commands.whitelist=*
+{{if .ZK_SASL}}authProvider.1=org.apache.zookeeper.server.auth.SASLAuthenticationProvider
+{{end}}{{range .ZK_SERVERS}}{{.}}
+{{end}}`
+	zkReadyTimeout = 20 * time.Second
+	// zkSessionTimeout is the session timeout of zookeeper clients
+	zkSessionTimeout = 3 * time.Second
+	// zkDockerPort is the client port inside the container
+	zkDockerPort = 2181
 )
 
 func init() {
 	RegisterService(ZooKeeper, func() Service {
 		return &zkService{}
 	})
+	RegisterSpecOption(ZooKeeper, "chroot", stringSpecOption(ZkChroot))
+	RegisterSpecOption(ZooKeeper, "fixture", stringSpecOption(ZkFixtureFile))
 }
 
 type zkService struct {
+	serviceBase
 	port    int
 	workDir string
+	// chroot and seeds are created once the server is ready
+	chroot   string
+	seeds    []ZNode
+	fixtures []ZkFixtureNode
+	// session keeps ephemeral znodes of fixtures
+	session *zk.Conn
+	// user and password of digest auth
+	user     string
+	password string
 }
 
 func (s *zkService) Start() (string, error) {
+	return s.StartContext(context.Background())
+}
+
+func (s *zkService) StartContext(ctx context.Context) (string, error) {
 	// perform default check
-	if err := CheckExecutable("java", "zkServer.sh"); err != nil {
+	if err := s.checkNative(); err != nil {
 		return "", err
 	}
 
 	// booking 4 ports
-	ports, err := BookPorts(1)
+	ports, err := s.bookPorts(1)
 	if err != nil {
 		return "", fmt.Errorf("fail to book ports, err:%v", err)
 	}
@@ -48,52 +76,308 @@ func (s *zkService) Start() (string, error) {
 	// prepare tmp dir
 	s.workDir, err = ioutil.TempDir("", "zk-test")
 	if err != nil {
+		s.releasePorts()
 		return "", fmt.Errorf("fail to prepare tmp dir, err:%v", err)
 	}
 
 	// prepare cfg
+	sasl, err := s.writeJaas()
+	if err != nil {
+		s.releasePorts()
+		return "", err
+	}
 	if err = ApplyTemplate(
 		s.cfgFile(),
 		zkCfgTpl,
 		map[string]interface{}{
 			"ZK_PORT":     s.port,
 			"ZK_DATA_DIR": s.workDir,
+			"ZK_SASL":     sasl,
 		}); err != nil {
+		s.releasePorts()
 		return "", fmt.Errorf("fail to prepare cfg file, err:%v", err)
 	}
+	envs := []string{}
+	if sasl {
+		envs = append(envs, "SERVER_JVMFLAGS=-Djava.security.auth.login.config="+s.jaasFile())
+	}
 
 	// leverage zkServer.sh to start zk with config file
-	if err := Exec(
-		s.workDir, nil, nil,
+	if err := markOwner(ZooKeeper, s.workDir, nil, "zookeeper_server.pid"); err != nil {
+		s.releasePorts()
+		return "", fmt.Errorf("fail to mark owner, err:%v", err)
+	}
+	if err := ExecContext(
+		ctx, s.workDir, envs, nil,
 		"zkServer.sh", "start", s.cfgFile()); err != nil {
+		s.Stop()
 		return "", fmt.Errorf("fail to start hbase master, err:%v", err)
 	}
 
 	// Make sure zk really starts
-	if err := WaitPortAvail(s.port, 20*time.Second); err != nil {
-		return "", fmt.Errorf("port %v isn't available after 20 sec", s.port)
+	ipport := fmt.Sprintf("localhost:%d", s.port)
+	if err := s.waitReady(ctx, ipport, zkReadyTimeout, ZkRuokProbe()); err != nil {
+		s.Stop()
+		return "", fmt.Errorf("zk isn't ready after %v, err:%v", zkReadyTimeout, err)
 	}
-
-	// only need region server thrift port
-	return fmt.Sprintf("localhost:%d", s.port), nil
+	if err := s.setup(ctx, ipport); err != nil {
+		s.Stop()
+		return "", fmt.Errorf("fail to set up zk, err:%v", err)
+	}
+	return ipport, nil
 }
 
 func (s *zkService) Stop() error {
-	return Exec(
-		s.workDir, nil, nil,
+	return s.StopContext(context.Background())
+}
+
+func (s *zkService) StopContext(ctx context.Context) error {
+	defer s.releasePorts()
+	s.closeSession()
+	return ExecContext(
+		ctx, s.workDir, nil, nil,
 		"zkServer.sh", "stop", s.cfgFile())
 }
 
+// logFiles returns output files written by zkServer.sh
+func (s *zkService) logFiles() []string {
+	return globFiles(s.workDir, "*.out", "*.log")
+}
+
+// checkNative checks executables required to start the service natively
+func (s *zkService) checkNative() error {
+	return CheckExecutable("java", "zkServer.sh")
+}
+
 // StartDocker start the service via docker
 func (s *zkService) StartDocker(cl *docker.Client) (string, error) {
-	return "", fmt.Errorf("implmenet this")
+	return s.StartDockerContext(context.Background(), cl)
+}
+
+// StartDockerContext start the service via docker
+func (s *zkService) StartDockerContext(ctx context.Context, cl *docker.Client) (ipport string, err error) {
+	// prepare tmp dir
+	s.workDir, err = ioutil.TempDir("", "zk-test")
+	if err != nil {
+		return "", fmt.Errorf("fail to prepare tmp dir, err:%v", err)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(s.workDir)
+		}
+	}()
+
+	// prepare cfg with paths inside the container
+	sasl, err := s.writeJaas()
+	if err != nil {
+		return "", err
+	}
+	if err = ApplyTemplate(
+		s.cfgFile(),
+		zkCfgTpl,
+		map[string]interface{}{
+			"ZK_PORT":     zkDockerPort,
+			"ZK_DATA_DIR": "/data",
+			"ZK_SASL":     sasl,
+		}); err != nil {
+		return "", fmt.Errorf("fail to prepare cfg file, err:%v", err)
+	}
+	binds := []string{s.cfgFile() + ":/conf/zoo.cfg:ro"}
+	envs := []string{}
+	if sasl {
+		binds = append(binds, s.jaasFile()+":"+zkDockerJaasFile+":ro")
+		envs = append(envs, "SERVER_JVMFLAGS=-Djava.security.auth.login.config="+zkDockerJaasFile)
+	}
+
+	s.container, ipport, err = StartContainerContext(
+		ctx, cl,
+		SetImage("zookeeper:3.5"),
+		SetExposedPorts([]string{fmt.Sprintf("%d/tcp", zkDockerPort)}),
+		SetBinds(binds),
+		SetEnv(envs),
+	)
+	if err != nil {
+		return "", err
+	}
+	if err := s.waitReady(ctx, ipport, zkReadyTimeout, ZkRuokProbe()); err != nil {
+		RemoveContainer(cl, s.container)
+		return "", fmt.Errorf("zk isn't ready after %v, err:%v", zkReadyTimeout, err)
+	}
+	if err := s.setup(ctx, ipport); err != nil {
+		RemoveContainer(cl, s.container)
+		return "", fmt.Errorf("fail to set up zk, err:%v", err)
+	}
+	return ipport, nil
 }
 
 // StopDocker stops the service via docker
 func (s *zkService) StopDocker(cl *docker.Client) error {
-	return fmt.Errorf("implmenet this")
+	return s.StopDockerContext(context.Background(), cl)
 }
 
+// StopDockerContext stops the service via docker, and removes the work dir
+func (s *zkService) StopDockerContext(ctx context.Context, cl *docker.Client) error {
+	s.closeSession()
+	return CombineError(RemoveContainerContext(ctx, cl, s.container), os.RemoveAll(s.workDir))
+}
+
+// Reset deletes all znodes except the system ones under /zookeeper, and creates the
+// chroot again if it's set
+func (s *zkService) Reset(ctx context.Context, ipport string) error {
+	conn, err := s.connect([]string{ipport})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := zkClear(ctx, conn); err != nil {
+		return err
+	}
+	if s.chroot != "" {
+		return zkCreateAll(ctx, conn, s.chroot, nil, nil)
+	}
+	return nil
+}
+
+// zkClear deletes all znodes except the system ones under /zookeeper
+func zkClear(ctx context.Context, conn *zk.Conn) error {
+	children, _, err := conn.Children("/")
+	if err != nil {
+		return fmt.Errorf("fail to list znodes, err:%v", err)
+	}
+	for _, child := range children {
+		if child == "zookeeper" {
+			continue
+		}
+		if err := zkDeleteAll(ctx, conn, "/"+child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zkNode is a znode in zookeeper snapshots
+type zkNode struct {
+	Path string `json:"path"`
+	Data []byte `json:"data,omitempty"`
+	// ACL is open to the world if empty
+	ACL []zk.ACL `json:"acl,omitempty"`
+}
+
+// Snapshot saves persistent znodes with their ACLs except the system ones under
+// /zookeeper
+func (s *zkService) Snapshot(ctx context.Context, ipport, name string) error {
+	conn, err := s.connect([]string{ipport})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	nodes := []zkNode{}
+	var walk func(path string) error
+	walk = func(path string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		children, _, err := conn.Children(path)
+		if err != nil {
+			return fmt.Errorf("fail to list %s, err:%v", path, err)
+		}
+		for _, child := range children {
+			p := strings.TrimSuffix(path, "/") + "/" + child
+			if p == "/zookeeper" {
+				continue
+			}
+			data, stat, err := conn.Get(p)
+			if err == zk.ErrNoNode {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("fail to get %s, err:%v", p, err)
+			}
+			if stat.EphemeralOwner != 0 {
+				// ephemeral znodes go with their sessions
+				continue
+			}
+			acl, _, err := conn.GetACL(p)
+			if err != nil {
+				return fmt.Errorf("fail to get acl of %s, err:%v", p, err)
+			}
+			nodes = append(nodes, zkNode{Path: p, Data: data, ACL: acl})
+			if err := walk(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk("/"); err != nil {
+		return err
+	}
+	return writeSnapshot(ZooKeeper, name, nodes)
+}
+
+// Restore deletes all znodes and creates the ones of the snapshot with their ACLs
+func (s *zkService) Restore(ctx context.Context, ipport, name string) error {
+	nodes := []zkNode{}
+	if err := readSnapshot(ZooKeeper, name, &nodes); err != nil {
+		return err
+	}
+	conn, err := s.connect([]string{ipport})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// the chroot is in the snapshot if it's set
+	if err := zkClear(ctx, conn); err != nil {
+		return err
+	}
+	// parents precede their children in snapshots
+	for _, n := range nodes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := conn.Create(n.Path, n.Data, 0, zk.WorldACL(zk.PermAll)); err != nil {
+			return fmt.Errorf("fail to create %s, err:%v", n.Path, err)
+		}
+	}
+	// ACLs are set once all znodes are created, as they may forbid creating children
+	for _, n := range nodes {
+		if len(n.ACL) == 0 {
+			continue
+		}
+		if _, err := conn.SetACL(n.Path, n.ACL, -1); err != nil {
+			return fmt.Errorf("fail to set acl of %s, err:%v", n.Path, err)
+		}
+	}
+	return nil
+}
+
+// zkDeleteAll deletes the znode and its descendants
+func zkDeleteAll(ctx context.Context, conn *zk.Conn, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	children, _, err := conn.Children(path)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fail to list %s, err:%v", path, err)
+	}
+	for _, child := range children {
+		if err := zkDeleteAll(ctx, conn, path+"/"+child); err != nil {
+			return err
+		}
+	}
+	if err := conn.Delete(path, -1); err != nil && err != zk.ErrNoNode {
+		return fmt.Errorf("fail to delete %s, err:%v", path, err)
+	}
+	return nil
+}
+
+// zkNopLogger silences logs of zookeeper clients
+type zkNopLogger struct{}
+
+func (zkNopLogger) Printf(string, ...interface{}) {}
+
 func (s *zkService) cfgFile() string {
 	return filepath.Join(s.workDir, zkCfgFileName)
 }
@@ -0,0 +1,176 @@
+package test
+
+// This file handles chroot, authentication and seeded znodes of zookeeper services,
+// which are prepared right after the server is ready.
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const (
+	zkJaasFileName = "jaas.conf"
+	// zkJaasTpl lets java clients authenticate via SASL DIGEST-MD5 with the credentials
+	zkJaasTpl = `
+Server {
+  org.apache.zookeeper.server.auth.DigestLoginModule required
+  user_{{.ZK_USER}}="{{.ZK_PASSWORD}}";
+};
+`
+	// zkDockerJaasFile is where jaas.conf is mounted in containers
+	zkDockerJaasFile = "/conf/jaas.conf"
+)
+
+// ZNode is a znode seeded by ZkSeed
+type ZNode struct {
+	// Path is relative to the chroot if it's set
+	Path string
+	Data []byte
+	// ACL is open to the world if empty
+	ACL []zk.ACL
+}
+
+// zkOption applies f to the zookeeper service
+func zkOption(name string, f func(*zkService)) ServiceOption {
+	return func(s Service) error {
+		zs, ok := s.(*zkService)
+		if !ok {
+			return fmt.Errorf("can't set zookeeper %s with service %v", name, s)
+		}
+		f(zs)
+		return nil
+	}
+}
+
+// ZkChroot creates the chroot, e.g. "/tenant", once the service is ready. Clients
+// connect to it with ZooKeeperHandle.ConnString.
+func ZkChroot(chroot string) ServiceOption {
+	return func(s Service) error {
+		if !strings.HasPrefix(chroot, "/") || strings.HasSuffix(chroot, "/") {
+			return fmt.Errorf("invalid zookeeper chroot %q", chroot)
+		}
+		return zkOption("chroot", func(zs *zkService) {
+			zs.chroot = chroot
+		})(s)
+	}
+}
+
+// ZkDigestAuth enables SASL authentication of the user with the password for java
+// clients, and authenticates connections of the launcher, e.g. handles, with the
+// digest scheme, so they can access znodes with zk.DigestACL of the user.
+func ZkDigestAuth(user, password string) ServiceOption {
+	return zkOption("digest auth", func(zs *zkService) {
+		zs.user, zs.password = user, password
+	})
+}
+
+// ZkSeed creates the znodes once the service is ready. Missing parents are created
+// with open ACLs, and parents should precede their children.
+func ZkSeed(nodes ...ZNode) ServiceOption {
+	return zkOption("seed", func(zs *zkService) {
+		zs.seeds = append(zs.seeds, nodes...)
+	})
+}
+
+// writeJaas writes jaas.conf into the work dir if digest auth is set, and returns
+// whether it's written
+func (s *zkService) writeJaas() (bool, error) {
+	if s.user == "" {
+		return false, nil
+	}
+	if err := ApplyTemplate(
+		s.jaasFile(),
+		zkJaasTpl,
+		map[string]interface{}{
+			"ZK_USER":     s.user,
+			"ZK_PASSWORD": s.password,
+		}); err != nil {
+		return false, fmt.Errorf("fail to prepare jaas file, err:%v", err)
+	}
+	return true, nil
+}
+
+func (s *zkService) jaasFile() string {
+	return filepath.Join(s.workDir, zkJaasFileName)
+}
+
+// connect connects to servers, authenticated if digest auth is set
+func (s *zkService) connect(servers []string) (*zk.Conn, error) {
+	conn, _, err := zk.Connect(servers, zkSessionTimeout, zk.WithLogger(zkNopLogger{}))
+	if err != nil {
+		return nil, err
+	}
+	if s.user != "" {
+		if err := conn.AddAuth("digest", []byte(s.user+":"+s.password)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("fail to authenticate %s, err:%v", s.user, err)
+		}
+	}
+	return conn, nil
+}
+
+// setup creates the chroot, seeded znodes and the ones of fixtures
+func (s *zkService) setup(ctx context.Context, ipport string) error {
+	if s.chroot != "" || len(s.seeds) > 0 {
+		if err := s.seed(ctx, ipport); err != nil {
+			return err
+		}
+	}
+	return s.loadFixtures(ctx, ipport)
+}
+
+// seed creates the chroot and seeded znodes
+func (s *zkService) seed(ctx context.Context, ipport string) error {
+	conn, err := s.connect([]string{ipport})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if s.chroot != "" {
+		if err := zkCreateAll(ctx, conn, s.chroot, nil, nil); err != nil {
+			return err
+		}
+	}
+	for _, n := range s.seeds {
+		if err := zkCreateAll(ctx, conn, s.chroot+n.Path, n.Data, n.ACL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zkCreateAll creates the znode with missing parents, which are open to the world.
+// The znode is updated if it exists.
+func zkCreateAll(ctx context.Context, conn *zk.Conn, path string, data []byte, acl []zk.ACL) error {
+	if len(acl) == 0 {
+		acl = zk.WorldACL(zk.PermAll)
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i := range parts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p := "/" + strings.Join(parts[:i+1], "/")
+		if i < len(parts)-1 {
+			_, err := conn.Create(p, nil, 0, zk.WorldACL(zk.PermAll))
+			if err != nil && err != zk.ErrNodeExists {
+				return fmt.Errorf("fail to create %s, err:%v", p, err)
+			}
+			continue
+		}
+		_, err := conn.Create(p, data, 0, acl)
+		if err == zk.ErrNodeExists {
+			if _, err = conn.Set(p, data, -1); err == nil {
+				_, err = conn.SetACL(p, acl, -1)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("fail to create %s, err:%v", p, err)
+		}
+	}
+	return nil
+}
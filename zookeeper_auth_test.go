@@ -0,0 +1,50 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZkChroot(t *testing.T) {
+	s := &zkService{}
+	assert.NoError(t, ZkChroot("/tenant/a")(s))
+	assert.Equal(t, "/tenant/a", s.chroot)
+	assert.Error(t, ZkChroot("tenant")(s))
+	assert.Error(t, ZkChroot("/tenant/")(s))
+	assert.Error(t, ZkChroot("/tenant")(&redisService{}))
+
+	h := &ZooKeeperHandle{Servers: []string{"a:1", "b:2"}, Chroot: s.chroot}
+	assert.Equal(t, "a:1,b:2/tenant/a", h.ConnString())
+}
+
+func TestZkDigestAuthConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zk-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := &zkService{workDir: dir}
+	sasl, err := s.writeJaas()
+	assert.NoError(t, err)
+	assert.False(t, sasl)
+
+	assert.NoError(t, ZkDigestAuth("app", "secret")(s))
+	sasl, err = s.writeJaas()
+	assert.NoError(t, err)
+	assert.True(t, sasl)
+	jaas, err := ioutil.ReadFile(filepath.Join(dir, zkJaasFileName))
+	assert.NoError(t, err)
+	assert.Contains(t, string(jaas), `user_app="secret";`)
+
+	assert.NoError(t, ApplyTemplate(s.cfgFile(), zkCfgTpl, map[string]interface{}{
+		"ZK_PORT":     2181,
+		"ZK_DATA_DIR": dir,
+		"ZK_SASL":     sasl,
+	}))
+	cfg, err := ioutil.ReadFile(s.cfgFile())
+	assert.NoError(t, err)
+	assert.Contains(t, string(cfg), "authProvider.1=org.apache.zookeeper.server.auth.SASLAuthenticationProvider\n")
+}
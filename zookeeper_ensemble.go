@@ -0,0 +1,409 @@
+package test
+
+// This file handles zookeeper ensembles. Every member books client, quorum and
+// election ports, and its config lists all members as server.N lines where N is the
+// myid of the member, i.e. its index plus 1. Members can be stopped and started
+// again to test leader loss.
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	zkEnsembleReadyTimeout = 60 * time.Second
+	zkMyIDFileName         = "myid"
+)
+
+func init() {
+	RegisterService(ZkEnsemble, func() Service {
+		return &zkEnsembleService{size: 3}
+	})
+	RegisterSpecOption(ZkEnsemble, "size", intSpecOption(ZkEnsembleSize))
+}
+
+// zkMember is a member of zookeeper ensemble
+type zkMember struct {
+	workDir  string
+	client   int
+	quorum   int
+	election int
+	running  bool
+}
+
+func (m *zkMember) cfgFile() string {
+	return filepath.Join(m.workDir, zkCfgFileName)
+}
+
+func (m *zkMember) addr() string {
+	return fmt.Sprintf("localhost:%d", m.client)
+}
+
+type zkEnsembleService struct {
+	serviceBase
+	size    int
+	members []*zkMember
+	// lock protects running states of members
+	lock sync.Mutex
+}
+
+// Start starts all members and returns ip:port of the first one
+func (s *zkEnsembleService) Start() (string, error) {
+	return s.StartContext(context.Background())
+}
+
+// StartContext starts all members and waits until a leader is elected
+func (s *zkEnsembleService) StartContext(ctx context.Context) (string, error) {
+	if err := s.checkNative(); err != nil {
+		return "", err
+	}
+	if s.size < 1 {
+		return "", fmt.Errorf("invalid ensemble size %d", s.size)
+	}
+
+	// booking client, quorum and election ports of each member
+	ports, err := s.bookPorts(3 * s.size)
+	if err != nil {
+		return "", fmt.Errorf("fail to book ports, err:%v", err)
+	}
+	servers := []string{}
+	for i := 0; i < s.size; i++ {
+		m := &zkMember{client: ports[3*i], quorum: ports[3*i+1], election: ports[3*i+2]}
+		s.members = append(s.members, m)
+		servers = append(servers, fmt.Sprintf("server.%d=localhost:%d:%d", i+1, m.quorum, m.election))
+	}
+	if s.size == 1 {
+		// a single server runs standalone
+		servers = nil
+	}
+
+	if err := s.prepareMembers(servers); err != nil {
+		s.Stop()
+		return "", err
+	}
+
+	for i := range s.members {
+		if err := s.startMember(ctx, i); err != nil {
+			s.Stop()
+			return "", err
+		}
+	}
+
+	ipport := s.members[0].addr()
+	if err := s.waitReady(ctx, ipport, zkEnsembleReadyTimeout, ProbeFunc(s.checkLeader)); err != nil {
+		s.Stop()
+		return "", fmt.Errorf("zk ensemble isn't ready after %v, err:%v", zkEnsembleReadyTimeout, err)
+	}
+	return ipport, nil
+}
+
+// prepareMembers prepares tmp dir, cfg and myid of members
+func (s *zkEnsembleService) prepareMembers(servers []string) error {
+	for i, m := range s.members {
+		dir, err := ioutil.TempDir("", "zk-test")
+		if err != nil {
+			return fmt.Errorf("fail to prepare tmp dir, err:%v", err)
+		}
+		m.workDir = dir
+		if err = ApplyTemplate(
+			m.cfgFile(),
+			zkCfgTpl,
+			map[string]interface{}{
+				"ZK_PORT":     m.client,
+				"ZK_DATA_DIR": m.workDir,
+				"ZK_SERVERS":  servers,
+			}); err != nil {
+			return fmt.Errorf("fail to prepare cfg file, err:%v", err)
+		}
+		myid := filepath.Join(m.workDir, zkMyIDFileName)
+		if err := ioutil.WriteFile(myid, []byte(strconv.Itoa(i+1)), 0666); err != nil {
+			return fmt.Errorf("fail to write myid, err:%v", err)
+		}
+		if err := markOwner(ZkEnsemble, m.workDir, nil, "zookeeper_server.pid"); err != nil {
+			return fmt.Errorf("fail to mark owner, err:%v", err)
+		}
+	}
+	return nil
+}
+
+// startMember starts the member with zkServer.sh
+func (s *zkEnsembleService) startMember(ctx context.Context, i int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if i < 0 || i >= len(s.members) {
+		return fmt.Errorf("no member %d in ensemble of %d", i, len(s.members))
+	}
+	m := s.members[i]
+	if m.running {
+		return fmt.Errorf("member %d is running", i)
+	}
+	if err := ExecContext(ctx, m.workDir, nil, nil, "zkServer.sh", "start", m.cfgFile()); err != nil {
+		return fmt.Errorf("fail to start member %d, err:%v", i, err)
+	}
+	m.running = true
+	return nil
+}
+
+// stopMember stops the member with zkServer.sh
+func (s *zkEnsembleService) stopMember(ctx context.Context, i int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if i < 0 || i >= len(s.members) {
+		return fmt.Errorf("no member %d in ensemble of %d", i, len(s.members))
+	}
+	m := s.members[i]
+	if !m.running {
+		return fmt.Errorf("member %d isn't running", i)
+	}
+	m.running = false
+	if err := ExecContext(ctx, m.workDir, nil, nil, "zkServer.sh", "stop", m.cfgFile()); err != nil {
+		return fmt.Errorf("fail to stop member %d, err:%v", i, err)
+	}
+	return nil
+}
+
+// running returns indexes of running members
+func (s *zkEnsembleService) running() []int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	result := []int{}
+	for i, m := range s.members {
+		if m.running {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+// checkLeader checks if running members have elected exactly one leader
+func (s *zkEnsembleService) checkLeader(ctx context.Context, ipport string) error {
+	_, err := s.leader(ctx)
+	return err
+}
+
+// leader returns index of the leader, which all running members must agree on
+func (s *zkEnsembleService) leader(ctx context.Context) (int, error) {
+	leader := -1
+	for _, i := range s.running() {
+		mode, err := zkMode(ctx, s.members[i].addr())
+		if err != nil {
+			return -1, fmt.Errorf("member %d isn't serving, err:%v", i, err)
+		}
+		switch mode {
+		case "leader", "standalone":
+			if leader >= 0 {
+				return -1, fmt.Errorf("members %d and %d both lead", leader, i)
+			}
+			leader = i
+		case "follower", "observer":
+		default:
+			return -1, fmt.Errorf("member %d is in mode %q", i, mode)
+		}
+	}
+	if leader < 0 {
+		return -1, fmt.Errorf("no leader is elected")
+	}
+	return leader, nil
+}
+
+// Stop stops running members
+func (s *zkEnsembleService) Stop() error {
+	return s.StopContext(context.Background())
+}
+
+// StopContext stops running members and removes their work dirs
+func (s *zkEnsembleService) StopContext(ctx context.Context) error {
+	defer s.releasePorts()
+	errs := []error{}
+	for _, i := range s.running() {
+		errs = append(errs, s.stopMember(ctx, i))
+	}
+	for _, m := range s.members {
+		if m.workDir != "" {
+			errs = append(errs, os.RemoveAll(m.workDir))
+		}
+	}
+	return CombineError(errs...)
+}
+
+// logFiles returns output files written by zkServer.sh of all members
+func (s *zkEnsembleService) logFiles() []string {
+	files := []string{}
+	for _, m := range s.members {
+		files = append(files, globFiles(m.workDir, "*.out", "*.log")...)
+	}
+	return files
+}
+
+// checkNative checks executables required to start the service natively
+func (s *zkEnsembleService) checkNative() error {
+	return CheckExecutable("java", "zkServer.sh")
+}
+
+// StartDocker isn't supported as members have to know addresses of each other
+// before they start
+func (s *zkEnsembleService) StartDocker(cl *docker.Client) (string, error) {
+	return s.StartDockerContext(context.Background(), cl)
+}
+
+// StartDockerContext isn't supported as members have to know addresses of each other
+// before they start
+func (s *zkEnsembleService) StartDockerContext(ctx context.Context, cl *docker.Client) (string, error) {
+	return "", fmt.Errorf("zookeeper ensemble isn't supported via docker")
+}
+
+// StopDocker stops the service via docker
+func (s *zkEnsembleService) StopDocker(cl *docker.Client) error {
+	return s.StopDockerContext(context.Background(), cl)
+}
+
+// StopDockerContext stops the service via docker
+func (s *zkEnsembleService) StopDockerContext(ctx context.Context, cl *docker.Client) error {
+	return nil
+}
+
+// endpoints returns client, quorum and election endpoints of members
+func (s *zkEnsembleService) endpoints() []Endpoint {
+	eps := []Endpoint{}
+	for i, m := range s.members {
+		eps = append(eps,
+			Endpoint{Name: fmt.Sprintf("client_%d", i), Protocol: ProtocolZooKeeper, Port: m.client},
+			Endpoint{Name: fmt.Sprintf("quorum_%d", i), Protocol: ProtocolTCP, Port: m.quorum},
+			Endpoint{Name: fmt.Sprintf("election_%d", i), Protocol: ProtocolTCP, Port: m.election},
+		)
+	}
+	return eps
+}
+
+// servers returns client addresses of all members
+func (s *zkEnsembleService) servers() []string {
+	result := []string{}
+	for _, m := range s.members {
+		result = append(result, m.addr())
+	}
+	return result
+}
+
+// serving returns the client address of a running member
+func (s *zkEnsembleService) serving() (string, error) {
+	running := s.running()
+	if len(running) == 0 {
+		return "", fmt.Errorf("no member is running")
+	}
+	return s.members[running[0]].addr(), nil
+}
+
+// Reset deletes all znodes except the system ones under /zookeeper
+func (s *zkEnsembleService) Reset(ctx context.Context, ipport string) error {
+	addr, err := s.serving()
+	if err != nil {
+		return err
+	}
+	return (&zkService{}).Reset(ctx, addr)
+}
+
+// Snapshot saves persistent znodes as snapshots of standalone zookeeper do
+func (s *zkEnsembleService) Snapshot(ctx context.Context, ipport, name string) error {
+	addr, err := s.serving()
+	if err != nil {
+		return err
+	}
+	return (&zkService{}).Snapshot(ctx, addr, name)
+}
+
+// Restore deletes all znodes and creates the ones of the snapshot
+func (s *zkEnsembleService) Restore(ctx context.Context, ipport, name string) error {
+	addr, err := s.serving()
+	if err != nil {
+		return err
+	}
+	return (&zkService{}).Restore(ctx, addr, name)
+}
+
+// zkMode returns the mode reported by srvr, e.g. "leader" or "follower"
+func zkMode(ctx context.Context, ipport string) (string, error) {
+	reply, err := zkFourLetterWord(ctx, ipport, "srvr")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(reply, "\n") {
+		if strings.HasPrefix(line, "Mode:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Mode:")), nil
+		}
+	}
+	return "", fmt.Errorf("no mode in %q", reply)
+}
+
+// zkEnsemble returns the zookeeper ensemble service at ipport
+func zkEnsemble(sl ServiceLauncher, ipport string) (*zkEnsembleService, error) {
+	zs, ok := sl.Get(ipport).(*zkEnsembleService)
+	if !ok {
+		return nil, fmt.Errorf("no zookeeper ensemble at %s", ipport)
+	}
+	return zs, nil
+}
+
+// ZkLeader returns index of the leader of the zookeeper ensemble at ipport
+func ZkLeader(ctx context.Context, sl ServiceLauncher, ipport string) (int, error) {
+	zs, err := zkEnsemble(sl, ipport)
+	if err != nil {
+		return -1, err
+	}
+	return zs.leader(ctx)
+}
+
+// StopZkMember stops the member of the zookeeper ensemble at ipport
+func StopZkMember(ctx context.Context, sl ServiceLauncher, ipport string, member int) error {
+	zs, err := zkEnsemble(sl, ipport)
+	if err != nil {
+		return err
+	}
+	return zs.stopMember(ctx, member)
+}
+
+// StartZkMember starts the stopped member of the zookeeper ensemble at ipport again
+// with its data, and waits until it joins the quorum
+func StartZkMember(ctx context.Context, sl ServiceLauncher, ipport string, member int) error {
+	zs, err := zkEnsemble(sl, ipport)
+	if err != nil {
+		return err
+	}
+	if err := zs.startMember(ctx, member); err != nil {
+		return err
+	}
+	return WaitReady(ctx, zs.members[member].addr(), zkEnsembleReadyTimeout, DefaultBackoff, ProbeFunc(zs.checkLeader))
+}
+
+// WaitZkLeader waits until running members of the zookeeper ensemble at ipport agree
+// on a leader, e.g. after the leader is stopped, and returns its index
+func WaitZkLeader(ctx context.Context, sl ServiceLauncher, ipport string) (int, error) {
+	zs, err := zkEnsemble(sl, ipport)
+	if err != nil {
+		return -1, err
+	}
+	if err := WaitReady(ctx, ipport, zkEnsembleReadyTimeout, DefaultBackoff, ProbeFunc(zs.checkLeader)); err != nil {
+		return -1, err
+	}
+	return zs.leader(ctx)
+}
+
+// ZkEnsembleSize sets the number of members, which is 3 by default
+func ZkEnsembleSize(n int) ServiceOption {
+	return func(s Service) error {
+		zs, ok := s.(*zkEnsembleService)
+		if !ok {
+			return fmt.Errorf("can't set zookeeper ensemble size with service %v", s)
+		}
+		zs.size = n
+		return nil
+	}
+}
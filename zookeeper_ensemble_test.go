@@ -0,0 +1,91 @@
+package test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestZkCfgServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zk-cfg-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, zkCfgFileName)
+
+	assert.NoError(t, ApplyTemplate(file, zkCfgTpl, map[string]interface{}{
+		"ZK_PORT":     2181,
+		"ZK_DATA_DIR": "/data",
+	}))
+	bs, _ := ioutil.ReadFile(file)
+	assert.NotContains(t, string(bs), "server.")
+
+	assert.NoError(t, ApplyTemplate(file, zkCfgTpl, map[string]interface{}{
+		"ZK_PORT":     2181,
+		"ZK_DATA_DIR": "/data",
+		"ZK_SERVERS":  []string{"server.1=localhost:1:2", "server.2=localhost:3:4"},
+	}))
+	bs, _ = ioutil.ReadFile(file)
+	assert.Contains(t, string(bs), "\nserver.1=localhost:1:2\nserver.2=localhost:3:4\n")
+}
+
+func TestZkEnsembleEndpoints(t *testing.T) {
+	s := &zkEnsembleService{members: []*zkMember{
+		{client: 1, quorum: 2, election: 3},
+		{client: 4, quorum: 5, election: 6},
+	}}
+	desc, err := describe(ZkEnsemble, s, "localhost:1")
+	assert.NoError(t, err)
+	assert.Len(t, desc.Endpoints, 6)
+	e, _ := desc.Endpoint("election_1")
+	assert.Equal(t, "localhost:6", e.Addr())
+	assert.Equal(t, []string{"localhost:1", "localhost:4"}, s.servers())
+
+	_, err = s.serving()
+	assert.Error(t, err, "no member is running")
+	assert.Error(t, s.stopMember(context.Background(), 0))
+	assert.Error(t, s.stopMember(context.Background(), 2))
+}
+
+func TestZkEnsembleSuite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip zookeeper ensemble test")
+		return
+	}
+	suite.Run(t, new(zkEnsembleSuite))
+}
+
+type zkEnsembleSuite struct {
+	suite.Suite
+}
+
+func (s *zkEnsembleSuite) TestLeaderLoss() {
+	ctx := context.Background()
+	sl := NewServiceLauncher()
+	defer sl.StopAll()
+
+	ipport, _, err := sl.Start(ZkEnsemble, ZkEnsembleSize(3))
+	s.NoError(err)
+	h, err := GetZooKeeper(sl, ipport)
+	s.NoError(err)
+	s.Len(h.Servers, 3)
+	_, err = h.Conn.Create("/csigo", []byte("a"), 0, zk.WorldACL(zk.PermAll))
+	s.NoError(err)
+
+	leader, err := ZkLeader(ctx, sl, ipport)
+	s.NoError(err)
+	s.NoError(StopZkMember(ctx, sl, ipport, leader))
+	newLeader, err := WaitZkLeader(ctx, sl, ipport)
+	s.NoError(err)
+	s.NotEqual(leader, newLeader)
+
+	s.NoError(StartZkMember(ctx, sl, ipport, leader))
+	data, _, err := h.Conn.Get("/csigo")
+	s.NoError(err)
+	s.Equal([]byte("a"), data)
+}
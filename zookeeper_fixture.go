@@ -0,0 +1,199 @@
+package test
+
+// This file loads znode trees described by yaml or json fixtures into zookeeper
+// services, and dumps trees in the same format for golden file comparisons.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+
+	"github.com/samuel/go-zookeeper/zk"
+	"gopkg.in/yaml.v2"
+)
+
+// ZkFixture is a znode tree, e.g.
+//
+//	nodes:
+//	- path: /config/app
+//	  data: '{"debug": true}'
+//	- path: /workers/w-
+//	  ephemeral: true
+//	  sequential: true
+type ZkFixture struct {
+	// Nodes are created in order, so parents should precede their children
+	Nodes []ZkFixtureNode `yaml:"nodes" json:"nodes"`
+}
+
+// ZkFixtureNode is a znode of fixtures. Paths are relative to the chroot if it's
+// set.
+type ZkFixtureNode struct {
+	Path       string `yaml:"path" json:"path"`
+	Data       string `yaml:"data,omitempty" json:"data,omitempty"`
+	Ephemeral  bool   `yaml:"ephemeral,omitempty" json:"ephemeral,omitempty"`
+	Sequential bool   `yaml:"sequential,omitempty" json:"sequential,omitempty"`
+}
+
+// LoadZkFixture loads the fixture from a yaml or json file
+func LoadZkFixture(file string) (*ZkFixture, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseZkFixture(bs)
+}
+
+// ParseZkFixture parses the fixture in yaml or json
+func ParseZkFixture(data []byte) (*ZkFixture, error) {
+	f := &ZkFixture{}
+	// json is a subset of yaml
+	if err := yaml.UnmarshalStrict(data, f); err != nil {
+		return nil, fmt.Errorf("fail to parse zk fixture, err:%v", err)
+	}
+	for _, n := range f.Nodes {
+		if len(n.Path) < 2 || n.Path[0] != '/' || path.Clean(n.Path) != n.Path {
+			return nil, fmt.Errorf("invalid znode path %q", n.Path)
+		}
+	}
+	return f, nil
+}
+
+// YAML returns the fixture in yaml
+func (f *ZkFixture) YAML() ([]byte, error) {
+	return yaml.Marshal(f)
+}
+
+// JSON returns the fixture in indented json
+func (f *ZkFixture) JSON() ([]byte, error) {
+	return json.MarshalIndent(f, "", "  ")
+}
+
+// ZkFixtureFile loads znodes of the yaml or json fixture file once the service is
+// ready. Ephemeral znodes live until the service is stopped.
+func ZkFixtureFile(file string) ServiceOption {
+	return func(s Service) error {
+		f, err := LoadZkFixture(file)
+		if err != nil {
+			return err
+		}
+		return zkOption("fixture", func(zs *zkService) {
+			zs.fixtures = append(zs.fixtures, f.Nodes...)
+		})(s)
+	}
+}
+
+// loadFixtures creates znodes of fixtures with the session, which is kept for
+// ephemeral znodes
+func (s *zkService) loadFixtures(ctx context.Context, ipport string) error {
+	if len(s.fixtures) == 0 {
+		return nil
+	}
+	conn, err := s.connect([]string{ipport})
+	if err != nil {
+		return err
+	}
+	for _, n := range s.fixtures {
+		p := s.chroot + n.Path
+		if parent := path.Dir(p); parent != "/" {
+			ok, _, err := conn.Exists(parent)
+			if err == nil && !ok {
+				err = zkCreateAll(ctx, conn, parent, nil, nil)
+			}
+			if err != nil {
+				conn.Close()
+				return fmt.Errorf("fail to create parent of %s, err:%v", p, err)
+			}
+		}
+		var flags int32
+		if n.Ephemeral {
+			flags |= zk.FlagEphemeral
+		}
+		if n.Sequential {
+			flags |= zk.FlagSequence
+		}
+		if _, err := conn.Create(p, []byte(n.Data), flags, zk.WorldACL(zk.PermAll)); err != nil {
+			conn.Close()
+			return fmt.Errorf("fail to create %s, err:%v", p, err)
+		}
+	}
+	s.session = conn
+	return nil
+}
+
+// closeSession closes the session of fixtures, which drops their ephemeral znodes
+func (s *zkService) closeSession() {
+	if s.session != nil {
+		s.session.Close()
+		s.session = nil
+	}
+}
+
+// DumpZkFixture exports the znode tree of the zookeeper service or ensemble at ipport,
+// under the chroot if it's set. Children are sorted by name, and znodes created as
+// sequential have their actual names without the flag.
+func DumpZkFixture(ctx context.Context, sl ServiceLauncher, ipport string) (*ZkFixture, error) {
+	servers := []string{ipport}
+	zs := &zkService{}
+	switch s := sl.Get(ipport).(type) {
+	case *zkService:
+		zs = s
+	case *zkEnsembleService:
+		servers = s.servers()
+	default:
+		return nil, fmt.Errorf("no zookeeper service at %s", ipport)
+	}
+	conn, err := zs.connect(servers)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	root := zs.chroot
+	if root == "" {
+		root = "/"
+	}
+	f := &ZkFixture{Nodes: []ZkFixtureNode{}}
+	var walk func(p string) error
+	walk = func(p string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		children, _, err := conn.Children(p)
+		if err == zk.ErrNoNode {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("fail to list %s, err:%v", p, err)
+		}
+		sort.Strings(children)
+		for _, child := range children {
+			cp := path.Join(p, child)
+			if cp == "/zookeeper" {
+				continue
+			}
+			data, stat, err := conn.Get(cp)
+			if err == zk.ErrNoNode {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("fail to get %s, err:%v", cp, err)
+			}
+			f.Nodes = append(f.Nodes, ZkFixtureNode{
+				Path:      cp[len(zs.chroot):],
+				Data:      string(data),
+				Ephemeral: stat.EphemeralOwner != 0,
+			})
+			if err := walk(cp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(root); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,44 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseZkFixture(t *testing.T) {
+	f, err := ParseZkFixture([]byte(`
+nodes:
+- path: /config
+- path: /config/app
+  data: '{"debug": true}'
+- path: /workers/w-
+  ephemeral: true
+  sequential: true
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []ZkFixtureNode{
+		{Path: "/config"},
+		{Path: "/config/app", Data: `{"debug": true}`},
+		{Path: "/workers/w-", Ephemeral: true, Sequential: true},
+	}, f.Nodes)
+
+	// json works as well, and round trips
+	bs, err := f.JSON()
+	assert.NoError(t, err)
+	g, err := ParseZkFixture(bs)
+	assert.NoError(t, err)
+	assert.Equal(t, f, g)
+	bs, err = f.YAML()
+	assert.NoError(t, err)
+	g, err = ParseZkFixture(bs)
+	assert.NoError(t, err)
+	assert.Equal(t, f, g)
+
+	for _, p := range []string{"", "/", "config", "/config/", "/a/../b"} {
+		_, err = ParseZkFixture([]byte(`{"nodes": [{"path": "` + p + `"}]}`))
+		assert.Error(t, err, p)
+	}
+	_, err = ParseZkFixture([]byte(`{"nodes": [{"path": "/a", "flags": 1}]}`))
+	assert.Error(t, err, "unknown field")
+}
@@ -1,8 +1,11 @@
 package test
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"testing"
 	"time"
 
@@ -40,6 +43,75 @@ func (s *zkSuite) TestSerivce() {
 	s.True(ok, "no such node")
 }
 
+func (s *zkSuite) TestAuth() {
+	sl := NewServiceLauncher()
+	defer sl.StopAll()
+
+	ipport, _, err := sl.Start(ZooKeeper,
+		ZkChroot("/tenant"),
+		ZkDigestAuth("app", "secret"),
+		ZkSeed(
+			ZNode{Path: "/open/config", Data: []byte("v1")},
+			ZNode{Path: "/secret", Data: []byte("v2"), ACL: zk.DigestACL(zk.PermAll, "app", "secret")},
+		))
+	s.NoError(err)
+
+	h, err := GetZooKeeper(sl, ipport)
+	s.NoError(err)
+	s.Equal(ipport+"/tenant", h.ConnString())
+	data, _, err := h.Conn.Get("/tenant/secret")
+	s.NoError(err)
+	s.Equal("v2", string(data))
+
+	// unauthenticated clients can only read open znodes
+	conn, _, err := zk.Connect([]string{ipport}, 3*time.Second)
+	s.NoError(err)
+	defer conn.Close()
+	data, _, err = conn.Get("/tenant/open/config")
+	s.NoError(err)
+	s.Equal("v1", string(data))
+	_, _, err = conn.Get("/tenant/secret")
+	s.Equal(zk.ErrNoAuth, err)
+
+	// reset keeps the chroot
+	s.NoError(sl.Reset(context.Background(), ipport))
+	children, _, err := conn.Children("/tenant")
+	s.NoError(err)
+	s.Empty(children)
+}
+
+func (s *zkSuite) TestFixture() {
+	file, err := ioutil.TempFile("", "zk-fixture")
+	s.NoError(err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(`
+nodes:
+- path: /config
+  data: root
+- path: /config/app
+  data: v1
+- path: /workers/w-
+  ephemeral: true
+  sequential: true
+`)
+	s.NoError(err)
+	file.Close()
+
+	sl := NewServiceLauncher()
+	defer sl.StopAll()
+	ipport, _, err := sl.Start(ZooKeeper, ZkChroot("/tenant"), ZkFixtureFile(file.Name()))
+	s.NoError(err)
+
+	f, err := DumpZkFixture(context.Background(), sl, ipport)
+	s.NoError(err)
+	s.Equal([]ZkFixtureNode{
+		{Path: "/config", Data: "root"},
+		{Path: "/config/app", Data: "v1"},
+		{Path: "/workers"},
+		{Path: "/workers/w-0000000000", Ephemeral: true},
+	}, f.Nodes)
+}
+
 func (s *zkSuite) TestStop() {
 	service := &zkService{}
 	defer service.Stop()
@@ -57,3 +129,74 @@ func (s *zkSuite) TestStop() {
 	s.NoError(err, "port is listenering")
 	ln.Close()
 }
+
+func (s *zkSuite) TestReset() {
+	service := &zkService{}
+
+	ipport, err := service.Start()
+	s.NoError(err, "start service error")
+	defer service.Stop()
+
+	conn, _, err := zk.Connect([]string{ipport}, 3*time.Second)
+	s.NoError(err, "get conn error")
+	defer conn.Close()
+
+	_, err = conn.Create("/testhome", nil, 0, zk.WorldACL(zk.PermAll))
+	s.NoError(err, "create node error")
+	_, err = conn.Create("/testhome/child", nil, 0, zk.WorldACL(zk.PermAll))
+	s.NoError(err, "create node error")
+
+	s.NoError(service.Reset(context.Background(), ipport), "reset error")
+
+	ok, _, err := conn.Exists("/testhome")
+	s.NoError(err, "get node error")
+	s.False(ok, "node should be deleted")
+	ok, _, err = conn.Exists("/zookeeper")
+	s.NoError(err, "get node error")
+	s.True(ok, "system node should be kept")
+}
+
+func (s *zkSuite) TestSnapshot() {
+	service := &zkService{}
+
+	ipport, err := service.Start()
+	s.NoError(err, "start service error")
+	defer service.Stop()
+
+	conn, _, err := zk.Connect([]string{ipport}, 3*time.Second)
+	s.NoError(err, "get conn error")
+	defer conn.Close()
+
+	_, err = conn.Create("/testhome", []byte("home"), 0, zk.WorldACL(zk.PermAll))
+	s.NoError(err, "create node error")
+	_, err = conn.Create("/testhome/child", []byte("child"), 0, zk.WorldACL(zk.PermAll))
+	s.NoError(err, "create node error")
+	s.NoError(service.Snapshot(context.Background(), ipport, "zk-suite"), "snapshot error")
+
+	s.NoError(service.Reset(context.Background(), ipport), "reset error")
+	s.NoError(service.Restore(context.Background(), ipport, "zk-suite"), "restore error")
+
+	data, _, err := conn.Get("/testhome/child")
+	s.NoError(err, "get node error")
+	s.Equal([]byte("child"), data, "node should be restored")
+}
+
+func (s *zkSuite) TestSnapshotACL() {
+	sl := NewServiceLauncher()
+	defer sl.StopAll()
+	ctx := context.Background()
+
+	ipport, _, err := sl.Start(ZooKeeper,
+		ZkDigestAuth("app", "secret"),
+		ZkSeed(ZNode{Path: "/secret", Data: []byte("v"), ACL: zk.DigestACL(zk.PermAll, "app", "secret")}))
+	s.NoError(err)
+	s.NoError(sl.Snapshot(ctx, ipport, "zk-suite-acl"), "snapshot error")
+	s.NoError(sl.Restore(ctx, ipport, "zk-suite-acl"), "restore error")
+
+	// the restored znode is still closed to unauthenticated clients
+	conn, _, err := zk.Connect([]string{ipport}, 3*time.Second)
+	s.NoError(err)
+	defer conn.Close()
+	_, _, err = conn.Get("/secret")
+	s.Equal(zk.ErrNoAuth, err)
+}